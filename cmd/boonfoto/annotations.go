@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"exif"
+	"filescanner"
+	"iptc"
+	"jpegseg"
+	"xmp"
+)
+
+// annotations are the descriptive fields of a foto. They can be found in
+// several places in and next to a file, and for each field the first of
+// these that has it wins:
+//
+//  1. the XMP sidecar,
+//  2. XMP embedded in the file,
+//  3. the IPTC-IIM block,
+//  4. EXIF ImageDescription, Artist and Copyright.
+//
+// Keywords are taken as a whole from the first source that has any.
+type annotations struct {
+	rating    int
+	label     string
+	title     string
+	caption   string
+	byline    string
+	copyright string
+	city      string
+	keywords  []string
+}
+
+func fromXMP(m xmp.Metadata) annotations {
+	return annotations{rating: m.Rating, label: m.Label, title: m.Title, caption: m.Description,
+		byline: m.Creator, copyright: m.Rights, city: m.City, keywords: m.Keywords}
+}
+
+func fromIPTC(m iptc.Metadata) annotations {
+	return annotations{title: m.Title, caption: m.Caption, byline: m.Byline, copyright: m.Copyright,
+		city: m.City, keywords: m.Keywords}
+}
+
+// placeholderCaptions are written into ImageDescription by cameras rather
+// than people.
+var placeholderCaptions = map[string]bool{
+	"OLYMPUS DIGITAL CAMERA": true,
+	"SONY DSC":               true,
+	"DIGITAL CAMERA":         true,
+}
+
+func fromExif(x *exif.Exif) annotations {
+	a := annotations{caption: x.Description(), byline: x.Artist(), copyright: x.Copyright()}
+	if placeholderCaptions[strings.ToUpper(a.caption)] {
+		a.caption = ""
+	}
+	return a
+}
+
+func mergeAnnotations(sources []annotations) annotations {
+	var a annotations
+	first := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	for _, s := range sources {
+		if a.rating == 0 {
+			a.rating = s.rating
+		}
+		first(&a.label, s.label)
+		first(&a.title, s.title)
+		first(&a.caption, s.caption)
+		first(&a.byline, s.byline)
+		first(&a.copyright, s.copyright)
+		first(&a.city, s.city)
+		if len(a.keywords) == 0 {
+			a.keywords = s.keywords
+		}
+	}
+	return a
+}
+
+// readEmbedded returns the annotations in the file itself, in order of
+// precedence. A JPEG file keeps XMP and IPTC in segments of their own,
+// TIFF-based files in tags of IFD0.
+func readEmbedded(f filescanner.File) []annotations {
+	if !hasExif(f.Format) {
+		return nil
+	}
+	file, err := os.Open(f.Path)
+	if err != nil {
+		log.Println("Failed to read annotations of ", f.Path, ": ", err)
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Println("Failed to read annotations of ", f.Path, ": ", err)
+		return nil
+	}
+
+	// readMetadata reports files whose EXIF data cannot be read.
+	x, exifErr := exif.Decode(file, info.Size())
+
+	var packet []byte
+	var record iptc.Metadata
+	iptcErr := iptc.ErrNoIPTC
+	if f.Format.Name == "jpeg" {
+		segments, err := jpegseg.ReadSegments(io.NewSectionReader(file, 0, info.Size()), func(marker byte) bool {
+			return marker == jpegseg.APP1 || marker == jpegseg.APP13
+		})
+		if err != nil && (exifErr == nil || exifErr == exif.ErrNoExif) {
+			log.Println("Failed to read segments of ", f.Path, ": ", err)
+		}
+		packet = xmp.FindPacket(segments)
+		if segment := iptc.FindSegment(segments); segment != nil {
+			record, iptcErr = iptc.ParsePhotoshop(segment.Data)
+		}
+	} else if x != nil {
+		if e := x.Main.Find(exif.TagXMP); e != nil {
+			packet = e.Value
+		}
+		if e := x.Main.Find(exif.TagIPTC); e != nil {
+			record, iptcErr = iptc.Parse(e.Value)
+		}
+	}
+
+	var sources []annotations
+	if packet != nil {
+		if m, err := xmp.Read(packet); err != nil {
+			log.Println("Failed to read XMP data of ", f.Path, ": ", err)
+		} else {
+			sources = append(sources, fromXMP(m))
+		}
+	}
+	if iptcErr == nil {
+		sources = append(sources, fromIPTC(record))
+	} else if iptcErr != iptc.ErrNoIPTC {
+		log.Println("Failed to read IPTC data of ", f.Path, ": ", iptcErr)
+	}
+	if x != nil {
+		sources = append(sources, fromExif(x))
+	}
+	return sources
+}
+
+// readAnnotations merges the annotations of f from its sidecar and the
+// file. An unreadable sidecar is left out.
+func readAnnotations(f filescanner.File) annotations {
+	var sources []annotations
+	if f.Sidecar != "" {
+		if m, err := xmp.ReadFile(f.Sidecar); err != nil {
+			log.Println("Failed to read sidecar ", f.Sidecar, ": ", err)
+		} else {
+			sources = append(sources, fromXMP(m))
+		}
+	}
+	return mergeAnnotations(append(sources, readEmbedded(f)...))
+}
+
+// annotationStatements returns the statements storing the annotations of
+// the foto at path and the sidecar they were read with.
+func annotationStatements(path string, a annotations, sidecar string, mtime time.Time) []statement {
+	var sidecarMtime interface{}
+	if sidecar != "" {
+		sidecarMtime = mtime.UTC()
+	}
+	statements := []statement{
+		{"UPDATE fotos SET rating = ?, label = ?, title = ?, description = ?, byline = ?, copyright = ?, location_city = ?, " +
+			"sidecar = ?, sidecar_mtime = ? WHERE path = ?",
+			[]interface{}{nullInt(a.rating), nullString(a.label), nullString(a.title), nullString(a.caption),
+				nullString(a.byline), nullString(a.copyright), nullString(a.city),
+				nullString(sidecar), sidecarMtime, path}},
+		{"DELETE FROM foto_keywords WHERE foto_id = (SELECT id FROM fotos WHERE path = ?)", []interface{}{path}},
+	}
+	for _, keyword := range a.keywords {
+		statements = append(statements, statement{
+			"INSERT OR IGNORE INTO foto_keywords (foto_id, keyword) SELECT id, ? FROM fotos WHERE path = ?",
+			[]interface{}{keyword, path}})
+	}
+	return statements
+}
+
+// queueAnnotations reads the annotations of f and queues them for the row
+// at its path.
+func (sp *SqlPopulator) queueAnnotations(f filescanner.File) error {
+	for _, s := range annotationStatements(f.Path, readAnnotations(f), f.Sidecar, f.SidecarModTime) {
+		if err := sp.queue(s.query, s.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSidecar reads the annotations of a file again when its sidecar was
+// added, changed or removed since they were last read. Files whose
+// metadata is still to be read get them along with it.
+func (sp *SqlPopulator) syncSidecar(f filescanner.File, k knownFoto) error {
+	if !k.metadata {
+		return nil
+	}
+	if f.Sidecar == k.sidecar && (f.Sidecar == "" || f.SidecarModTime.Equal(k.sidecarMtime.Time)) {
+		return nil
+	}
+	return sp.queueAnnotations(f)
+}
+
+// loadKeywords returns the keywords of foto id in alphabetical order.
+func loadKeywords(db *sql.DB, id int32) ([]string, error) {
+	rows, err := db.Query("SELECT keyword FROM foto_keywords WHERE foto_id = ? ORDER BY keyword", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keywords []string
+	for rows.Next() {
+		var keyword string
+		if err := rows.Scan(&keyword); err != nil {
+			return nil, err
+		}
+		keywords = append(keywords, keyword)
+	}
+	return keywords, rows.Err()
+}
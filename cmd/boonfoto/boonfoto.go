@@ -2,67 +2,151 @@ package main
 
 import (
 	_ "github.com/mattn/go-sqlite3"
+	"bytes"
 	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"github.com/labstack/echo"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
+
+	"geo"
+	"gpx"
 )
 
-func getIds(db *sql.DB) ([]int32) {
-	rows, err := db.Query("SELECT id FROM fotos ORDER BY mtime, path")
+func main() {
+	configPath := flag.String("config", "./boonfoto.json", "Path of the JSON config file.")
+	scan := flag.Bool("scan", false, "Scan the library roots in the background while serving.")
+	watch := flag.Bool("watch", false, "Watch the library roots for changes while serving.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [serve|duplicates|gpx|shift-time|migrate|render-url]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	config, err := loadConfig(*configPath, isFlagSet("config"))
 	if err != nil {
-		log.Fatal("Failed to load fotos: ", err)
+		log.Fatal("Failed to load config: ", err)
 	}
-	defer rows.Close()
 
-	var idList []int32
-	for rows.Next() {
-		var id int32
-		rows.Scan(&id)
-		idList = append(idList, id)
+	db, err := sql.Open("sqlite3", config.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	command := flag.Arg(0)
+	if command != "migrate" {
+		if _, err := migrate(db, config.Database, os.Stdout, false); err != nil {
+			log.Fatal("Failed to migrate database: ", err)
+		}
 	}
 
-	return idList
-	//c.Insert(&Foto{"test"})
-	//
-	//var result []Foto
-	//c.Find(bson.M{}).All(&result)
-	//for _, v := range result {
-	//	fmt.Println("filename: ", v.Filename)
-	//}
-	//
-	//image, err := magick.DecodeFile("t.jpg")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//
-	//longer_edge_size := math.Max(float64(image.Width()), float64(image.Height()))
-	//multiplier := 200 / longer_edge_size
-	//
-	//thumbnail_image, err := image.Scale(int(float64(image.Width())*multiplier), int(float64(image.Height())*multiplier))
-	//f, err := os.Create("thumb.jpg")
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
-	//
-	//defer f.Close()
-	//
-	//w := bufio.NewWriter(f)
-	//thumbnail_image.Encode(w, nil)
+	switch command {
+	case "", "serve":
+		serve(db, config, *scan, *watch)
+	case "duplicates":
+		if err := reportDuplicates(db, os.Stdout); err != nil {
+			log.Fatal("Failed to find duplicates: ", err)
+		}
+	case "gpx":
+		if err := runGpx(db, config, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Failed to import GPX: ", err)
+		}
+	case "shift-time":
+		if err := runShiftTime(db, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Failed to shift capture times: ", err)
+		}
+	case "migrate":
+		if err := runMigrate(db, config.Database, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Failed to migrate database: ", err)
+		}
+	case "render-url":
+		if err := runRenderURL(config, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Failed to sign render URL: ", err)
+		}
+	default:
+		log.Fatal("Unknown command: ", command)
+	}
 }
 
-func main() {
-	db, err := sql.Open("sqlite3", "./fotos.db")
+// storeHTTPError turns the errors of a FotoStore into the HTTP errors for
+// them, so that a missing foto or a busy database do not come out as 500.
+func storeHTTPError(err error) error {
+	switch err {
+	case ErrNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, "Foto not found.")
+	case ErrExists:
+		return echo.NewHTTPError(http.StatusConflict, "A foto with this path exists.")
+	case ErrInvalid:
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid foto.")
+	case ErrUnavailable:
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "The database is unavailable, try again later.")
+	}
+	if storeError(err) == ErrUnavailable {
+		return storeHTTPError(ErrUnavailable)
+	}
+	return err
+}
+
+func fotoJSON(c echo.Context, store FotoStore, id int32) error {
+	foto, err := store.Get(id)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer db.Close()
+	return c.JSON(http.StatusOK, foto)
+}
+
+func serve(db *sql.DB, config *Config, scan bool, watch bool) {
+	loadPlaces(config.Places)
+	go func() {
+		if err := geocodeFotos(db); err != nil {
+			log.Println("Failed to name places: ", err)
+		}
+	}()
+	if scan {
+		go scanLibrary(db, config.Roots, config.Scan)
+	}
+	if watch {
+		watchLibrary(db, config.Roots, config.Scan)
+	}
+	thumbs := newRenderCache(config.Thumbs.Dir, config.Thumbs.Workers)
+	if config.Thumbs.MaxAge.Duration > 0 {
+		go func() {
+			for {
+				removed, err := thumbs.prune(config.Thumbs.MaxAge.Duration)
+				if err != nil {
+					log.Println("Failed to prune thumbnails: ", err)
+				} else if removed > 0 {
+					log.Println("Pruned ", removed, " thumbnails.")
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+	startJobs(db, config, thumbs)
+
+	var store FotoStore = NewSqlStore(db)
 
 	e := echo.New()
-	e.GET("/api/foto-ids", func(c echo.Context) error {
-		idList := getIds(db)
-		return c.JSON(http.StatusOK, idList)
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		e.DefaultHTTPErrorHandler(storeHTTPError(err), c)
+	}
+
+	e.GET("/api/fotos", func(c echo.Context) error {
+		q, fields, err := parseListing(c.QueryParams())
+		if err != nil {
+			return err
+		}
+
+		page, err := listFotos(store, q, fields)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, page)
 	})
 
 	e.GET("/api/fotos/:id", func(c echo.Context) error {
@@ -73,13 +157,528 @@ func main() {
 
 		var id int
 		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		return fotoJSON(c, store, int32(id))
+	})
+
+	e.GET("/api/fotos/:id/similar", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		threshold := config.Similar.Threshold
+		if param := c.QueryParam("threshold"); param != "" {
+			threshold, err = strconv.Atoi(param)
+			if err != nil || threshold < 0 || threshold > config.Similar.MaxThreshold {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Parameter threshold must be between 0 and %d.", config.Similar.MaxThreshold))
+			}
+		}
+
+		matches, ok, err := similarIndex.Similar(db, int32(id), threshold)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Foto has no perceptual hash.")
+		}
+		return c.JSON(http.StatusOK, matches)
+	})
+
+	e.PUT("/api/fotos/:id/rotation", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		var body struct {
+			Orientation *int `json:"orientation"`
+			Rotate      *int `json:"rotate"`
+			Reset       bool `json:"reset"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		current, ok, err := loadOrientation(db, int32(id))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Foto not found.")
+		}
+
+		var orientation int
+		switch {
+		case body.Reset:
+			orientation = 0
+		case body.Orientation != nil && validOrientation(*body.Orientation):
+			orientation = *body.Orientation
+		case body.Rotate != nil && *body.Rotate%90 == 0:
+			orientation = rotateOrientation(current, *body.Rotate)
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "Expected orientation from 1 to 8, rotate by a multiple of 90 or reset.")
+		}
+
+		if _, err := setOrientation(db, int32(id), orientation); err != nil {
+			return err
+		}
+		return fotoJSON(c, store, int32(id))
+	})
+
+	e.PUT("/api/fotos/:id/metadata", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		var body MetadataUpdate
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		ok, err := updateSidecar(db, int32(id), body)
+		if err == errInvalidRating {
+			return echo.NewHTTPError(http.StatusBadRequest, "Expected rating from -1 (rejected) to 5.")
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Foto not found.")
+		}
+		return fotoJSON(c, store, int32(id))
+	})
+
+	e.POST("/api/fotos/:id/write-back", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		var body FileEdit
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		w, ok, err := writeBack(db, int32(id), body)
+		if !ok && err == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Foto not found.")
+		}
+		if editErr, isEditErr := err.(*EditError); isEditErr {
+			return echo.NewHTTPError(http.StatusBadRequest, editErr.Message)
+		}
+		if err != nil {
+			return err
+		}
+		foto, err := store.Get(int32(id))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, WriteResult{Write: w, Foto: foto})
+	})
+
+	e.GET("/api/fotos/:id/writes", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		writes, err := fileWrites(db, int32(id))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, writes)
+	})
+
+	e.POST("/api/writes/:id/revert", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		w, ok, err := revertWrite(db, id)
+		if !ok && err == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "Write not found.")
+		}
+		switch err {
+		case errAlreadyReverted:
+			return echo.NewHTTPError(http.StatusConflict, "The write was reverted already.")
+		case errFileChanged:
+			return echo.NewHTTPError(http.StatusConflict, "The file changed since the write; revert later writes first.")
+		}
+		if err != nil {
+			return err
+		}
+		foto, err := store.Get(w.FotoId)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, WriteResult{Write: w, Foto: foto})
+	})
+
+	e.GET("/api/fotos/:id/jpeg", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		orientation, ok, err := loadOrientation(db, int32(id))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Foto not found.")
+		}
+
+		foto, err := store.Get(int32(id))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := writeJPEG(&buf, foto.Path, orientation); err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Failed to render foto: "+err.Error())
+		}
+		return c.Blob(http.StatusOK, "image/jpeg", buf.Bytes())
+	})
+
+	original := func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+		return serveOriginal(c, db, config.Roots, int32(id))
+	}
+	e.GET("/api/fotos/:id/original", original)
+	e.HEAD("/api/fotos/:id/original", original)
+
+	e.GET("/api/fotos/:id/thumb/:size", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+		spec, ok := thumbSizes[c.Param("size")]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Unknown thumbnail size, expected square, small or large.")
+		}
+		spec.Quality = config.Thumbs.Quality
+		negotiateFormat(c, &spec)
+
+		src, err := loadRenderSource(db, int32(id))
+		if err != nil {
+			return err
+		}
+		return serveRendered(c, thumbs, src, spec)
+	})
+
+	e.GET("/api/fotos/:id/render", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+		if config.Render.Secret == "" {
+			return echo.NewHTTPError(http.StatusForbidden, "Rendering is disabled until render.secret is set.")
+		}
+		if !validRenderSignature(config.Render.Secret, int32(id), c.QueryParams()) {
+			return echo.NewHTTPError(http.StatusForbidden, "Invalid or missing parameter sig.")
+		}
+		spec, err := parseRender(c.QueryParams(), config)
+		if err != nil {
+			return err
+		}
+		if c.QueryParam("format") == "" {
+			negotiateFormat(c, &spec)
+		}
+
+		src, err := loadRenderSource(db, int32(id))
+		if err != nil {
+			return err
+		}
+		return serveRendered(c, thumbs, src, spec)
+	})
+
+	e.GET("/api/jobs/stats", func(c echo.Context) error {
+		stats, err := jobStats(db)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, stats)
+	})
+
+	e.GET("/api/jobs", func(c echo.Context) error {
+		state, jobType := c.QueryParam("state"), c.QueryParam("type")
+		if state != "" && state != jobQueued && state != jobRunning && state != jobDone && state != jobDead {
+			return echo.NewHTTPError(http.StatusBadRequest, "Parameter state must be queued, running, done or dead.")
+		}
+		if jobType != "" && !knownJobType(jobType) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Parameter type must be metadata, phash or thumbs.")
+		}
+		limit := defaultPageSize
+		if param := c.QueryParam("limit"); param != "" {
+			var err error
+			if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > maxPageSize {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Parameter limit must be from 1 to %d.", maxPageSize))
+			}
+		}
+
+		jobs, err := listJobs(db, state, jobType, limit)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, jobs)
+	})
+
+	e.GET("/api/jobs/:id", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		job, err := loadJobWithLogs(db, id)
+		if err == ErrNotFound {
+			return echo.NewHTTPError(http.StatusNotFound, "Job not found.")
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, job)
+	})
+
+	e.POST("/api/jobs/:id/retry", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid parameter id.")
+		}
+
+		job, err := retryJob(db, id)
+		switch err {
+		case nil:
+			return c.JSON(http.StatusOK, job)
+		case ErrNotFound:
+			return echo.NewHTTPError(http.StatusNotFound, "Job not found.")
+		case errJobNotDead:
+			return echo.NewHTTPError(http.StatusConflict, "Only dead jobs can be retried.")
+		}
+		return err
+	})
+
+	e.GET("/api/geo/bbox", func(c echo.Context) error {
+		bounds, err := geo.ParseBounds(c.QueryParam("bbox"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Parameter bbox must be west,south,east,north in degrees.")
+		}
+		limit, err := geoLimit(c)
+		if err != nil {
+			return err
+		}
+
+		fotos, err := fotosInBounds(db, bounds, limit)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, fotos)
+	})
+
+	e.GET("/api/geo/radius", func(c echo.Context) error {
+		lat, latErr := strconv.ParseFloat(c.QueryParam("lat"), 64)
+		lon, lonErr := strconv.ParseFloat(c.QueryParam("lon"), 64)
+		center := geo.Point{Lat: lat, Lon: lon}
+		if latErr != nil || lonErr != nil || !center.Valid() {
+			return echo.NewHTTPError(http.StatusBadRequest, "Parameters lat and lon must be a position in degrees.")
+		}
+		radius, err := strconv.ParseFloat(c.QueryParam("radius"), 64)
+		if err != nil || radius <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Parameter radius must be a positive number of metres.")
+		}
+		limit, err := geoLimit(c)
+		if err != nil {
+			return err
+		}
+
+		fotos, err := fotosNear(db, center, radius, limit)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, fotos)
+	})
+
+	e.GET("/api/geo/features", func(c echo.Context) error {
+		zoom, err := strconv.Atoi(c.QueryParam("zoom"))
+		if err != nil || zoom < 0 || zoom > geo.MaxZoom+1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Parameter zoom must be between 0 and %d.", geo.MaxZoom+1))
+		}
+		bounds := geo.Bounds{West: -180, South: -90, East: 180, North: 90}
+		if param := c.QueryParam("bbox"); param != "" {
+			if bounds, err = geo.ParseBounds(param); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Parameter bbox must be west,south,east,north in degrees.")
+			}
+		}
+
+		features, err := fotoFeatures(db, bounds, zoom)
 		if err != nil {
 			return err
 		}
+		return c.JSON(http.StatusOK, features)
+	})
 
-		foto := loadFoto(db, int32(id))
-		return c.JSON(http.StatusOK, foto)
+	e.GET("/api/places", func(c echo.Context) error {
+		counts, err := findPlaces(db, c.QueryParam("q"))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, counts)
 	})
 
-	e.Logger.Fatal(e.Start(":8888"))
+	e.GET("/api/search", func(c echo.Context) error {
+		ids, err := searchFotos(db, SearchQuery{
+			Place:     c.QueryParam("place"),
+			Q:         c.QueryParam("q"),
+			Keyword:   c.QueryParam("keyword"),
+			Byline:    c.QueryParam("byline"),
+			Copyright: c.QueryParam("copyright"),
+		})
+		if err == errEmptySearch {
+			return echo.NewHTTPError(http.StatusBadRequest, "Missing parameter place, q, keyword, byline or copyright.")
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, ids)
+	})
+
+	e.POST("/api/gpx", func(c echo.Context) error {
+		offset := config.Gpx.Offset.Duration
+		maxGap := config.Gpx.MaxGap.Duration
+		var err error
+		if param := c.QueryParam("offset"); param != "" {
+			if offset, err = time.ParseDuration(param); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Parameter offset must be a duration such as -1h30m.")
+			}
+		}
+		if param := c.QueryParam("maxGap"); param != "" {
+			if maxGap, err = time.ParseDuration(param); err != nil || maxGap < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "Parameter maxGap must be a duration such as 10m.")
+			}
+		}
+		source := c.QueryParam("source")
+		if source == "" {
+			source = "upload.gpx"
+		}
+
+		result, err := importGpx(db, c.Request().Body, source, offset, maxGap, c.QueryParam("apply") == "true")
+		if err == gpx.ErrNoPoints {
+			return echo.NewHTTPError(http.StatusBadRequest, "GPX has no timed track points.")
+		}
+		if _, ok := err.(*gpx.FormatError); ok {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.POST("/api/time-shift", func(c echo.Context) error {
+		var body struct {
+			TimeSelection
+			Offset string `json:"offset"`
+			Anchor *struct {
+				Id      int32  `json:"id"`
+				TakenAt string `json:"takenAt"`
+			} `json:"anchor"`
+			Write  bool `json:"write"`
+			DryRun bool `json:"dryRun"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		var offset time.Duration
+		switch {
+		case body.Anchor != nil:
+			correct, err := parseTaken(body.Anchor.TakenAt)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Anchor takenAt must be a time such as 2017-05-01T10:20:30+08:00.")
+			}
+			if offset, err = anchorOffset(db, body.Anchor.Id, correct); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		case body.Offset != "":
+			var err error
+			if offset, err = time.ParseDuration(body.Offset); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Offset must be a duration such as -1h30m.")
+			}
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "Expected offset or anchor.")
+		}
+
+		result, err := shiftTimes(db, body.TimeSelection, offset, body.Write, body.DryRun)
+		if err == errEmptySelection {
+			return echo.NewHTTPError(http.StatusBadRequest, "Select fotos by ids, folder or model.")
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.POST("/api/time-shift/undo", func(c echo.Context) error {
+		var body struct {
+			TimeSelection
+			DryRun bool `json:"dryRun"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+
+		result, err := undoShift(db, body.TimeSelection, body.DryRun)
+		if err == errEmptySelection {
+			return echo.NewHTTPError(http.StatusBadRequest, "Select fotos by ids, folder or model.")
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+
+	e.GET("/api/duplicates", func(c echo.Context) error {
+		groups, err := findDuplicates(db)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, groups)
+	})
+
+	e.Logger.Fatal(e.Start(config.Listen))
+}
+
+const (
+	defaultGeoLimit = 1000
+	maxGeoLimit     = 10000
+)
+
+// geoLimit reads the limit parameter of the geographic searches.
+func geoLimit(c echo.Context) (int, error) {
+	param := c.QueryParam("limit")
+	if param == "" {
+		return defaultGeoLimit, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 || limit > maxGeoLimit {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Parameter limit must be between 1 and %d.", maxGeoLimit))
+	}
+	return limit, nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
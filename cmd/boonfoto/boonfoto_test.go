@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"exif"
+	"jpegseg"
+)
+
+// testImage is the image data of the JPEG files made by tests, from the
+// start of scan to the end of the image. Nothing decodes it.
+var testImage = []byte{0xff, jpegseg.SOS, 0x00, 0x08, 0x01, 0x01, 0x00, 0x00, 0x3f, 0x00, 0x12, 0x34, 0xff, 0x00, 0x56, 0xff, jpegseg.EOI}
+
+// newTestDB returns an in-memory database at the latest schema version.
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: opens a database of its own.
+	db.SetMaxOpenConns(1)
+	if _, err := migrate(db, ":memory:", ioutil.Discard, false); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	return db
+}
+
+// writeTestJPEG writes a JPEG file whose EXIF data has taken as capture
+// time.
+func writeTestJPEG(t *testing.T, path string, taken time.Time) {
+	editor, err := exif.NewEditor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor.SetDateTimeOriginal(taken, true)
+	tiff, err := editor.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := jpegseg.Join([]jpegseg.Segment{{Marker: jpegseg.APP1, Data: exif.EmbedTIFF(tiff)}}, testImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// insertTestFoto adds a row for the file at path and returns its id. An
+// empty root is stored as NULL, as in rows indexed before roots existed.
+func insertTestFoto(t *testing.T, db *sql.DB, path string, root string) int32 {
+	res, err := db.Exec("INSERT INTO fotos (path, root, mtime, format, size, hash) VALUES (?, ?, ?, 'jpeg', 0, '')",
+		path, nullString(root), time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int32(id)
+}
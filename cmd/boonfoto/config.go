@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration reads and writes a time.Duration as a string such as "2s" in
+// the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// RootConfig is one named library root. Include and Exclude use the
+// pattern syntax of filescanner.
+type RootConfig struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+type ScanConfig struct {
+	Workers        int      `json:"workers"`
+	QueueSize      int      `json:"queueSize"`
+	BatchSize      int      `json:"batchSize"`
+	IgnoreFile     string   `json:"ignoreFile"`
+	WatchDebounce  Duration `json:"watchDebounce"`
+	RescanInterval Duration `json:"rescanInterval"`
+}
+
+// SimilarConfig sets the default and largest Hamming distance, in bits
+// out of 64, between the perceptual hashes of similar fotos.
+type SimilarConfig struct {
+	Threshold    int `json:"threshold"`
+	MaxThreshold int `json:"maxThreshold"`
+}
+
+// PlacesConfig points at the GeoNames files used for reverse geocoding.
+// Fotos further than MaxDistance metres from every place get none.
+type PlacesConfig struct {
+	Cities      string  `json:"cities"`
+	Admin1      string  `json:"admin1"`
+	Countries   string  `json:"countries"`
+	MaxDistance float64 `json:"maxDistance"`
+}
+
+// GpxConfig holds the defaults for matching fotos to GPX tracks. Offset
+// is added to capture times to get GPS time, to make up for a camera
+// clock that is wrong or set to another zone than the server's. MaxGap is
+// the longest time between two track points that a position is
+// interpolated across.
+type GpxConfig struct {
+	Offset Duration `json:"offset"`
+	MaxGap Duration `json:"maxGap"`
+}
+
+// ThumbsConfig sets where thumbnails are cached, their JPEG quality, how
+// many are rendered at once and how long one is kept after it was last
+// served. A MaxAge of zero keeps them for good.
+type ThumbsConfig struct {
+	Dir     string   `json:"dir"`
+	Quality int      `json:"quality"`
+	Workers int      `json:"workers"`
+	MaxAge  Duration `json:"maxAge"`
+}
+
+// RenderConfig sets the secret /api/fotos/:id/render URLs are signed with
+// and the largest width or height it renders.
+type RenderConfig struct {
+	Secret  string `json:"secret"`
+	MaxSize int    `json:"maxSize"`
+}
+
+// JobsConfig sets up the background job queue: the number of workers for
+// each job type, how often a job is tried before it is given up as dead,
+// the delay before the first retry, which doubles with every further one,
+// how long a worker holds a job without a heartbeat before another may
+// take it over, and how long finished jobs are kept.
+type JobsConfig struct {
+	Workers     map[string]int `json:"workers"`
+	MaxAttempts int            `json:"maxAttempts"`
+	Backoff     Duration       `json:"backoff"`
+	Lease       Duration       `json:"lease"`
+	KeepDone    Duration       `json:"keepDone"`
+}
+
+type Config struct {
+	Database string        `json:"database"`
+	Listen   string        `json:"listen"`
+	Roots    []RootConfig  `json:"roots"`
+	Scan     ScanConfig    `json:"scan"`
+	Similar  SimilarConfig `json:"similar"`
+	Places   PlacesConfig  `json:"places"`
+	Gpx      GpxConfig     `json:"gpx"`
+	Thumbs   ThumbsConfig  `json:"thumbs"`
+	Render   RenderConfig  `json:"render"`
+	Jobs     JobsConfig    `json:"jobs"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Database: "./fotos.db",
+		Listen:   ":8888",
+		Scan: ScanConfig{
+			Workers:        4,
+			QueueSize:      64,
+			BatchSize:      500,
+			IgnoreFile:     ".boonignore",
+			WatchDebounce:  Duration{2 * time.Second},
+			RescanInterval: Duration{24 * time.Hour},
+		},
+		Similar: SimilarConfig{
+			Threshold:    10,
+			MaxThreshold: 24,
+		},
+		Places: PlacesConfig{
+			Cities:      "./geonames/cities1000.txt",
+			Admin1:      "./geonames/admin1CodesASCII.txt",
+			Countries:   "./geonames/countryInfo.txt",
+			MaxDistance: 50000,
+		},
+		Gpx: GpxConfig{
+			MaxGap: Duration{10 * time.Minute},
+		},
+		Thumbs: ThumbsConfig{
+			Dir:     "./thumbs",
+			Quality: 85,
+			Workers: 2,
+			MaxAge:  Duration{30 * 24 * time.Hour},
+		},
+		Render: RenderConfig{
+			MaxSize: 4096,
+		},
+		Jobs: JobsConfig{
+			Workers:     map[string]int{jobMetadata: 2, jobPerceptualHash: 2, jobThumbnails: 1},
+			MaxAttempts: 5,
+			Backoff:     Duration{30 * time.Second},
+			Lease:       Duration{2 * time.Minute},
+			KeepDone:    Duration{24 * time.Hour},
+		},
+	}
+}
+
+// loadConfig reads the JSON config file at path on top of the defaults and
+// then applies the BOONFOTO_* environment variables. A missing file is
+// only an error when required is set.
+func loadConfig(path string, required bool) (*Config, error) {
+	config := defaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case !os.IsNotExist(err) || required:
+		return nil, err
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	return config, config.validate()
+}
+
+// applyEnv overrides the config from the environment. BOONFOTO_ROOTS holds
+// name=path pairs separated by the OS path list separator and replaces
+// the configured roots.
+func (config *Config) applyEnv() error {
+	if v := os.Getenv("BOONFOTO_DATABASE"); v != "" {
+		config.Database = v
+	}
+	if v := os.Getenv("BOONFOTO_LISTEN"); v != "" {
+		config.Listen = v
+	}
+	if v := os.Getenv("BOONFOTO_ROOTS"); v != "" {
+		config.Roots = nil
+		for _, pair := range filepath.SplitList(v) {
+			i := strings.Index(pair, "=")
+			if i < 1 {
+				return fmt.Errorf("BOONFOTO_ROOTS: expected name=path, got %q", pair)
+			}
+			config.Roots = append(config.Roots, RootConfig{Name: pair[:i], Path: pair[i+1:]})
+		}
+	}
+	if v := os.Getenv("BOONFOTO_SCAN_WORKERS"); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("BOONFOTO_SCAN_WORKERS: %v", err)
+		}
+		config.Scan.Workers = workers
+	}
+	if v := os.Getenv("BOONFOTO_RENDER_SECRET"); v != "" {
+		config.Render.Secret = v
+	}
+	return nil
+}
+
+func (config *Config) validate() error {
+	names := make(map[string]bool)
+	for i := range config.Roots {
+		root := &config.Roots[i]
+		if root.Name == "" || root.Path == "" {
+			return fmt.Errorf("root %d: name and path are required", i)
+		}
+		if names[root.Name] {
+			return fmt.Errorf("root %s: duplicate name", root.Name)
+		}
+		names[root.Name] = true
+
+		path, err := filepath.Abs(root.Path)
+		if err != nil {
+			return fmt.Errorf("root %s: %v", root.Name, err)
+		}
+		root.Path = path
+	}
+	if config.Thumbs.Quality < 1 || config.Thumbs.Quality > 100 {
+		return fmt.Errorf("thumbs: quality must be from 1 to 100")
+	}
+	if config.Thumbs.Workers < 1 {
+		config.Thumbs.Workers = 1
+	}
+	if config.Render.MaxSize < 1 {
+		return fmt.Errorf("render: maxSize must be positive")
+	}
+	for jobType := range config.Jobs.Workers {
+		if !knownJobType(jobType) {
+			return fmt.Errorf("jobs: unknown job type %s", jobType)
+		}
+	}
+	if config.Jobs.MaxAttempts < 1 {
+		config.Jobs.MaxAttempts = 1
+	}
+	if config.Jobs.Lease.Duration < 10*time.Second {
+		return fmt.Errorf("jobs: lease must be at least 10s")
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+
+	"github.com/rainycape/magick"
+)
+
+// jpegQuality is the quality of fotos downloaded as JPEG.
+const jpegQuality = 90
+
+// writeJPEG decodes the file at path, turns it upright for orientation o
+// and writes it to w as a JPEG.
+func writeJPEG(w io.Writer, path string, o int) error {
+	im, err := magick.DecodeFile(path)
+	if err != nil {
+		return err
+	}
+	defer im.Dispose()
+
+	upright, err := orient(im, o)
+	if err != nil {
+		return err
+	}
+	if upright != im {
+		defer upright.Dispose()
+	}
+
+	info := magick.NewInfo()
+	info.SetFormat("JPEG")
+	info.SetQuality(jpegQuality)
+	return upright.Encode(w, info)
+}
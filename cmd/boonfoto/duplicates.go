@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+type DuplicateFoto struct {
+	Id   int32  `json:"id"`
+	Path string `json:"path"`
+	Root string `json:"root"`
+}
+
+// DuplicateGroup is a set of byte-identical files. Reclaimable is the
+// space freed by keeping only one of them.
+type DuplicateGroup struct {
+	Hash        string          `json:"hash"`
+	Size        int64           `json:"size"`
+	Reclaimable int64           `json:"reclaimable"`
+	Fotos       []DuplicateFoto `json:"fotos"`
+}
+
+// findDuplicates groups the present files sharing a content hash, largest
+// files first.
+func findDuplicates(db *sql.DB) ([]DuplicateGroup, error) {
+	rows, err := db.Query(`
+		SELECT hash, COALESCE(size, 0), id, path, COALESCE(root, '') FROM fotos
+		WHERE status IS NOT 'missing' AND hash IN (
+			SELECT hash FROM fotos WHERE hash != '' AND status IS NOT 'missing'
+			GROUP BY hash HAVING COUNT(*) > 1)
+		ORDER BY size DESC, hash, path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []DuplicateGroup{}
+	for rows.Next() {
+		var hash string
+		var size int64
+		var foto DuplicateFoto
+		if err := rows.Scan(&hash, &size, &foto.Id, &foto.Path, &foto.Root); err != nil {
+			return nil, err
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].Hash != hash {
+			groups = append(groups, DuplicateGroup{Hash: hash, Size: size})
+		} else {
+			groups[len(groups)-1].Reclaimable += size
+		}
+		groups[len(groups)-1].Fotos = append(groups[len(groups)-1].Fotos, foto)
+	}
+
+	return groups, rows.Err()
+}
+
+func reportDuplicates(db *sql.DB, w io.Writer) error {
+	groups, err := findDuplicates(db)
+	if err != nil {
+		return err
+	}
+
+	var files int
+	var reclaimable int64
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s  %d copies of %s, %s reclaimable\n",
+			group.Hash[:16], len(group.Fotos), formatBytes(group.Size), formatBytes(group.Reclaimable))
+		for _, foto := range group.Fotos {
+			fmt.Fprintf(w, "    [%s] %s\n", foto.Root, foto.Path)
+		}
+		files += len(group.Fotos) - 1
+		reclaimable += group.Reclaimable
+	}
+	fmt.Fprintf(w, "%d groups, %d redundant files, %s reclaimable.\n", len(groups), files, formatBytes(reclaimable))
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
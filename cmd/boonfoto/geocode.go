@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"exif"
+	"places"
+)
+
+// placeIndex is nil when no GeoNames cities file could be loaded, which
+// leaves fotos without place names.
+var (
+	placeIndex       *places.Index
+	placeMaxDistance float64
+)
+
+func loadPlaces(config PlacesConfig) {
+	if config.Cities == "" {
+		return
+	}
+	index, err := places.Load(config.Cities, optionalFile(config.Admin1), optionalFile(config.Countries))
+	if err != nil {
+		log.Println("Failed to load places, fotos get no place names: ", err)
+		return
+	}
+	fmt.Println("Loaded ", index.Len(), " places from ", config.Cities, ".")
+	placeIndex = index
+	placeMaxDistance = config.MaxDistance
+}
+
+// optionalFile drops the path of a file that is not there.
+func optionalFile(path string) string {
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// placeColumns lists the fotos columns filled by reverse geocoding, in
+// the order of the values returned by lookupPlace.
+const placeColumns = "place_country = ?, place_region = ?, place_city = ?, place_at = ?"
+
+// lookupPlace returns the values for placeColumns of a position, or of no
+// position when ok is false.
+func lookupPlace(lat float64, lon float64, ok bool) []interface{} {
+	values := []interface{}{nil, nil, nil, time.Now().UTC()}
+	if !ok {
+		return values
+	}
+	place, distance := placeIndex.Nearest(lat, lon)
+	if place == nil || distance > placeMaxDistance {
+		return values
+	}
+	values[0] = nullString(place.Country)
+	values[1] = nullString(place.Region)
+	values[2] = nullString(place.Name)
+	return values
+}
+
+// queuePlace queues the place of the row at path for its EXIF position,
+// when places are loaded. Without one, a place named after a derived
+// location is kept.
+func (sp *SqlPopulator) queuePlace(path string, loc *exif.Location) error {
+	if placeIndex == nil {
+		return nil
+	}
+	if loc == nil {
+		args := append(lookupPlace(0, 0, false), path)
+		return sp.queue("UPDATE fotos SET "+placeColumns+" WHERE path = ? AND derived_latitude IS NULL", args...)
+	}
+	args := append(lookupPlace(loc.Latitude, loc.Longitude, true), path)
+	return sp.queue("UPDATE fotos SET "+placeColumns+" WHERE path = ?", args...)
+}
+
+// geocodeFotos names the places of located fotos that have none yet,
+// such as those indexed before the places were loaded.
+func geocodeFotos(db *sql.DB) error {
+	if placeIndex == nil {
+		return nil
+	}
+
+	rows, err := db.Query("SELECT id, " + latitudeExpr + ", " + longitudeExpr + " FROM fotos WHERE " + latitudeExpr + " IS NOT NULL AND place_at IS NULL")
+	if err != nil {
+		return err
+	}
+	type located struct {
+		id       int64
+		lat, lon float64
+	}
+	var fotos []located
+	for rows.Next() {
+		var l located
+		if err := rows.Scan(&l.id, &l.lat, &l.lon); err != nil {
+			rows.Close()
+			return err
+		}
+		fotos = append(fotos, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(fotos) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, l := range fotos {
+		args := append(lookupPlace(l.lat, l.lon, true), l.id)
+		if _, err := tx.Exec("UPDATE fotos SET "+placeColumns+" WHERE id = ?", args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Println("Named the places of ", len(fotos), " fotos.")
+	return nil
+}
+
+type PlaceCount struct {
+	Country string `json:"country"`
+	Region  string `json:"region,omitempty"`
+	City    string `json:"city"`
+	Count   int    `json:"count"`
+}
+
+// placeCondition matches fotos whose city, region or country contains q,
+// ignoring case.
+func placeCondition(q string) (string, []interface{}) {
+	like := "%" + escapeLike(strings.TrimSpace(q)) + "%"
+	return `(place_city LIKE ? ESCAPE '\' OR place_region LIKE ? ESCAPE '\' OR place_country LIKE ? ESCAPE '\')`,
+		[]interface{}{like, like, like}
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// findPlaces lists the places of present fotos matching q, or all of
+// them when q is empty, with the most fotos first.
+func findPlaces(db *sql.DB, q string) ([]PlaceCount, error) {
+	cond, args := placeCondition(q)
+	rows, err := db.Query(`SELECT place_country, COALESCE(place_region, ''), place_city, COUNT(*) FROM fotos
+		WHERE place_city IS NOT NULL AND status IS NOT 'missing' AND `+cond+`
+		GROUP BY place_country, place_region, place_city
+		ORDER BY COUNT(*) DESC, place_country, place_region, place_city`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []PlaceCount{}
+	for rows.Next() {
+		var c PlaceCount
+		if err := rows.Scan(&c.Country, &c.Region, &c.City, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gpx"
+)
+
+// GeotagMatch is a foto without an EXIF position placed on a GPX track.
+// Gap is the time in seconds to the nearer track point.
+type GeotagMatch struct {
+	Id        int32    `json:"id"`
+	Path      string   `json:"path"`
+	TakenAt   string   `json:"takenAt"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Gap       float64  `json:"gap"`
+}
+
+// GeotagResult lists the matches of one import. Unmatched counts the fotos
+// taken while the track was recording that fell into a gap.
+type GeotagResult struct {
+	Source    string        `json:"source"`
+	Offset    string        `json:"offset"`
+	MaxGap    string        `json:"maxGap"`
+	Matches   []GeotagMatch `json:"matches"`
+	Unmatched int           `json:"unmatched"`
+	Applied   bool          `json:"applied"`
+}
+
+// matchTrack places the present fotos that have a capture time but no EXIF
+// position on track. Fotos located from an earlier track are matched
+// again, so that an import can be redone with a better offset.
+func matchTrack(db *sql.DB, track *gpx.Track, offset time.Duration, maxGap time.Duration) (GeotagResult, error) {
+	result := GeotagResult{Offset: offset.String(), MaxGap: maxGap.String(), Matches: []GeotagMatch{}}
+
+	// Capture times are shifted by offset to get GPS time, so the track
+	// covers capture times shifted the other way.
+	from := track.Start().Add(-offset).UTC()
+	to := track.End().Add(-offset).UTC()
+	rows, err := db.Query(`SELECT id, path, taken_at, COALESCE(taken_offset, '') FROM fotos
+		WHERE latitude IS NULL AND taken_at BETWEEN ? AND ? AND status IS NOT 'missing'
+		ORDER BY taken_at, path`, from, to)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m GeotagMatch
+		var takenAt time.Time
+		var takenOffset string
+		if err := rows.Scan(&m.Id, &m.Path, &takenAt, &takenOffset); err != nil {
+			return result, err
+		}
+		m.TakenAt = formatTaken(takenAt, takenOffset)
+
+		p, gap, ok := track.Locate(takenAt.Add(offset), maxGap)
+		if !ok {
+			result.Unmatched++
+			continue
+		}
+		m.Latitude, m.Longitude, m.Gap = p.Latitude, p.Longitude, gap.Seconds()
+		if p.HasElevation {
+			elevation := p.Elevation
+			m.Altitude = &elevation
+		}
+		result.Matches = append(result.Matches, m)
+	}
+	return result, rows.Err()
+}
+
+// applyMatches stores the matches as derived locations and names their
+// places again.
+func applyMatches(db *sql.DB, result *GeotagResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, m := range result.Matches {
+		var altitude interface{}
+		if m.Altitude != nil {
+			altitude = *m.Altitude
+		}
+		_, err := tx.Exec(`UPDATE fotos SET derived_latitude = ?, derived_longitude = ?, derived_altitude = ?, derived_source = ?,
+			place_country = NULL, place_region = NULL, place_city = NULL, place_at = NULL
+			WHERE id = ? AND latitude IS NULL`,
+			m.Latitude, m.Longitude, altitude, result.Source, m.Id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	result.Applied = true
+	return geocodeFotos(db)
+}
+
+// importGpx matches fotos against the GPX document in r and, when apply
+// is set, stores the result.
+func importGpx(db *sql.DB, r io.Reader, source string, offset time.Duration, maxGap time.Duration, apply bool) (GeotagResult, error) {
+	track, err := gpx.Decode(r)
+	if err != nil {
+		return GeotagResult{}, err
+	}
+
+	result, err := matchTrack(db, track, offset, maxGap)
+	if err != nil {
+		return result, err
+	}
+	result.Source = source
+	if apply {
+		err = applyMatches(db, &result)
+	}
+	return result, err
+}
+
+// runGpx implements the gpx command, which previews the matches of each
+// GPX file given and stores them with -apply.
+func runGpx(db *sql.DB, config *Config, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("gpx", flag.ExitOnError)
+	offset := flags.Duration("offset", config.Gpx.Offset.Duration, "Added to capture times to get GPS time.")
+	maxGap := flags.Duration("max-gap", config.Gpx.MaxGap.Duration, "Longest time between track points to interpolate across.")
+	apply := flags.Bool("apply", false, "Store the matches instead of only listing them.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] gpx [-offset d] [-max-gap d] [-apply] file.gpx...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no GPX files given")
+	}
+
+	loadPlaces(config.Places)
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		result, err := importGpx(db, f, filepath.Base(path), *offset, *maxGap, *apply)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		for _, m := range result.Matches {
+			fmt.Fprintf(w, "%s  %10.6f %11.6f  %4.0fs  %s\n", m.TakenAt, m.Latitude, m.Longitude, m.Gap, m.Path)
+		}
+		verb := "Would locate"
+		if result.Applied {
+			verb = "Located"
+		}
+		fmt.Fprintf(w, "%s: %s %d fotos, %d in gaps longer than %s.\n", path, verb, len(result.Matches), result.Unmatched, result.MaxGap)
+	}
+	if !*apply {
+		log.Println("Nothing stored; run again with -apply to keep these locations.")
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filescanner"
+)
+
+const (
+	statusModified = "modified"
+	statusMissing  = "missing"
+	statusMoved    = "moved"
+)
+
+type knownFoto struct {
+	id           int64
+	mtime        time.Time
+	size         int64
+	hash         string
+	status       string
+	root         string
+	phash        bool
+	metadata     bool
+	sidecar      string
+	sidecarMtime NullTime
+}
+
+type statement struct {
+	query string
+	args  []interface{}
+}
+
+// SqlPopulator reconciles files with the fotos table. A populator made by
+// NewSqlPopulator serves one full scan: known is a snapshot taken before
+// the scan and is only read while it runs, since needsHash is called from
+// the scanner's workers. A live populator looks rows up as files come in.
+type SqlPopulator struct {
+	db        *sql.DB
+	root      RootConfig
+	batchSize int
+	live      bool
+	known     map[string]knownFoto
+	byHash    map[string][]string
+	seen      map[string]bool
+	moves     []filescanner.File
+	failed    []string
+	pending   []statement
+}
+
+func NewSqlPopulator(db *sql.DB, root RootConfig, batchSize int) (*SqlPopulator, error) {
+	rows, err := db.Query("SELECT id, path, mtime, COALESCE(size, -1), COALESCE(hash, ''), COALESCE(status, ''), COALESCE(root, ''), phash IS NOT NULL, metadata_at IS NOT NULL, " +
+		"COALESCE(sidecar, ''), sidecar_mtime FROM fotos")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sp := &SqlPopulator{
+		db:        db,
+		root:      root,
+		batchSize: batchSize,
+		known:     make(map[string]knownFoto),
+		byHash:    make(map[string][]string),
+		seen:      make(map[string]bool),
+	}
+	for rows.Next() {
+		var path string
+		var k knownFoto
+		if err := rows.Scan(&k.id, &path, &k.mtime, &k.size, &k.hash, &k.status, &k.root, &k.phash, &k.metadata, &k.sidecar, &k.sidecarMtime); err != nil {
+			return nil, err
+		}
+		sp.known[path] = k
+		if k.hash != "" {
+			sp.byHash[k.hash] = append(sp.byHash[k.hash], path)
+		}
+	}
+
+	return sp, rows.Err()
+}
+
+// NewLivePopulator returns a populator for files reported one at a time,
+// which writes every change straight away.
+func NewLivePopulator(db *sql.DB, root RootConfig) *SqlPopulator {
+	return &SqlPopulator{db: db, root: root, batchSize: 1, live: true}
+}
+
+func (sp *SqlPopulator) lookup(path string) (knownFoto, bool, error) {
+	if !sp.live {
+		k, ok := sp.known[path]
+		return k, ok, nil
+	}
+
+	var k knownFoto
+	err := sp.db.QueryRow("SELECT id, mtime, COALESCE(size, -1), COALESCE(hash, ''), COALESCE(status, ''), COALESCE(root, ''), phash IS NOT NULL, metadata_at IS NOT NULL, "+
+		"COALESCE(sidecar, ''), sidecar_mtime FROM fotos WHERE path = ?", path).
+		Scan(&k.id, &k.mtime, &k.size, &k.hash, &k.status, &k.root, &k.phash, &k.metadata, &k.sidecar, &k.sidecarMtime)
+	if err == sql.ErrNoRows {
+		return k, false, nil
+	}
+	return k, err == nil, err
+}
+
+func (sp *SqlPopulator) needsHash(f filescanner.File) bool {
+	k, ok, err := sp.lookup(f.Path)
+	return err != nil || !ok || k.hash == "" || k.size != f.Size || !k.mtime.Equal(f.ModTime)
+}
+
+func (sp *SqlPopulator) scanError(path string, err error) {
+	sp.failed = append(sp.failed, path)
+	log.Println("Failed to scan ", path, ": ", err)
+}
+
+func (sp *SqlPopulator) queue(query string, args ...interface{}) error {
+	sp.pending = append(sp.pending, statement{query, args})
+	if len(sp.pending) >= sp.batchSize {
+		return sp.Flush()
+	}
+	return nil
+}
+
+func (sp *SqlPopulator) visitImageFile(f filescanner.File) error {
+	if !sp.live {
+		sp.seen[f.Path] = true
+	}
+
+	k, ok, err := sp.lookup(f.Path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return sp.add(f)
+	}
+	// A file found again is no longer new to the index: it loses the
+	// modified or moved status an earlier scan gave it.
+	changed := k.size != f.Size || !k.mtime.Equal(f.ModTime)
+	switch {
+	case f.Hash == "":
+		// Not rehashed, so size and mtime are unchanged.
+		if err := sp.backfill(f, k); err != nil {
+			return err
+		}
+		if err := sp.syncSidecar(f, k); err != nil {
+			return err
+		}
+		if k.status == "" && k.root != "" {
+			return nil
+		}
+		return sp.queue("UPDATE fotos SET status = NULL, format = COALESCE(format, ?), root = COALESCE(root, ?) WHERE id = ?",
+			f.Format.Name, nullString(sp.root.Name), k.id)
+	case k.hash == f.Hash || (k.hash == "" && !changed):
+		if err := sp.backfill(f, k); err != nil {
+			return err
+		}
+		if err := sp.syncSidecar(f, k); err != nil {
+			return err
+		}
+		return sp.queue("UPDATE fotos SET mtime = ?, size = ?, hash = ?, format = COALESCE(format, ?), status = NULL, root = COALESCE(root, ?) WHERE id = ?",
+			f.ModTime.UTC(), f.Size, f.Hash, f.Format.Name, nullString(sp.root.Name), k.id)
+	default:
+		// Changed content, or a changed size or mtime of a file that was
+		// never hashed.
+		fmt.Println("Modified ", f.Format.Kind, " file: ", f.Path)
+		err := sp.queue("UPDATE fotos SET mtime = ?, size = ?, hash = ?, format = COALESCE(format, ?), status = ?, phash = NULL, root = COALESCE(root, ?) WHERE id = ?",
+			f.ModTime.UTC(), f.Size, f.Hash, f.Format.Name, statusModified, nullString(sp.root.Name), k.id)
+		if err != nil {
+			return err
+		}
+		if err := sp.syncSidecar(f, k); err != nil {
+			return err
+		}
+		return sp.queueJobs(f, enqueueJob)
+	}
+}
+
+// backfill queues the jobs for what rows lack, such as rows indexed before
+// a column existed or whose jobs did not finish.
+func (sp *SqlPopulator) backfill(f filescanner.File, k knownFoto) error {
+	if !k.phash && hasPerceptualHash(f.Format) {
+		s := backfillJob(jobPerceptualHash, f.Path)
+		if err := sp.queue(s.query, s.args...); err != nil {
+			return err
+		}
+	}
+	if !k.metadata {
+		s := backfillJob(jobMetadata, f.Path)
+		return sp.queue(s.query, s.args...)
+	}
+	return nil
+}
+
+// queueJobs queues the jobs that read the metadata and compute the
+// perceptual hash of f for the row at its path, which may be inserted
+// earlier in the same batch. Only hashing is left to the scan, which needs
+// it to tell moves from new files.
+func (sp *SqlPopulator) queueJobs(f filescanner.File, enqueue func(jobType string, path string) statement) error {
+	jobTypes := []string{jobMetadata}
+	if hasPerceptualHash(f.Format) {
+		jobTypes = append(jobTypes, jobPerceptualHash)
+	}
+	for _, jobType := range jobTypes {
+		s := enqueue(jobType, f.Path)
+		if err := sp.queue(s.query, s.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sp *SqlPopulator) add(f filescanner.File) error {
+	if sp.live {
+		// Only rows already marked missing can be the source of a move.
+		var id int64
+		var from string
+		err := sp.db.QueryRow("SELECT id, path FROM fotos WHERE hash = ? AND status = ? LIMIT 1", f.Hash, statusMissing).Scan(&id, &from)
+		if err == nil {
+			return sp.move(id, from, f)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+	} else if len(sp.byHash[f.Hash]) > 0 {
+		// Same content as a known row: decide between a move and a copy
+		// once the whole tree has been seen.
+		sp.moves = append(sp.moves, f)
+		return nil
+	}
+
+	fmt.Println("Added ", f.Format.Kind, " file: ", f.Path)
+	return sp.insert(f)
+}
+
+// insert ignores rows that already exist, as a watcher may have added the
+// file since a full scan took its snapshot.
+func (sp *SqlPopulator) insert(f filescanner.File) error {
+	err := sp.queue("INSERT OR IGNORE INTO fotos (path, root, mtime, format, size, hash) VALUES (?, ?, ?, ?, ?, ?)",
+		f.Path, sp.root.Name, f.ModTime.UTC(), f.Format.Name, f.Size, f.Hash)
+	if err != nil {
+		return err
+	}
+	return sp.queueJobs(f, enqueueJob)
+}
+
+// move points the row of a moved file at its new path. The sidecar is read
+// again, as it may or may not have moved along.
+func (sp *SqlPopulator) move(id int64, from string, f filescanner.File) error {
+	fmt.Println("Moved ", f.Format.Kind, " file: ", from, " -> ", f.Path)
+	err := sp.queue("UPDATE fotos SET path = ?, root = ?, previous_path = ?, mtime = ?, size = ?, status = ? WHERE id = ?",
+		f.Path, sp.root.Name, from, f.ModTime.UTC(), f.Size, statusMoved, id)
+	if err != nil {
+		return err
+	}
+	return sp.queueAnnotations(f)
+}
+
+// remove marks the row at path, or every row under it when path was a
+// directory, as missing.
+func (sp *SqlPopulator) remove(path string) error {
+	lo, hi := prefixRange(path)
+	res, err := sp.db.Exec("UPDATE fotos SET status = ? WHERE (path = ? OR (path > ? AND path < ?)) AND status IS NOT ?",
+		statusMissing, path, lo, hi, statusMissing)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		fmt.Println("Missing ", n, " file(s) under: ", path)
+		similarIndex.Invalidate()
+	}
+	return nil
+}
+
+// gone reports whether the known row at path no longer has a file behind
+// it. Unseen rows only count when the scan of their tree was complete.
+func (sp *SqlPopulator) gone(path string, root string, complete bool) bool {
+	if sp.seen[path] {
+		return false
+	}
+	if sp.known[path].status == statusMissing {
+		return true
+	}
+	if !complete || !under(path, root) {
+		return false
+	}
+	for _, failed := range sp.failed {
+		if under(path, failed) {
+			return false
+		}
+	}
+	return true
+}
+
+// Finish resolves moves and marks rows under the root whose files were
+// not seen as missing, then writes everything out. complete must only be
+// true when the scan walked the whole tree.
+func (sp *SqlPopulator) Finish(complete bool) error {
+	root := filepath.Clean(sp.root.Path)
+
+	for _, f := range sp.moves {
+		from := ""
+		for _, path := range sp.byHash[f.Hash] {
+			if sp.gone(path, root, complete) {
+				from = path
+				break
+			}
+		}
+
+		var err error
+		if from == "" {
+			fmt.Println("Added ", f.Format.Kind, " file: ", f.Path)
+			err = sp.insert(f)
+		} else {
+			sp.seen[from] = true
+			err = sp.move(sp.known[from].id, from, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sp.moves = nil
+
+	for path, k := range sp.known {
+		if k.status == statusMissing || !sp.gone(path, root, complete) {
+			continue
+		}
+		fmt.Println("Missing file: ", path)
+		if err := sp.queue("UPDATE fotos SET status = ? WHERE id = ?", statusMissing, k.id); err != nil {
+			return err
+		}
+	}
+
+	return sp.Flush()
+}
+
+// Flush writes the pending statements in one transaction.
+func (sp *SqlPopulator) Flush() error {
+	if len(sp.pending) == 0 {
+		return nil
+	}
+
+	tx, err := sp.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sp.pending {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sp.pending = sp.pending[:0]
+	similarIndex.Invalidate()
+	return nil
+}
+
+func under(path string, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// prefixRange returns the bounds of the paths strictly under dir, for an
+// index-friendly range query instead of LIKE, which would need escaping.
+func prefixRange(dir string) (string, string) {
+	return dir + string(filepath.Separator), dir + string(filepath.Separator+1)
+}
+
+func scanOptions(root RootConfig, config ScanConfig, sp *SqlPopulator) filescanner.Options {
+	return filescanner.Options{
+		Workers:    config.Workers,
+		QueueSize:  config.QueueSize,
+		Hash:       true,
+		ShouldHash: sp.needsHash,
+		Include:    root.Include,
+		Exclude:    root.Exclude,
+		IgnoreFile: config.IgnoreFile,
+	}
+}
+
+func fillSqlLiteDb(db *sql.DB, root RootConfig, config ScanConfig) {
+	sp, err := NewSqlPopulator(db, root, config.BatchSize)
+	if err != nil {
+		log.Println("Failed to load known fotos: ", err)
+		return
+	}
+
+	opts := scanOptions(root, config, sp)
+	opts.OnError = sp.scanError
+	summary, err := filescanner.Scan(context.Background(), root.Path, sp.visitImageFile, opts)
+	if err != nil {
+		log.Println("Scan of ", root.Name, " stopped: ", err)
+	}
+	if err := sp.Finish(err == nil); err != nil {
+		log.Println("Failed to write scan results: ", err)
+	}
+	fmt.Printf("Scanned %s: %d files in %v, %d matched, %d sidecars, %d skipped, %d errored.\n",
+		root.Name, summary.Seen, summary.Duration, summary.Matched, summary.Sidecars, summary.Skipped, summary.Errored)
+}
+
+// scanLibrary scans the roots one after the other, so that they do not
+// compete for the same disks.
+func scanLibrary(db *sql.DB, roots []RootConfig, config ScanConfig) {
+	for _, root := range roots {
+		fillSqlLiteDb(db, root, config)
+	}
+}
+
+// watchLibrary feeds live changes under the roots into the fotos table and
+// runs a full scan every rescan interval to catch anything the watch
+// missed.
+func watchLibrary(db *sql.DB, roots []RootConfig, config ScanConfig) {
+	go func() {
+		for range time.Tick(config.RescanInterval.Duration) {
+			scanLibrary(db, roots, config)
+		}
+	}()
+
+	for _, root := range roots {
+		go watchRoot(db, root, config)
+	}
+}
+
+func watchRoot(db *sql.DB, root RootConfig, config ScanConfig) {
+	sp := NewLivePopulator(db, root)
+	opts := filescanner.WatchOptions{
+		Options:  scanOptions(root, config, sp),
+		Debounce: config.WatchDebounce.Duration,
+		OnRemove: sp.remove,
+	}
+	opts.OnError = func(path string, err error) {
+		log.Println("Failed to watch ", path, ": ", err)
+	}
+	err := filescanner.Watch(context.Background(), root.Path, sp.visitImageFile, opts)
+	log.Println("Stopped watching ", root.Name, ": ", err)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filescanner"
+)
+
+func TestScanFillsMissingRoot(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	for _, test := range []struct {
+		name string
+		hash string
+	}{
+		{"unchanged", ""},
+		{"rehashed", "same"},
+		{"modified", "other"},
+	} {
+		path := "/library/" + test.name + ".jpg"
+		id := insertTestFoto(t, db, path, "")
+		if _, err := db.Exec("UPDATE fotos SET hash = 'same' WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+
+		f := filescanner.File{Path: path, ModTime: time.Now(), Format: filescanner.Lookup(path), Hash: test.hash}
+		sp := NewLivePopulator(db, RootConfig{Name: "family", Path: "/library"})
+		if err := sp.visitImageFile(f); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := sp.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		var root string
+		if err := db.QueryRow("SELECT COALESCE(root, '') FROM fotos WHERE id = ?", id).Scan(&root); err != nil {
+			t.Fatal(err)
+		}
+		if root != "family" {
+			t.Errorf("%s: root %q, want family", test.name, root)
+		}
+	}
+}
+
+func TestScanKeepsRoot(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	path := "/library/a.jpg"
+	id := insertTestFoto(t, db, path, "family")
+	f := filescanner.File{Path: path, ModTime: time.Now(), Format: filescanner.Lookup(path), Hash: "other"}
+	if err := NewLivePopulator(db, RootConfig{}).visitImageFile(f); err != nil {
+		t.Fatal(err)
+	}
+	var root string
+	if err := db.QueryRow("SELECT COALESCE(root, '') FROM fotos WHERE id = ?", id).Scan(&root); err != nil {
+		t.Fatal(err)
+	}
+	if root != "family" {
+		t.Errorf("root %q, want family", root)
+	}
+}
+
+// knownTestFoto returns the status, hash and queued metadata jobs of the
+// row at path.
+func knownTestFoto(t *testing.T, db *sql.DB, path string) (string, string, int) {
+	var status, hash string
+	var jobs int
+	err := db.QueryRow("SELECT COALESCE(status, ''), COALESCE(hash, ''), "+
+		"(SELECT COUNT(*) FROM jobs WHERE jobs.foto_id = fotos.id AND type = ? AND state = ?) FROM fotos WHERE path = ?",
+		jobMetadata, jobQueued, path).Scan(&status, &hash, &jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, hash, jobs
+}
+
+func TestRescanStatus(t *testing.T) {
+	mtime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name       string
+		status     string
+		hash       string
+		size       int64
+		mtime      time.Time
+		newHash    string
+		wantStatus string
+		wantHash   string
+		wantJob    bool
+	}{
+		{"modified found unchanged", statusModified, "abc", 10, mtime, "", "", "abc", false},
+		{"moved found unchanged", statusMoved, "abc", 10, mtime, "", "", "abc", false},
+		{"modified rehashed unchanged", statusModified, "abc", 10, mtime.Add(time.Hour), "abc", "", "abc", false},
+		{"missing found again", statusMissing, "abc", 10, mtime, "", "", "abc", false},
+		{"changed", "", "abc", 12, mtime.Add(time.Hour), "def", statusModified, "def", true},
+		{"unhashed unchanged", "", "", 10, mtime, "abc", "", "abc", false},
+		{"unhashed changed size", "", "", 12, mtime, "abc", statusModified, "abc", true},
+		{"unhashed changed mtime", statusMoved, "", 10, mtime.Add(time.Hour), "abc", statusModified, "abc", true},
+	} {
+		db := newTestDB(t)
+		path := "/library/a.jpg"
+		_, err := db.Exec("INSERT INTO fotos (path, root, mtime, format, size, hash, status, metadata_at) VALUES (?, 'family', ?, 'jpeg', 10, ?, ?, ?)",
+			path, mtime, nullString(test.hash), nullString(test.status), mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := filescanner.File{Path: path, Size: test.size, ModTime: test.mtime, Format: filescanner.Lookup(path), Hash: test.newHash}
+		sp := NewLivePopulator(db, RootConfig{Name: "family", Path: "/library"})
+		if err := sp.visitImageFile(f); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := sp.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		status, hash, jobs := knownTestFoto(t, db, path)
+		if status != test.wantStatus || hash != test.wantHash || (jobs == 1) != test.wantJob {
+			t.Errorf("%s: status %q, hash %q, %d metadata jobs; want %q, %q, job %v",
+				test.name, status, hash, jobs, test.wantStatus, test.wantHash, test.wantJob)
+		}
+		db.Close()
+	}
+}
+
+func TestRescanModifiedReadsSidecar(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.jpg")
+	writeTestJPEG(t, path, time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC))
+	sidecar := filepath.Join(dir, "a.xmp")
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="4"/></rdf:RDF></x:xmpmeta>`
+	if err := ioutil.WriteFile(sidecar, []byte(packet), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The metadata was read before the sidecar was written.
+	mtime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = db.Exec("INSERT INTO fotos (path, root, mtime, format, size, hash, metadata_at) VALUES (?, 'family', ?, 'jpeg', 10, 'abc', ?)",
+		path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := filescanner.File{Path: path, Size: 12, ModTime: time.Now(), Format: filescanner.Lookup(path), Hash: "def",
+		Sidecar: sidecar, SidecarModTime: time.Now()}
+	sp := NewLivePopulator(db, RootConfig{Name: "family", Path: dir})
+	if err := sp.visitImageFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rating int
+	var stored string
+	if err := db.QueryRow("SELECT COALESCE(rating, 0), COALESCE(sidecar, '') FROM fotos WHERE path = ?", path).Scan(&rating, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if rating != 4 || stored != sidecar {
+		t.Errorf("rating %d from sidecar %q, want 4 from %s", rating, stored, sidecar)
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"filescanner"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Job types. Each works on one foto.
+const (
+	jobMetadata       = "metadata"
+	jobPerceptualHash = "phash"
+	jobThumbnails     = "thumbs"
+)
+
+func knownJobType(jobType string) bool {
+	return jobType == jobMetadata || jobType == jobPerceptualHash || jobType == jobThumbnails
+}
+
+// Job states. A queued job runs at run_at; a running one is held by its
+// worker until lease_until, and taken over by another worker after that,
+// as when boonfoto stopped halfway. A job that failed as often as allowed
+// is dead until retried by hand.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobDead    = "dead"
+)
+
+// jobPollInterval is how long idle workers wait before looking for jobs
+// again.
+const jobPollInterval = 2 * time.Second
+
+// jobMaxBackoff bounds the delay before a failed job is retried.
+const jobMaxBackoff = 24 * time.Hour
+
+type Job struct {
+	Id         int64      `json:"id"`
+	Type       string     `json:"type"`
+	FotoId     int32      `json:"fotoId"`
+	State      string     `json:"state"`
+	Attempts   int        `json:"attempts"`
+	RunAt      time.Time  `json:"runAt"`
+	LeaseUntil *time.Time `json:"leaseUntil,omitempty"`
+	Worker     string     `json:"worker,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	Logs       []JobLog   `json:"logs,omitempty"`
+}
+
+type JobLog struct {
+	At      time.Time `json:"at"`
+	Message string    `json:"message"`
+}
+
+// JobStats is the queue of one job type. Retrying counts the queued jobs
+// that failed before.
+type JobStats struct {
+	Type     string `json:"type"`
+	Queued   int    `json:"queued"`
+	Retrying int    `json:"retrying"`
+	Running  int    `json:"running"`
+	Done     int    `json:"done"`
+	Dead     int    `json:"dead"`
+}
+
+var errJobNotDead = fmt.Errorf("only dead jobs can be retried")
+
+// enqueueJob returns the statement that queues a job for the foto at path,
+// unless one is queued already.
+func enqueueJob(jobType string, path string) statement {
+	now := time.Now().UTC()
+	return statement{"INSERT OR IGNORE INTO jobs (type, foto_id, state, run_at, created_at, updated_at) " +
+		"SELECT ?, id, ?, ?, ?, ? FROM fotos WHERE path = ?", []interface{}{jobType, jobQueued, now, now, now, path}}
+}
+
+// backfillJob is like enqueueJob, but leaves out fotos whose job of the
+// type is running or dead, as for files a scan finds still unprocessed.
+// Dead jobs wait to be retried by hand rather than fail on every scan.
+func backfillJob(jobType string, path string) statement {
+	s := enqueueJob(jobType, path)
+	s.query += " AND NOT EXISTS (SELECT 1 FROM jobs WHERE jobs.type = ? AND jobs.foto_id = fotos.id AND jobs.state IN (?, ?))"
+	s.args = append(s.args, jobType, jobRunning, jobDead)
+	return s
+}
+
+// jobHandler does the work of a job, writing what it wants kept in the
+// job's log with logf.
+type jobHandler func(job *Job, logf func(format string, args ...interface{})) error
+
+// JobQueue runs the jobs stored in the jobs table with a pool of workers
+// for each job type.
+type JobQueue struct {
+	db       *sql.DB
+	config   JobsConfig
+	handlers map[string]jobHandler
+	name     string
+
+	// leaseMu keeps the workers of this process from leasing the same job.
+	leaseMu sync.Mutex
+}
+
+func NewJobQueue(db *sql.DB, config JobsConfig) *JobQueue {
+	host, _ := os.Hostname()
+	return &JobQueue{db: db, config: config, handlers: make(map[string]jobHandler), name: fmt.Sprintf("%s-%d", host, os.Getpid())}
+}
+
+func (q *JobQueue) Handle(jobType string, h jobHandler) {
+	q.handlers[jobType] = h
+}
+
+// Start starts the workers and the pruning of finished jobs.
+func (q *JobQueue) Start() {
+	for jobType := range q.handlers {
+		for i := 0; i < q.config.Workers[jobType]; i++ {
+			go q.work(jobType, fmt.Sprintf("%s/%s-%d", q.name, jobType, i+1))
+		}
+	}
+	go func() {
+		for {
+			if err := q.prune(); err != nil {
+				log.Println("Failed to prune jobs: ", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func (q *JobQueue) work(jobType string, worker string) {
+	for {
+		job, err := q.lease(jobType, worker)
+		if err != nil {
+			log.Println("Failed to lease ", jobType, " job: ", err)
+		}
+		if job == nil {
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		q.run(job, worker)
+	}
+}
+
+// lease takes the next job of a type that is due, or whose worker let its
+// lease run out, or returns nil. The update repeats the condition, so that
+// a job another boonfoto on the same database leased in between is left
+// to it and the next one is looked for.
+func (q *JobQueue) lease(jobType string, worker string) (*Job, error) {
+	q.leaseMu.Lock()
+	defer q.leaseMu.Unlock()
+
+	for {
+		now := time.Now().UTC()
+		var id int64
+		err := q.db.QueryRow("SELECT id FROM jobs WHERE type = ? AND ((state = ? AND run_at <= ?) OR (state = ? AND lease_until < ?)) ORDER BY run_at, id LIMIT 1",
+			jobType, jobQueued, now, jobRunning, now).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		res, err := q.db.Exec("UPDATE jobs SET state = ?, attempts = attempts + 1, lease_until = ?, worker = ?, updated_at = ? "+
+			"WHERE id = ? AND ((state = ? AND run_at <= ?) OR (state = ? AND lease_until < ?))",
+			jobRunning, now.Add(q.config.Lease.Duration), worker, now, id, jobQueued, now, jobRunning, now)
+		if err != nil {
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			return loadJob(q.db, id)
+		}
+	}
+}
+
+// run runs a leased job, renewing its lease while it works, and records
+// the outcome.
+func (q *JobQueue) run(job *Job, worker string) {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(q.config.Lease.Duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := q.heartbeat(job.Id, worker); err != nil {
+					log.Println("Failed to renew lease of job ", job.Id, ": ", err)
+				}
+			}
+		}
+	}()
+
+	logf := func(format string, args ...interface{}) {
+		if err := addJobLog(q.db, job.Id, fmt.Sprintf(format, args...)); err != nil {
+			log.Println("Failed to log job ", job.Id, ": ", err)
+		}
+	}
+	logf("Attempt %d by %s.", job.Attempts, worker)
+	start := time.Now()
+	err := q.handlers[job.Type](job, logf)
+	close(stop)
+
+	if err == nil {
+		logf("Done in %s.", time.Since(start).Round(time.Millisecond))
+		err = q.finish(job, worker, jobDone, time.Time{}, "")
+	} else if job.Attempts >= q.config.MaxAttempts {
+		logf("Failed, giving up: %v", err)
+		err = q.finish(job, worker, jobDead, time.Time{}, err.Error())
+	} else {
+		runAt := time.Now().Add(retryDelay(q.config.Backoff.Duration, job.Attempts))
+		logf("Failed, retrying at %s: %v", runAt.Format(time.RFC3339), err)
+		err = q.finish(job, worker, jobQueued, runAt, err.Error())
+	}
+	if err != nil {
+		log.Println("Failed to finish job ", job.Id, ": ", err)
+	}
+}
+
+// retryDelay is the wait before retrying a job that failed its attempts
+// so far: backoff after the first, doubling with every further one up to
+// jobMaxBackoff.
+func retryDelay(backoff time.Duration, attempts int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempts && delay < jobMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > jobMaxBackoff {
+		delay = jobMaxBackoff
+	}
+	return delay
+}
+
+func (q *JobQueue) heartbeat(id int64, worker string) error {
+	now := time.Now().UTC()
+	_, err := q.db.Exec("UPDATE jobs SET lease_until = ?, updated_at = ? WHERE id = ? AND worker = ? AND state = ?",
+		now.Add(q.config.Lease.Duration), now, id, worker, jobRunning)
+	return err
+}
+
+// finish moves a job the worker still holds to state. A job to retry
+// whose foto got queued again in the meantime is left to that newer one.
+func (q *JobQueue) finish(job *Job, worker string, state string, runAt time.Time, lastError string) error {
+	now := time.Now().UTC()
+	if runAt.IsZero() {
+		runAt = now
+	}
+	_, err := q.db.Exec("UPDATE jobs SET state = ?, run_at = ?, lease_until = NULL, last_error = ?, updated_at = ? WHERE id = ? AND worker = ? AND state = ?",
+		state, runAt.UTC(), nullString(lastError), now, job.Id, worker, jobRunning)
+	if e, ok := err.(sqlite3.Error); ok && e.ExtendedCode == sqlite3.ErrConstraintUnique {
+		if err := addJobLog(q.db, job.Id, "Superseded by a newer job for the foto."); err != nil {
+			return err
+		}
+		_, err = q.db.Exec("UPDATE jobs SET state = ?, lease_until = NULL, last_error = ?, updated_at = ? WHERE id = ? AND worker = ? AND state = ?",
+			jobDone, nullString(lastError), now, job.Id, worker, jobRunning)
+	}
+	return err
+}
+
+// prune deletes the jobs that finished longer ago than configured.
+func (q *JobQueue) prune() error {
+	before := time.Now().Add(-q.config.KeepDone.Duration).UTC()
+	_, err := q.db.Exec("DELETE FROM job_logs WHERE job_id IN (SELECT id FROM jobs WHERE state = ? AND updated_at < ?)", jobDone, before)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec("DELETE FROM jobs WHERE state = ? AND updated_at < ?", jobDone, before)
+	return err
+}
+
+func addJobLog(db *sql.DB, id int64, message string) error {
+	_, err := db.Exec("INSERT INTO job_logs (job_id, at, message) VALUES (?, ?, ?)", id, time.Now().UTC(), message)
+	return err
+}
+
+const jobColumns = "id, type, foto_id, state, attempts, run_at, lease_until, COALESCE(worker, ''), COALESCE(last_error, ''), created_at, updated_at"
+
+func scanJob(row scanner) (*Job, error) {
+	var job Job
+	var leaseUntil NullTime
+	err := row.Scan(&job.Id, &job.Type, &job.FotoId, &job.State, &job.Attempts, &job.RunAt, &leaseUntil,
+		&job.Worker, &job.LastError, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if leaseUntil.Valid {
+		job.LeaseUntil = &leaseUntil.Time
+	}
+	return &job, nil
+}
+
+func loadJob(db *sql.DB, id int64) (*Job, error) {
+	job, err := scanJob(db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id))
+	return job, storeError(err)
+}
+
+// loadJobWithLogs returns job id with its log, or ErrNotFound.
+func loadJobWithLogs(db *sql.DB, id int64) (*Job, error) {
+	job, err := loadJob(db, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT at, message FROM job_logs WHERE job_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+	job.Logs = []JobLog{}
+	for rows.Next() {
+		var l JobLog
+		if err := rows.Scan(&l.At, &l.Message); err != nil {
+			return nil, storeError(err)
+		}
+		job.Logs = append(job.Logs, l)
+	}
+	return job, storeError(rows.Err())
+}
+
+// listJobs returns the jobs in a state and of a type, where given, the
+// most recently updated first.
+func listJobs(db *sql.DB, state string, jobType string, limit int) ([]*Job, error) {
+	var conds []string
+	var args []interface{}
+	if state != "" {
+		conds = append(conds, "state = ?")
+		args = append(args, state)
+	}
+	if jobType != "" {
+		conds = append(conds, "type = ?")
+		args = append(args, jobType)
+	}
+	query := "SELECT " + jobColumns + " FROM jobs"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	rows, err := db.Query(query+" ORDER BY updated_at DESC, id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, storeError(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, storeError(rows.Err())
+}
+
+// jobStats counts the jobs of each type by state.
+func jobStats(db *sql.DB) ([]JobStats, error) {
+	rows, err := db.Query("SELECT type, state, attempts > 0, COUNT(*) FROM jobs GROUP BY type, state, attempts > 0 ORDER BY type")
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+
+	stats := []JobStats{}
+	byType := map[string]*JobStats{}
+	for _, jobType := range []string{jobMetadata, jobPerceptualHash, jobThumbnails} {
+		stats = append(stats, JobStats{Type: jobType})
+	}
+	for i := range stats {
+		byType[stats[i].Type] = &stats[i]
+	}
+	for rows.Next() {
+		var jobType, state string
+		var failed bool
+		var n int
+		if err := rows.Scan(&jobType, &state, &failed, &n); err != nil {
+			return nil, storeError(err)
+		}
+		s := byType[jobType]
+		if s == nil {
+			continue
+		}
+		switch state {
+		case jobQueued:
+			s.Queued += n
+			if failed {
+				s.Retrying += n
+			}
+		case jobRunning:
+			s.Running += n
+		case jobDone:
+			s.Done += n
+		case jobDead:
+			s.Dead += n
+		}
+	}
+	return stats, storeError(rows.Err())
+}
+
+// retryJob queues a dead job again with its attempts reset.
+func retryJob(db *sql.DB, id int64) (*Job, error) {
+	job, err := loadJob(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State != jobDead {
+		return nil, errJobNotDead
+	}
+	now := time.Now().UTC()
+	_, err = db.Exec("UPDATE jobs SET state = ?, attempts = 0, run_at = ?, worker = NULL, updated_at = ? WHERE id = ? AND state = ?",
+		jobQueued, now, now, id, jobDead)
+	if e, ok := err.(sqlite3.Error); ok && e.ExtendedCode == sqlite3.ErrConstraintUnique {
+		// The foto has a queued job of this type already.
+		_, err = db.Exec("UPDATE jobs SET state = ?, updated_at = ? WHERE id = ? AND state = ?", jobDone, now, id, jobDead)
+		if err == nil {
+			err = addJobLog(db, id, "Retried by the job queued for the foto already.")
+		}
+	} else if err == nil {
+		err = addJobLog(db, id, "Queued again by hand.")
+	}
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return loadJob(db, id)
+}
+
+// jobFile returns the file of the foto a job works on, or nil when the
+// foto or its file is gone, which leaves nothing to do.
+func jobFile(db *sql.DB, job *Job, logf func(format string, args ...interface{})) (*filescanner.File, string, error) {
+	var path, root string
+	err := db.QueryRow("SELECT path, COALESCE(root, '') FROM fotos WHERE id = ? AND status IS NOT ?", job.FotoId, statusMissing).Scan(&path, &root)
+	if err == sql.ErrNoRows {
+		logf("Foto %d is gone, nothing to do.", job.FotoId)
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		logf("File %s is gone, nothing to do.", path)
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	format, err := filescanner.Detect(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if format == nil {
+		return nil, "", fmt.Errorf("unknown format of %s", path)
+	}
+	f := &filescanner.File{Path: path, Size: info.Size(), ModTime: info.ModTime(), Format: format}
+	if sidecar, sidecarInfo := filescanner.FindSidecar(path); sidecarInfo != nil {
+		f.Sidecar, f.SidecarModTime = sidecar, sidecarInfo.ModTime()
+	}
+	return f, root, nil
+}
+
+// metadataJob reads the metadata and annotations of a foto and queues its
+// thumbnails.
+func metadataJob(db *sql.DB) jobHandler {
+	return func(job *Job, logf func(format string, args ...interface{})) error {
+		f, root, err := jobFile(db, job, logf)
+		if f == nil || err != nil {
+			return err
+		}
+		sp := NewLivePopulator(db, RootConfig{Name: root})
+		if err := sp.queueMetadata(*f); err != nil {
+			return err
+		}
+		if hasPerceptualHash(f.Format) {
+			s := enqueueJob(jobThumbnails, f.Path)
+			if err := sp.queue(s.query, s.args...); err != nil {
+				return err
+			}
+		}
+		logf("Read metadata of %s.", f.Path)
+		return nil
+	}
+}
+
+// perceptualHashJob computes the pHash of a foto for finding similar ones.
+func perceptualHashJob(db *sql.DB) jobHandler {
+	return func(job *Job, logf func(format string, args ...interface{})) error {
+		f, _, err := jobFile(db, job, logf)
+		if f == nil || err != nil {
+			return err
+		}
+		hash, err := perceptualHash(f.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE fotos SET phash = ? WHERE id = ?", int64(hash), job.FotoId); err != nil {
+			return err
+		}
+		similarIndex.Invalidate()
+		logf("Perceptual hash of %s is %016x.", f.Path, hash)
+		return nil
+	}
+}
+
+// thumbnailsJob renders the thumbnails the timeline shows ahead of their
+// first request, in every format they may be negotiated in. Large ones are
+// left to be rendered on demand.
+func thumbnailsJob(db *sql.DB, rc *renderCache, quality int) jobHandler {
+	return func(job *Job, logf func(format string, args ...interface{})) error {
+		src, err := loadRenderSource(db, job.FotoId)
+		if err == ErrNotFound {
+			logf("Foto %d is gone, nothing to do.", job.FotoId)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(src.Path); os.IsNotExist(err) {
+			logf("File %s is gone, nothing to do.", src.Path)
+			return nil
+		}
+		formats := []string{"jpeg"}
+		for _, format := range negotiatedFormats {
+			if canEncode(format) {
+				formats = append(formats, format)
+			}
+		}
+		for _, size := range []string{"square", "small"} {
+			for _, format := range formats {
+				spec := thumbSizes[size]
+				spec.Quality, spec.Format = quality, format
+				path, _, err := rc.get(src, spec)
+				if err != nil {
+					return err
+				}
+				logf("Rendered %s %s thumbnail %s.", size, format, path)
+			}
+		}
+		return nil
+	}
+}
+
+// startJobs starts the workers of the job queue. Jobs left running when
+// boonfoto stopped are taken up again once their lease runs out.
+func startJobs(db *sql.DB, config *Config, thumbs *renderCache) *JobQueue {
+	q := NewJobQueue(db, config.Jobs)
+	q.Handle(jobMetadata, metadataJob(db))
+	q.Handle(jobPerceptualHash, perceptualHashJob(db))
+	q.Handle(jobThumbnails, thumbnailsJob(db, thumbs, config.Thumbs.Quality))
+	q.Start()
+	return q
+}
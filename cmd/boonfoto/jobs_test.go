@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataJobWithoutRoot(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.jpg")
+	taken := time.Date(2017, 5, 1, 10, 20, 30, 0, time.FixedZone("", 8*3600))
+	writeTestJPEG(t, path, taken)
+	// Rows indexed before library roots existed have no root.
+	id := insertTestFoto(t, db, path, "")
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	if err := metadataJob(db)(&Job{Id: 1, Type: jobMetadata, FotoId: id}, logf); err != nil {
+		t.Fatalf("metadata job: %v (log %q)", err, logs)
+	}
+
+	var takenAt time.Time
+	var offset string
+	err = db.QueryRow("SELECT taken_at, taken_offset FROM fotos WHERE id = ? AND metadata_at IS NOT NULL", id).Scan(&takenAt, &offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !takenAt.Equal(taken) || offset != "+08:00" {
+		t.Errorf("taken_at %v %s, want %v", takenAt, offset, taken)
+	}
+	var queued int
+	if err := db.QueryRow("SELECT COUNT(*) FROM jobs WHERE type = ? AND foto_id = ?", jobThumbnails, id).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("%d thumbnail jobs queued, want 1", queued)
+	}
+}
+
+func TestMetadataJobOfMissingFile(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	id := insertTestFoto(t, db, "/nonexistent/a.jpg", "")
+	if err := metadataJob(db)(&Job{Id: 1, Type: jobMetadata, FotoId: id}, func(string, ...interface{}) {}); err != nil {
+		t.Errorf("metadata job of a missing file: %v, want nothing to do", err)
+	}
+}
+
+func newTestQueue(db *sql.DB) *JobQueue {
+	return NewJobQueue(db, JobsConfig{MaxAttempts: 2, Backoff: Duration{time.Minute}, Lease: Duration{time.Minute}})
+}
+
+// queueTestJob queues a job of jobType for a new foto at path.
+func queueTestJob(t *testing.T, db *sql.DB, jobType string, path string) int64 {
+	insertTestFoto(t, db, path, "")
+	s := enqueueJob(jobType, path)
+	res, err := db.Exec(s.query, s.args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestLeaseTakesOverExpiredLease(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	q := newTestQueue(db)
+	id := queueTestJob(t, db, jobMetadata, "/fotos/a.jpg")
+
+	job, err := q.lease(jobMetadata, "first")
+	if err != nil || job == nil || job.Id != id {
+		t.Fatalf("lease: %v, %v, want job %d", job, err, id)
+	}
+	if job, err := q.lease(jobMetadata, "second"); err != nil || job != nil {
+		t.Fatalf("lease of a held job: %v, %v, want none", job, err)
+	}
+
+	// The first worker stopped without renewing its lease.
+	if _, err := db.Exec("UPDATE jobs SET lease_until = ? WHERE id = ?", time.Now().Add(-time.Second).UTC(), id); err != nil {
+		t.Fatal(err)
+	}
+	job, err = q.lease(jobMetadata, "second")
+	if err != nil || job == nil {
+		t.Fatalf("lease of an expired job: %v, %v", job, err)
+	}
+	if job.Id != id || job.Worker != "second" || job.State != jobRunning || job.Attempts != 2 {
+		t.Errorf("taken over job %+v, want job %d running for second in attempt 2", job, id)
+	}
+	if err := q.heartbeat(id, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if job, err := loadJob(db, id); err != nil || job.Worker != "second" {
+		t.Errorf("job after the first worker's heartbeat: %+v, %v, want it held by second", job, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, c := range []struct {
+		backoff  time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{time.Minute, 1, time.Minute},
+		{time.Minute, 2, 2 * time.Minute},
+		{time.Minute, 3, 4 * time.Minute},
+		{time.Minute, 5, 16 * time.Minute},
+		{time.Hour, 5, 16 * time.Hour},
+		{time.Hour, 6, jobMaxBackoff},
+		{time.Hour, 1000, jobMaxBackoff},
+		{48 * time.Hour, 1, jobMaxBackoff},
+	} {
+		if got := retryDelay(c.backoff, c.attempts); got != c.want {
+			t.Errorf("retryDelay(%s, %d) = %s, want %s", c.backoff, c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestFailingJobDies(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	q := newTestQueue(db)
+	q.Handle(jobMetadata, func(job *Job, logf func(format string, args ...interface{})) error {
+		return fmt.Errorf("broken")
+	})
+	id := queueTestJob(t, db, jobMetadata, "/fotos/a.jpg")
+
+	job, err := q.lease(jobMetadata, "worker")
+	if err != nil || job == nil {
+		t.Fatalf("lease: %v, %v", job, err)
+	}
+	start := time.Now()
+	q.run(job, "worker")
+	job, err = loadJob(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobQueued || job.LastError != "broken" || job.RunAt.Before(start.Add(time.Minute)) {
+		t.Fatalf("job after the first failure: %+v, want it queued a minute later", job)
+	}
+	if job, err := q.lease(jobMetadata, "worker"); err != nil || job != nil {
+		t.Fatalf("lease before the retry is due: %v, %v, want none", job, err)
+	}
+
+	if _, err := db.Exec("UPDATE jobs SET run_at = ? WHERE id = ?", time.Now().Add(-time.Second).UTC(), id); err != nil {
+		t.Fatal(err)
+	}
+	job, err = q.lease(jobMetadata, "worker")
+	if err != nil || job == nil {
+		t.Fatalf("lease of the retry: %v, %v", job, err)
+	}
+	q.run(job, "worker")
+	job, err = loadJob(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobDead || job.Attempts != 2 || job.LastError != "broken" {
+		t.Errorf("job after MaxAttempts failures: %+v, want it dead", job)
+	}
+}
+
+func TestRetryJobAlreadyQueued(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	id := queueTestJob(t, db, jobMetadata, "/fotos/a.jpg")
+	if _, err := db.Exec("UPDATE jobs SET state = ?, attempts = 5 WHERE id = ?", jobDead, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := retryJob(db, id+100); err != ErrNotFound {
+		t.Errorf("retry of an unknown job: %v, want ErrNotFound", err)
+	}
+
+	// A later change to the foto queued a new job of the type.
+	s := enqueueJob(jobMetadata, "/fotos/a.jpg")
+	if _, err := db.Exec(s.query, s.args...); err != nil {
+		t.Fatal(err)
+	}
+	job, err := retryJob(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobDone {
+		t.Errorf("retried job %+v, want it done in favour of the queued one", job)
+	}
+	if queued, err := Count(db, "SELECT COUNT(*) FROM jobs WHERE state = ?", jobQueued); err != nil || queued != 1 {
+		t.Errorf("%d jobs queued (%v), want 1", queued, err)
+	}
+	if _, err := retryJob(db, id); err != errJobNotDead {
+		t.Errorf("retry of a done job: %v, want errJobNotDead", err)
+	}
+}
+
+func TestRetryDeadJob(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	id := queueTestJob(t, db, jobMetadata, "/fotos/a.jpg")
+	if _, err := db.Exec("UPDATE jobs SET state = ?, attempts = 5, worker = 'w' WHERE id = ?", jobDead, id); err != nil {
+		t.Fatal(err)
+	}
+	job, err := retryJob(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != jobQueued || job.Attempts != 0 || job.Worker != "" {
+		t.Errorf("retried job %+v, want it queued afresh", job)
+	}
+}
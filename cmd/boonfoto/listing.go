@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Page sizes of /api/fotos. The largest stays below the number of
+// parameters SQLite takes in one statement, as keywords are loaded by id.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// defaultFields are the Foto fields /api/fotos returns unless asked for
+// others.
+var defaultFields = []string{"id", "path", "takenAt", "mtime", "format", "width", "height", "rotation", "rating"}
+
+// fotoFields are the JSON names of the Foto fields.
+var fotoFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Foto{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// FotoPage is a page of /api/fotos. Next is the cursor of the page after
+// it, empty on the last page.
+type FotoPage struct {
+	Fotos []map[string]interface{} `json:"fotos"`
+	Next  string                   `json:"next,omitempty"`
+}
+
+// pageCursor is a Cursor with the order it was made for, as handed out to
+// clients.
+type pageCursor struct {
+	Sort   SortKey   `json:"s"`
+	Desc   bool      `json:"d,omitempty"`
+	Time   time.Time `json:"t,omitempty"`
+	Path   string    `json:"p,omitempty"`
+	Rating int       `json:"r,omitempty"`
+	Id     int32     `json:"i"`
+}
+
+func encodeCursor(q FotoQuery, c Cursor) string {
+	data, _ := json.Marshal(pageCursor{q.sort(), q.Desc, c.Time, c.Path, c.Rating, c.Id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the position of a cursor, which must have been made
+// for the order of q.
+func decodeCursor(s string, q FotoQuery) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var pc pageCursor
+	if err := json.Unmarshal(data, &pc); err != nil {
+		return nil, err
+	}
+	if pc.Sort != q.sort() || pc.Desc != q.Desc {
+		return nil, fmt.Errorf("cursor is for sort %s", pc.Sort)
+	}
+	return &Cursor{Time: pc.Time, Path: pc.Path, Rating: pc.Rating, Id: pc.Id}, nil
+}
+
+// parseDateBound parses a day such as 2017-05-01 or a capture time in the
+// API format. A day given as end bound includes the whole day.
+func parseDateBound(s string, end bool) (time.Time, error) {
+	if len(s) == len("2006-01-02") {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err == nil && end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, err
+	}
+	return parseTaken(s)
+}
+
+// parseListing reads the query and fields of /api/fotos from its
+// parameters.
+func parseListing(params url.Values) (q FotoQuery, fields []string, err error) {
+	bad := func(message string) (FotoQuery, []string, error) {
+		return q, nil, echo.NewHTTPError(http.StatusBadRequest, message)
+	}
+
+	q.Limit = defaultPageSize
+	if s := params.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return bad(fmt.Sprintf("Parameter limit must be from 1 to %d.", maxPageSize))
+		}
+	}
+
+	if s := params.Get("sort"); s != "" {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.Sort = SortKey(strings.TrimPrefix(s, "-"))
+		if _, ok := sortExprs[q.Sort]; !ok {
+			return bad("Parameter sort must be taken, mtime, path or rating, with - for descending.")
+		}
+	}
+	if s := params.Get("cursor"); s != "" {
+		if q.After, err = decodeCursor(s, q); err != nil {
+			return bad("Invalid parameter cursor for this sort.")
+		}
+	}
+
+	if s := params.Get("from"); s != "" {
+		if q.From, err = parseDateBound(s, false); err != nil {
+			return bad("Parameter from must be a day such as 2017-05-01 or a time such as 2017-05-01T10:20:30+08:00.")
+		}
+	}
+	if s := params.Get("to"); s != "" {
+		if q.To, err = parseDateBound(s, true); err != nil {
+			return bad("Parameter to must be a day such as 2017-05-01 or a time such as 2017-05-01T10:20:30+08:00.")
+		}
+	}
+	if s := params.Get("gps"); s != "" {
+		hasGPS, err := strconv.ParseBool(s)
+		if err != nil {
+			return bad("Parameter gps must be true or false.")
+		}
+		q.HasGPS = &hasGPS
+	}
+	q.Root = params.Get("root")
+	q.Folder = params.Get("folder")
+	q.Model = params.Get("camera")
+	q.Format = params.Get("format")
+
+	fields = defaultFields
+	if s := params.Get("fields"); s == "all" {
+		fields = nil
+	} else if s != "" {
+		fields = []string{"id"}
+		for _, name := range strings.Split(s, ",") {
+			name = strings.TrimSpace(name)
+			if !fotoFields[name] {
+				return bad("Unknown field " + name + " in parameter fields.")
+			}
+			if name != "id" {
+				fields = append(fields, name)
+			}
+		}
+	}
+	return q, fields, nil
+}
+
+// project returns the given fields of foto as JSON object, or all of them
+// for nil fields.
+func project(foto *Foto, fields []string) (map[string]interface{}, error) {
+	data, err := json.Marshal(foto)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return all, nil
+	}
+	picked := make(map[string]interface{}, len(fields))
+	for _, name := range fields {
+		if v, ok := all[name]; ok {
+			picked[name] = v
+		}
+	}
+	return picked, nil
+}
+
+// listFotos returns a page of the fotos matching q. Pages continue after
+// the last foto of the one before by its sort key and id, so fotos added
+// meanwhile neither repeat nor shift fotos from one page to the next.
+func listFotos(store FotoStore, q FotoQuery, fields []string) (FotoPage, error) {
+	limit := q.Limit
+	q.Limit = limit + 1
+	fotos, err := store.Query(q)
+	if err != nil {
+		return FotoPage{}, err
+	}
+
+	page := FotoPage{Fotos: []map[string]interface{}{}}
+	if len(fotos) > limit {
+		fotos = fotos[:limit]
+		page.Next = encodeCursor(q, CursorOf(fotos[limit-1], q.sort()))
+	}
+	for _, foto := range fotos {
+		item, err := project(foto, fields)
+		if err != nil {
+			return FotoPage{}, err
+		}
+		page.Fotos = append(page.Fotos, item)
+	}
+	return page, nil
+}
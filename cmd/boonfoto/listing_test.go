@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// listingStores are the stores the paging tests run against, each empty.
+var listingStores = map[string]func(t *testing.T) FotoStore{
+	"MemStore": func(t *testing.T) FotoStore {
+		return NewMemStore()
+	},
+	"SqlStore": func(t *testing.T) FotoStore {
+		db := newTestDB(t)
+		t.Cleanup(func() { db.Close() })
+		return NewSqlStore(db)
+	},
+}
+
+// listingFoto is the nth foto of the paging tests. Fotos share capture
+// times, modification times and ratings, so the sort keys tie.
+func listingFoto(n int) *Foto {
+	mtime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	foto := &Foto{
+		// Paths are unique, but fotos added later sort among the others.
+		Path:   fmt.Sprintf("/lib/%02d/%02d.jpg", n%5, n),
+		Mtime:  mtime.Add(time.Duration(n%3) * time.Hour),
+		Rating: n % 3,
+	}
+	if n%2 == 0 {
+		foto.TakenAt = fmt.Sprintf("2019-05-0%dT10:00:00+00:00", 1+n%4)
+	}
+	return foto
+}
+
+func TestListFotosPages(t *testing.T) {
+	for name, newStore := range listingStores {
+		for _, sort := range []string{"taken", "-taken", "mtime", "-mtime", "path", "-path", "rating", "-rating"} {
+			t.Run(name+"/"+sort, func(t *testing.T) {
+				s := newStore(t)
+				original := map[int32]bool{}
+				for n := 0; n < 12; n++ {
+					id, err := s.Insert(listingFoto(n))
+					if err != nil {
+						t.Fatal(err)
+					}
+					original[id] = true
+				}
+
+				params := url.Values{"sort": {sort}, "limit": {"3"}, "fields": {"id"}}
+				seen := map[int32]bool{}
+				var paged []int32
+				for n := 12; ; n++ {
+					q, fields, err := parseListing(params)
+					if err != nil {
+						t.Fatal(err)
+					}
+					page, err := listFotos(s, q, fields)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(page.Fotos) > 3 {
+						t.Fatalf("page of %d fotos, want at most 3", len(page.Fotos))
+					}
+					for _, item := range page.Fotos {
+						id := int32(item["id"].(float64))
+						if seen[id] {
+							t.Errorf("foto %d repeated", id)
+						}
+						seen[id] = true
+						paged = append(paged, id)
+					}
+					if page.Next == "" {
+						break
+					}
+					params.Set("cursor", page.Next)
+					// Ingest adds fotos tying with those listed already.
+					if _, err := s.Insert(listingFoto(n)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				for id := range original {
+					if !seen[id] {
+						t.Errorf("foto %d skipped", id)
+					}
+				}
+				// The pages follow the order of all fotos, those added
+				// meanwhile included.
+				q, _, err := parseListing(url.Values{"sort": {sort}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				all, err := s.Query(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				i := 0
+				for _, foto := range all {
+					if i < len(paged) && foto.Id == paged[i] {
+						i++
+					}
+				}
+				if i != len(paged) {
+					t.Errorf("pages %v out of order at %d", paged, i)
+				}
+			})
+		}
+	}
+}
+
+func TestParseListingRejects(t *testing.T) {
+	s := NewMemStore()
+	for n := 0; n < 3; n++ {
+		if _, err := s.Insert(listingFoto(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor := func(sort string) string {
+		q, fields, err := parseListing(url.Values{"sort": {sort}, "limit": {"1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := listFotos(s, q, fields)
+		if err != nil || page.Next == "" {
+			t.Fatalf("first page by %s: %v, %v", sort, page, err)
+		}
+		return page.Next
+	}
+
+	for _, test := range []struct {
+		name   string
+		params url.Values
+	}{
+		{"limit 0", url.Values{"limit": {"0"}}},
+		{"negative limit", url.Values{"limit": {"-1"}}},
+		{"limit too large", url.Values{"limit": {fmt.Sprint(maxPageSize + 1)}}},
+		{"limit not a number", url.Values{"limit": {"ten"}}},
+		{"unknown sort", url.Values{"sort": {"size"}}},
+		{"cursor of another sort", url.Values{"sort": {"mtime"}, "cursor": {cursor("path")}}},
+		{"cursor of the other order", url.Values{"sort": {"-path"}, "cursor": {cursor("path")}}},
+		{"cursor of the default sort", url.Values{"sort": {"rating"}, "cursor": {cursor("")}}},
+		{"cursor not base64", url.Values{"cursor": {"%%%"}}},
+		{"cursor not JSON", url.Values{"cursor": {"bm9wZQ"}}},
+		{"unknown field", url.Values{"fields": {"id,secret"}}},
+	} {
+		if _, _, err := parseListing(test.params); err == nil {
+			t.Errorf("%s: parseListing(%v) accepted", test.name, test.params)
+		}
+	}
+
+	for _, params := range []url.Values{
+		{"limit": {"1"}},
+		{"limit": {fmt.Sprint(maxPageSize)}},
+		{"sort": {"taken"}, "cursor": {cursor("")}},
+		{"sort": {"-path"}, "cursor": {cursor("-path")}},
+	} {
+		if _, _, err := parseListing(params); err != nil {
+			t.Errorf("parseListing(%v): %v", params, err)
+		}
+	}
+}
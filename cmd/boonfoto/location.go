@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"geo"
+)
+
+// The position of a foto on the map is its EXIF position, or else the one
+// derived from a GPX track. fotos_position indexes these expressions.
+const (
+	latitudeExpr  = "COALESCE(latitude, derived_latitude)"
+	longitudeExpr = "COALESCE(longitude, derived_longitude)"
+	altitudeExpr  = "CASE WHEN latitude IS NULL THEN derived_altitude ELSE altitude END"
+)
+
+// LocatedFoto is a foto on the map. Distance is only set by radius search.
+type LocatedFoto struct {
+	Id        int32    `json:"id"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Derived   bool     `json:"derived,omitempty"`
+	Distance  *float64 `json:"distance,omitempty"`
+	Url       string   `json:"url"`
+}
+
+func fotoUrl(id int32) string {
+	return fmt.Sprintf("/api/fotos/%d", id)
+}
+
+// boundsCondition returns the WHERE clause selecting positions in b.
+func boundsCondition(b geo.Bounds) (string, []interface{}) {
+	if b.CrossesAntimeridian() {
+		return latitudeExpr + " BETWEEN ? AND ? AND (" + longitudeExpr + " >= ? OR " + longitudeExpr + " <= ?)",
+			[]interface{}{b.South, b.North, b.West, b.East}
+	}
+	return latitudeExpr + " BETWEEN ? AND ? AND " + longitudeExpr + " BETWEEN ? AND ?",
+		[]interface{}{b.South, b.North, b.West, b.East}
+}
+
+// fotosInBounds returns up to limit present fotos located in b, in
+// timeline order.
+func fotosInBounds(db *sql.DB, b geo.Bounds, limit int) ([]LocatedFoto, error) {
+	cond, args := boundsCondition(b)
+	rows, err := db.Query(`SELECT id, `+latitudeExpr+`, `+longitudeExpr+`, `+altitudeExpr+`, latitude IS NULL FROM fotos
+		WHERE `+cond+` AND status IS NOT 'missing'
+		ORDER BY COALESCE(taken_at, mtime), path LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fotos := []LocatedFoto{}
+	for rows.Next() {
+		var foto LocatedFoto
+		var altitude sql.NullFloat64
+		if err := rows.Scan(&foto.Id, &foto.Latitude, &foto.Longitude, &altitude, &foto.Derived); err != nil {
+			return nil, err
+		}
+		if altitude.Valid {
+			foto.Altitude = &altitude.Float64
+		}
+		foto.Url = fotoUrl(foto.Id)
+		fotos = append(fotos, foto)
+	}
+	return fotos, rows.Err()
+}
+
+// fotosNear returns up to limit present fotos within radius metres of p,
+// nearest first.
+func fotosNear(db *sql.DB, p geo.Point, radius float64, limit int) ([]LocatedFoto, error) {
+	// The box is only a prefilter, so it must not be cut by the limit.
+	candidates, err := fotosInBounds(db, geo.Around(p, radius), -1)
+	if err != nil {
+		return nil, err
+	}
+
+	fotos := []LocatedFoto{}
+	for _, foto := range candidates {
+		d := geo.Distance(p, geo.Point{Lat: foto.Latitude, Lon: foto.Longitude})
+		if d <= radius {
+			foto.Distance = &d
+			fotos = append(fotos, foto)
+		}
+	}
+	sort.SliceStable(fotos, func(i, j int) bool { return *fotos[i].Distance < *fotos[j].Distance })
+	if len(fotos) > limit {
+		fotos = fotos[:limit]
+	}
+	return fotos, nil
+}
+
+// fotoFeatures returns the present fotos located in b as GeoJSON points,
+// clustered for the given zoom level. A cluster links to its earliest
+// foto and carries the number of fotos in it.
+func fotoFeatures(db *sql.DB, b geo.Bounds, zoom int) (geo.FeatureCollection, error) {
+	cond, args := boundsCondition(b)
+	rows, err := db.Query(`SELECT id, `+latitudeExpr+`, `+longitudeExpr+` FROM fotos
+		WHERE `+cond+` AND status IS NOT 'missing'
+		ORDER BY COALESCE(taken_at, mtime), path`, args...)
+	if err != nil {
+		return geo.FeatureCollection{}, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var points []geo.Point
+	for rows.Next() {
+		var id int64
+		var p geo.Point
+		if err := rows.Scan(&id, &p.Lat, &p.Lon); err != nil {
+			return geo.FeatureCollection{}, err
+		}
+		ids = append(ids, id)
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return geo.FeatureCollection{}, err
+	}
+
+	var features []geo.Feature
+	for _, cluster := range geo.ClusterPoints(ids, points, zoom) {
+		first := int32(cluster.Ids[0])
+		properties := map[string]interface{}{"url": fotoUrl(first)}
+		if len(cluster.Ids) > 1 {
+			properties["cluster"] = true
+			properties["count"] = len(cluster.Ids)
+			properties["expansionZoom"] = zoom + 1
+		}
+		feature := geo.NewPoint(cluster.Center, properties)
+		if len(cluster.Ids) == 1 {
+			feature.Id = first
+		}
+		features = append(features, feature)
+	}
+	return geo.NewFeatureCollection(features), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore is a FotoStore held in memory, for tests and tools that work
+// without a database.
+type MemStore struct {
+	mu     sync.RWMutex
+	fotos  map[int32]Foto
+	lastId int32
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{fotos: map[int32]Foto{}}
+}
+
+// copyFoto returns a copy of foto that shares nothing with it.
+func copyFoto(foto Foto) *Foto {
+	c := foto
+	c.Keywords = append([]string(nil), foto.Keywords...)
+	copyFloat := func(f *float64) *float64 {
+		if f == nil {
+			return nil
+		}
+		v := *f
+		return &v
+	}
+	c.Latitude, c.Longitude, c.Altitude = copyFloat(foto.Latitude), copyFloat(foto.Longitude), copyFloat(foto.Altitude)
+	if foto.DerivedLocation != nil {
+		d := *foto.DerivedLocation
+		d.Altitude = copyFloat(d.Altitude)
+		c.DerivedLocation = &d
+	}
+	return &c
+}
+
+// timelineTime is the time a foto is ordered by: its capture time, or the
+// modification time of its file.
+func timelineTime(foto *Foto) time.Time {
+	if foto.TakenAt != "" {
+		if t, _, err := parseTakenOffset(foto.TakenAt); err == nil {
+			return t
+		}
+	}
+	return foto.Mtime
+}
+
+// query returns the fotos matching q in its sort order.
+func (s *MemStore) query(q FotoQuery) []*Foto {
+	var fotos []*Foto
+	for _, foto := range s.fotos {
+		if q.matches(&foto) {
+			fotos = append(fotos, copyFoto(foto))
+		}
+	}
+	key := q.sort()
+	sort.Slice(fotos, func(i, j int) bool {
+		return q.before(CursorOf(fotos[i], key), CursorOf(fotos[j], key))
+	})
+	if q.Limit > 0 && len(fotos) > q.Limit {
+		fotos = fotos[:q.Limit]
+	}
+	return fotos
+}
+
+// before reports whether a comes before b in the sort order of q.
+func (q FotoQuery) before(a Cursor, b Cursor) bool {
+	if q.Desc {
+		a, b = b, a
+	}
+	var less, equal bool
+	switch q.sort() {
+	case SortPath:
+		less, equal = a.Path < b.Path, a.Path == b.Path
+	case SortRating:
+		less, equal = a.Rating < b.Rating, a.Rating == b.Rating
+	default:
+		less, equal = a.Time.Before(b.Time), a.Time.Equal(b.Time)
+	}
+	if equal {
+		return a.Id < b.Id
+	}
+	return less
+}
+
+func (q FotoQuery) matches(foto *Foto) bool {
+	if foto.Status == "missing" {
+		return false
+	}
+	if len(q.Ids) > 0 {
+		found := false
+		for _, id := range q.Ids {
+			found = found || id == foto.Id
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Root != "" && foto.Root != q.Root {
+		return false
+	}
+	if q.Folder != "" && !strings.HasPrefix(foto.Path, filepath.Clean(q.Folder)+string(filepath.Separator)) {
+		return false
+	}
+	if (q.Model != "" && foto.Model != q.Model) || (q.Format != "" && foto.Format != q.Format) {
+		return false
+	}
+	t := timelineTime(foto)
+	if (!q.From.IsZero() && t.Before(q.From)) || (!q.To.IsZero() && !t.Before(q.To)) {
+		return false
+	}
+	if q.HasGPS != nil {
+		located := (foto.Latitude != nil && foto.Longitude != nil) || foto.DerivedLocation != nil
+		if located != *q.HasGPS {
+			return false
+		}
+	}
+	return q.After == nil || q.before(*q.After, CursorOf(foto, q.sort()))
+}
+
+func (s *MemStore) Get(id int32) (*Foto, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	foto, ok := s.fotos[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyFoto(foto), nil
+}
+
+func (s *MemStore) List() ([]int32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fotos := make([]*Foto, 0, len(s.fotos))
+	for _, foto := range s.fotos {
+		if foto.Status != "missing" {
+			fotos = append(fotos, copyFoto(foto))
+		}
+	}
+	sort.Slice(fotos, func(i, j int) bool {
+		ti, tj := timelineTime(fotos[i]), timelineTime(fotos[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return fotos[i].Path < fotos[j].Path
+	})
+	ids := make([]int32, len(fotos))
+	for i, foto := range fotos {
+		ids[i] = foto.Id
+	}
+	return ids, nil
+}
+
+func (s *MemStore) Query(q FotoQuery) ([]*Foto, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fotos := s.query(q)
+	if fotos == nil {
+		fotos = []*Foto{}
+	}
+	return fotos, nil
+}
+
+// check validates foto like SqlStore does, and reports ErrExists when
+// another foto has its path.
+func (s *MemStore) check(foto *Foto) error {
+	if _, err := fotoValues(foto); err != nil {
+		return err
+	}
+	for id, other := range s.fotos {
+		if id != foto.Id && other.Path == foto.Path {
+			return ErrExists
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Insert(foto *Foto) (int32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := copyFoto(*foto)
+	c.Id = 0
+	if err := s.check(c); err != nil {
+		return 0, err
+	}
+	s.lastId++
+	c.Id = s.lastId
+	s.fotos[c.Id] = *c
+	return c.Id, nil
+}
+
+func (s *MemStore) Update(foto *Foto) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.fotos[foto.Id]; !ok {
+		return ErrNotFound
+	}
+	if err := s.check(foto); err != nil {
+		return err
+	}
+	s.fotos[foto.Id] = *copyFoto(*foto)
+	return nil
+}
+
+func (s *MemStore) Delete(id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.fotos[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.fotos, id)
+	return nil
+}
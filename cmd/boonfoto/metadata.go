@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"exif"
+	"filescanner"
+)
+
+// takenLayout formats capture times in the API. Times without a recorded
+// UTC offset are given without a zone.
+const (
+	takenLayout       = "2006-01-02T15:04:05"
+	takenOffsetLayout = "2006-01-02T15:04:05-07:00"
+)
+
+// metadataColumns lists the fotos columns filled from EXIF data, in the
+// order of the values returned by fotoMetadata.args.
+const metadataColumns = "taken_at = CASE WHEN taken_at_original IS NULL THEN ? ELSE taken_at END, " +
+	"taken_offset = CASE WHEN taken_at_original IS NULL THEN ? ELSE taken_offset END, make = ?, model = ?, lens = ?, focal_length = ?, aperture = ?, " +
+	"exposure_time = ?, iso = ?, width = ?, height = ?, orientation = ?, metadata_at = ?, " +
+	"rotation = CASE WHEN rotation_locked THEN rotation ELSE ? END, latitude = ?, longitude = ?, altitude = ?"
+
+func hasExif(format *filescanner.Format) bool {
+	return format.Kind == filescanner.KindImage || format.Kind == filescanner.KindRaw
+}
+
+// fotoMetadata is the capture metadata read from a file. Zero values stand
+// for what the file does not record. TakenAt is in UTC, and TakenOffset
+// is the recorded UTC offset of the capture time, if any.
+type fotoMetadata struct {
+	TakenAt      time.Time
+	TakenOffset  string
+	Make         string
+	Model        string
+	Lens         string
+	FocalLength  float64
+	Aperture     float64
+	ExposureTime float64
+	Iso          int
+	Width        int
+	Height       int
+	Orientation  int
+	ReadAt       time.Time
+	Location     *exif.Location
+}
+
+// args returns the values for metadataColumns. Metadata the file does not
+// record becomes NULL, but metadata_at is always set so that the file is
+// not read again until it changes. The orientation also becomes the
+// rotation unless the user overrode it.
+func (m *fotoMetadata) args() []interface{} {
+	var takenAt, orientation, latitude, longitude, altitude interface{}
+	if !m.TakenAt.IsZero() {
+		takenAt = m.TakenAt
+	}
+	if m.Orientation != 0 {
+		orientation = m.Orientation
+	}
+	if m.Location != nil {
+		latitude, longitude = m.Location.Latitude, m.Location.Longitude
+		if m.Location.HasAltitude {
+			altitude = m.Location.Altitude
+		}
+	}
+	return []interface{}{takenAt, nullString(m.TakenOffset), nullString(m.Make), nullString(m.Model), nullString(m.Lens),
+		nullFloat(m.FocalLength), nullFloat(m.Aperture), nullFloat(m.ExposureTime), nullInt(m.Iso), nullInt(m.Width), nullInt(m.Height),
+		orientation, m.ReadAt, orientation, latitude, longitude, altitude}
+}
+
+// readMetadata returns the capture metadata of a file. Files without EXIF
+// data get none but the time they were read at.
+//
+// taken_at is stored in UTC so that it sorts together with mtime. A capture
+// time without a recorded offset is taken to be in the server's zone.
+func readMetadata(f filescanner.File) *fotoMetadata {
+	m := &fotoMetadata{ReadAt: time.Now().UTC()}
+	if !hasExif(f.Format) {
+		return m
+	}
+
+	x, err := exif.DecodeFile(f.Path)
+	if err != nil {
+		if err != exif.ErrNoExif {
+			log.Println("Failed to read EXIF data of ", f.Path, ": ", err)
+		}
+		return m
+	}
+
+	if t, hasOffset, ok := x.DateTimeOriginal(); ok {
+		if hasOffset {
+			m.TakenOffset = t.Format("-07:00")
+		} else {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+		}
+		m.TakenAt = t.UTC()
+	}
+	m.Make = x.Make()
+	m.Model = x.Model()
+	m.Lens = x.LensModel()
+	m.FocalLength = x.FocalLength()
+	m.Aperture = x.FNumber()
+	m.ExposureTime = x.ExposureTime()
+	m.Iso = x.ISO()
+	m.Width, m.Height = x.Dimensions()
+	m.Orientation = x.Orientation()
+	if loc, ok := x.Location(); ok {
+		m.Location = &loc
+	}
+	return m
+}
+
+// queueMetadata reads the metadata and annotations of f and queues them for
+// the row at its path, which may be inserted earlier in the same batch.
+func (sp *SqlPopulator) queueMetadata(f filescanner.File) error {
+	m := readMetadata(f)
+	if err := sp.queue("UPDATE fotos SET "+metadataColumns+" WHERE path = ?", append(m.args(), f.Path)...); err != nil {
+		return err
+	}
+	if err := sp.queueAnnotations(f); err != nil {
+		return err
+	}
+	return sp.queuePlace(f.Path, m.Location)
+}
+
+// formatTaken formats a capture time read from the fotos table for the
+// API, in its recorded offset or else in the server's zone.
+func formatTaken(t time.Time, offset string) string {
+	if zone, ok := exif.ParseOffset(offset); ok {
+		return t.In(zone).Format(takenOffsetLayout)
+	}
+	return t.In(time.Local).Format(takenLayout)
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullFloat(f float64) interface{} {
+	if f == 0 {
+		return nil
+	}
+	return f
+}
+
+func nullInt(i int) interface{} {
+	if i == 0 {
+		return nil
+	}
+	return i
+}
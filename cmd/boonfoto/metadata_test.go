@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filescanner"
+)
+
+func TestMetadataArgs(t *testing.T) {
+	placeholders := strings.Count(metadataColumns, "?")
+	for _, m := range []*fotoMetadata{{}, {Orientation: 6, TakenAt: time.Now()}} {
+		if args := m.args(); len(args) != placeholders {
+			t.Errorf("%d args for %d placeholders", len(args), placeholders)
+		}
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.jpg")
+	taken := time.Date(2017, 5, 1, 10, 20, 30, 0, time.FixedZone("", -3*3600))
+	writeTestJPEG(t, path, taken)
+
+	format, err := filescanner.Detect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := readMetadata(filescanner.File{Path: path, Format: format})
+	if !m.TakenAt.Equal(taken) || m.TakenAt.Location() != time.UTC || m.TakenOffset != "-03:00" {
+		t.Errorf("taken at %v %q, want %v", m.TakenAt, m.TakenOffset, taken)
+	}
+	if m.Orientation != 1 || m.Location != nil || m.ReadAt.IsZero() {
+		t.Errorf("metadata %+v", m)
+	}
+	args := m.args()
+	if args[0] != m.TakenAt || args[1] != "-03:00" || args[2] != nil || args[11] != 1 || args[12] != m.ReadAt || args[13] != 1 || args[14] != nil {
+		t.Errorf("args %v", args)
+	}
+
+	// Files without EXIF data are only marked read.
+	m = readMetadata(filescanner.File{Path: filepath.Join(dir, "a.mov"), Format: &filescanner.Format{Kind: filescanner.KindVideo}})
+	for i, arg := range m.args() {
+		if arg != nil && i != 12 {
+			t.Errorf("arg %d of a video is %v, want NULL", i, arg)
+		}
+	}
+}
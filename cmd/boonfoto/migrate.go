@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations bring the database schema up to date, in order. Append new
+// ones with the next version and never change one that was released. A
+// migration adding a column the scanner fills can set metadata_at = NULL:
+// the next scan reads the metadata of every foto again, but does not index
+// them anew.
+var migrations = []migration{
+	{1, "baseline schema", migrateBaseline},
+	{2, "file write journal", migrateFileWrites},
+	{3, "listing indexes", migrateListingIndexes},
+	{4, "job queue", migrateJobs},
+}
+
+// MigrationStatus is a migration and when it was applied, if it was.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt NullTime
+}
+
+func createSchemaVersion(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, applied_at DATETIME NOT NULL)")
+	return err
+}
+
+// hasSchemaVersion reports whether the database has the schema_version
+// table, without creating it.
+func hasSchemaVersion(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&count)
+	return count > 0, err
+}
+
+// schemaVersion returns the version of the last migration applied.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// migrationStatus lists the known migrations, and those the database has
+// from a newer boonfoto. It only reads the database, so a database
+// without schema_version has every migration pending.
+func migrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	exists, err := hasSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]MigrationStatus{}
+	if exists {
+		rows, err := db.Query("SELECT version, name, applied_at FROM schema_version ORDER BY version")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s MigrationStatus
+			if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+				return nil, err
+			}
+			applied[s.Version] = s
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var status []MigrationStatus
+	for _, m := range migrations {
+		s := applied[m.version]
+		s.Version, s.Name = m.version, m.name
+		status = append(status, s)
+		delete(applied, m.version)
+	}
+	var newer []MigrationStatus
+	for _, s := range applied {
+		newer = append(newer, s)
+	}
+	sort.Slice(newer, func(i, j int) bool { return newer[i].Version < newer[j].Version })
+	return append(status, newer...), nil
+}
+
+// hasTables reports whether the database has any table other than
+// schema_version, that is, whether there is anything to back up.
+func hasTables(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'").Scan(&count)
+	return count > 0, err
+}
+
+// databaseFile returns the file of a database name as given to the sqlite3
+// driver, or "" for an in-memory database.
+func databaseFile(name string) string {
+	name = strings.TrimPrefix(name, "file:")
+	if i := strings.Index(name, "?"); i >= 0 {
+		if strings.Contains(name[i:], "mode=memory") {
+			return ""
+		}
+		name = name[:i]
+	}
+	if name == "" || name == ":memory:" {
+		return ""
+	}
+	return name
+}
+
+// backupDatabase copies the database file next to it, named after the
+// schema version it has, and returns the copy's path. It is called while
+// no transaction is open, so the file is consistent. The copy is streamed
+// into a temporary file and synced before it gets its name, so that a
+// backup that exists is complete.
+func backupDatabase(path string, version int) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	backup := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102-150405"))
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(backup)+".")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), backup); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return backup, nil
+}
+
+// migrate applies the pending migrations, each in a transaction together
+// with its schema_version row, after backing up the database file, and
+// returns how many there were. With dryRun it only lists them.
+func migrate(db *sql.DB, database string, w io.Writer, dryRun bool) (int, error) {
+	if err := createSchemaVersion(db); err != nil {
+		return 0, err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return 0, fmt.Errorf("database schema version %d is newer than this boonfoto knows (%d)", version, latest)
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	if dryRun {
+		for _, m := range pending {
+			fmt.Fprintf(w, "Would apply migration %d (%s).\n", m.version, m.name)
+		}
+		return len(pending), nil
+	}
+
+	if path := databaseFile(database); path != "" {
+		existing, err := hasTables(db)
+		if err != nil {
+			return 0, err
+		}
+		if existing {
+			backup, err := backupDatabase(path, version)
+			if err != nil {
+				return 0, fmt.Errorf("back up database: %v", err)
+			}
+			fmt.Fprintf(w, "Backed up the database to %s.\n", backup)
+		}
+	}
+
+	for _, m := range pending {
+		if err := applyMigration(db, m); err != nil {
+			return 0, fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		fmt.Fprintf(w, "Applied migration %d (%s).\n", m.version, m.name)
+	}
+	return len(pending), nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := m.up(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrate implements the migrate command.
+func runMigrate(db *sql.DB, database string, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "List the migrations and whether they are applied.")
+	dryRun := flags.Bool("dry-run", false, "List the pending migrations without applying them.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] migrate [-status] [-dry-run]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *status {
+		list, err := migrationStatus(db)
+		if err != nil {
+			return err
+		}
+		version := 0
+		for _, s := range list {
+			if s.AppliedAt.Valid && s.Version > version {
+				version = s.Version
+			}
+		}
+		fmt.Fprintf(w, "Schema version %d of %d.\n", version, migrations[len(migrations)-1].version)
+		for _, s := range list {
+			state := "pending"
+			if s.AppliedAt.Valid {
+				state = "applied " + s.AppliedAt.Time.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%4d  %-24s %s\n", s.Version, s.Name, state)
+		}
+		return nil
+	}
+
+	n, err := migrate(db, database, w, *dryRun)
+	if err != nil {
+		return err
+	}
+	if n == 0 || !*dryRun {
+		version, err := schemaVersion(db)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Schema version %d is up to date.\n", version)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openTestFile opens a database file in a new directory, which the
+// returned function removes.
+func openTestFile(t *testing.T) (*sql.DB, string, func()) {
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "fotos.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db, path, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func backups(t *testing.T, path string) []string {
+	found, err := filepath.Glob(path + ".v*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func latestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func TestMigrateFresh(t *testing.T) {
+	db, path, cleanup := openTestFile(t)
+	defer cleanup()
+
+	var out bytes.Buffer
+	n, err := migrate(db, path, &out, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) {
+		t.Errorf("%d migrations applied, want %d", n, len(migrations))
+	}
+	if version, err := schemaVersion(db); err != nil || version != latestVersion() {
+		t.Errorf("schema version %d (%v), want %d", version, err, latestVersion())
+	}
+	// An empty database has nothing to back up.
+	if found := backups(t, path); len(found) != 0 || strings.Contains(out.String(), "Backed up") {
+		t.Errorf("backups %q of a new database", found)
+	}
+
+	n, err = migrate(db, path, &out, false)
+	if err != nil || n != 0 {
+		t.Errorf("second migrate: %d, %v, want nothing to do", n, err)
+	}
+	list, err := migrationStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range list {
+		if !s.AppliedAt.Valid {
+			t.Errorf("migration %d (%s) not applied", s.Version, s.Name)
+		}
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db, path, cleanup := openTestFile(t)
+	defer cleanup()
+
+	// The schema of a release from before schema versions, with one foto
+	// whose metadata was read.
+	for _, query := range []string{
+		"CREATE TABLE fotos (id INTEGER NOT NULL PRIMARY KEY, path TEXT NOT NULL, mtime DATETIME, rotation INTEGER, format TEXT, size INTEGER, hash TEXT, status TEXT, metadata_at DATETIME)",
+		"CREATE UNIQUE INDEX fotos_path ON fotos (path)",
+		"CREATE INDEX foto_keywords_keyword ON fotos (path)",
+		"INSERT INTO fotos (path, mtime, rotation, format, size, hash, metadata_at) VALUES ('/fotos/a.jpg', '2017-05-01 10:20:30', 90, 'jpeg', 10, 'abc', '2017-05-02 10:20:30')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if _, err := migrate(db, path, &out, false); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := schemaVersion(db); err != nil || version != latestVersion() {
+		t.Errorf("schema version %d (%v), want %d", version, err, latestVersion())
+	}
+
+	found := backups(t, path)
+	if len(found) != 1 || !strings.HasPrefix(filepath.Base(found[0]), "fotos.db.v0-") || !strings.HasSuffix(found[0], ".bak") {
+		t.Fatalf("backups %q, want one of version 0", found)
+	}
+	if !strings.Contains(out.String(), "Backed up the database to "+found[0]) {
+		t.Errorf("output %q does not name the backup", out.String())
+	}
+	// The backup is the database as it was, at schema version 0.
+	backup, err := sql.Open("sqlite3", found[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if version, err := schemaVersion(backup); err != nil || version != 0 {
+		t.Errorf("backup schema version %d (%v), want 0", version, err)
+	}
+	if n, err := Count(backup, "SELECT COUNT(*) FROM fotos WHERE path = '/fotos/a.jpg' AND metadata_at IS NOT NULL"); err != nil || n != 1 {
+		t.Errorf("backup has %d of the fotos (%v), want 1", n, err)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.bak.*")); len(leftover) != 0 {
+		t.Errorf("temporary files %q left behind", leftover)
+	}
+
+	// The foto keeps what it had, and its metadata is read again for the
+	// added columns.
+	var rotation int
+	var hash string
+	var metadataAt NullTime
+	if err := db.QueryRow("SELECT rotation, hash, metadata_at FROM fotos WHERE path = '/fotos/a.jpg'").Scan(&rotation, &hash, &metadataAt); err != nil {
+		t.Fatal(err)
+	}
+	if rotation != 90 || hash != "abc" || metadataAt.Valid {
+		t.Errorf("migrated foto rotation %d, hash %q, metadata_at %v", rotation, hash, metadataAt)
+	}
+	var dropped int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'foto_keywords_keyword'").Scan(&dropped); err != nil || dropped != 0 {
+		t.Errorf("replaced index still there (%v)", err)
+	}
+	if _, err := db.Exec("INSERT INTO foto_keywords (foto_id, keyword) VALUES (1, 'cat')"); err != nil {
+		t.Errorf("foto_keywords: %v", err)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	db, path, cleanup := openTestFile(t)
+	defer cleanup()
+	if _, err := migrate(db, path, ioutil.Discard, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'from the future', CURRENT_TIMESTAMP)", latestVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrate(db, path, ioutil.Discard, false); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("migrate of a newer database: %v, want it refused", err)
+	}
+	list, err := migrationStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := list[len(list)-1]; last.Version != latestVersion()+1 || last.Name != "from the future" || !last.AppliedAt.Valid {
+		t.Errorf("last migration %+v, want the newer one", last)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db, path, cleanup := openTestFile(t)
+	defer cleanup()
+	if _, err := db.Exec("CREATE TABLE fotos (id INTEGER NOT NULL PRIMARY KEY, path TEXT NOT NULL, mtime DATETIME, rotation INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	n, err := migrate(db, path, &out, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) {
+		t.Errorf("%d migrations pending, want %d", n, len(migrations))
+	}
+	for _, m := range migrations {
+		if !strings.Contains(out.String(), m.name) {
+			t.Errorf("output %q does not list migration %d (%s)", out.String(), m.version, m.name)
+		}
+	}
+	if version, err := schemaVersion(db); err != nil || version != 0 {
+		t.Errorf("schema version %d (%v) after a dry run, want 0", version, err)
+	}
+	if found := backups(t, path); len(found) != 0 {
+		t.Errorf("backups %q after a dry run", found)
+	}
+	if added, err := hasColumn(db, "fotos", "hash"); err != nil || added {
+		t.Errorf("dry run added columns (%v)", err)
+	}
+}
+
+func hasColumn(db *sql.DB, table string, column string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+func TestMigrateStatusReadsOnly(t *testing.T) {
+	db, path, cleanup := openTestFile(t)
+	defer cleanup()
+	if _, err := db.Exec("CREATE TABLE fotos (id INTEGER NOT NULL PRIMARY KEY, path TEXT NOT NULL, mtime DATETIME, rotation INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runMigrate(db, path, []string{"-status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := hasSchemaVersion(db); err != nil || exists {
+		t.Errorf("migrate -status created schema_version (%v)", err)
+	}
+	if !strings.HasPrefix(out.String(), "Schema version 0 of ") || strings.Count(out.String(), "pending") != len(migrations) {
+		t.Errorf("migrate -status of a baseline database:\n%s", out.String())
+	}
+
+	if _, err := migrate(db, path, ioutil.Discard, false); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runMigrate(db, path, []string{"-status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), fmt.Sprintf("Schema version %d of %d.", latestVersion(), latestVersion())) ||
+		strings.Contains(out.String(), "pending") {
+		t.Errorf("migrate -status of a migrated database:\n%s", out.String())
+	}
+}
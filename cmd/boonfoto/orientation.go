@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/rainycape/magick"
+)
+
+// An orientation is an EXIF Orientation code from 1 to 8. The rotation
+// column holds the effective orientation of a foto: the one read from the
+// file, unless rotation_locked is set by a user override.
+//
+// Each code is the transform that shows the image upright: a clockwise
+// rotation by quarter turns followed by an optional horizontal mirror.
+var orientationTransforms = [9]struct {
+	turns  int
+	mirror bool
+}{
+	1: {0, false},
+	2: {0, true},
+	3: {2, false},
+	4: {2, true},
+	5: {1, true},
+	6: {1, false},
+	7: {3, true},
+	8: {3, false},
+}
+
+func validOrientation(o int) bool {
+	return o >= 1 && o <= 8
+}
+
+// rotateOrientation returns the orientation that turns the image a further
+// degrees clockwise, which must be a multiple of 90.
+func rotateOrientation(o int, degrees int) int {
+	t := orientationTransforms[o]
+	turns := degrees / 90
+	if t.mirror {
+		// Turning after the mirror is turning the other way before it.
+		turns = -turns
+	}
+	turns = ((t.turns+turns)%4 + 4) % 4
+	for code := 1; code <= 8; code++ {
+		if orientationTransforms[code].turns == turns && orientationTransforms[code].mirror == t.mirror {
+			return code
+		}
+	}
+	return o
+}
+
+// orient returns im transformed to show upright for orientation o. It
+// returns im itself for orientation 1 and a new image otherwise, which the
+// caller must dispose of as well.
+func orient(im *magick.Image, o int) (*magick.Image, error) {
+	if !validOrientation(o) || o == 1 {
+		return im, nil
+	}
+	t := orientationTransforms[o]
+
+	out := im
+	replace := func(next *magick.Image, err error) error {
+		if err != nil {
+			return err
+		}
+		if out != im {
+			out.Dispose()
+		}
+		out = next
+		return nil
+	}
+
+	var err error
+	switch t.turns {
+	case 1:
+		// magick has no plain rotation; an affine transform by a quarter
+		// turn is exact and is translated back into the canvas.
+		err = replace(out.AffineTransform(&magick.AffineMatrix{Sx: 0, Rx: 1, Ry: -1, Sy: 0}))
+	case 2:
+		if err = replace(out.Flip()); err == nil {
+			err = replace(out.Flop())
+		}
+	case 3:
+		err = replace(out.AffineTransform(&magick.AffineMatrix{Sx: 0, Rx: -1, Ry: 1, Sy: 0}))
+	}
+	if err == nil && t.mirror {
+		err = replace(out.Flop())
+	}
+	if err != nil {
+		if out != im {
+			out.Dispose()
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// loadOrientation returns the effective orientation of foto id, ok being
+// false when there is no such foto.
+func loadOrientation(db *sql.DB, id int32) (o int, ok bool, err error) {
+	err = db.QueryRow("SELECT COALESCE(rotation, orientation, 1) FROM fotos WHERE id = ?", id).Scan(&o)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if !validOrientation(o) {
+		o = 1
+	}
+	return o, true, nil
+}
+
+// setOrientation overrides the orientation of foto id; rescans leave it
+// alone from then on. An orientation of 0 drops the override and goes back
+// to the one read from the file.
+func setOrientation(db *sql.DB, id int32, o int) (bool, error) {
+	var res sql.Result
+	var err error
+	if o == 0 {
+		res, err = db.Exec("UPDATE fotos SET rotation = orientation, rotation_locked = NULL WHERE id = ?", id)
+	} else {
+		res, err = db.Exec("UPDATE fotos SET rotation = ?, rotation_locked = 1 WHERE id = ?", o, id)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
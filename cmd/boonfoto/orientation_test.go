@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+// matrix is a 2×2 transform of image coordinates, y pointing down.
+type matrix [2][2]int
+
+func (a matrix) mul(b matrix) matrix {
+	var c matrix
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 2; j++ {
+			c[i][j] = a[i][0]*b[0][j] + a[i][1]*b[1][j]
+		}
+	}
+	return c
+}
+
+var (
+	identity  = matrix{{1, 0}, {0, 1}}
+	clockwise = matrix{{0, -1}, {1, 0}}
+	mirror    = matrix{{-1, 0}, {0, 1}}
+)
+
+func turn(turns int) matrix {
+	m := identity
+	for i := 0; i < (turns%4+4)%4; i++ {
+		m = clockwise.mul(m)
+	}
+	return m
+}
+
+// transform is the matrix of orientation o: its turns, then its mirror.
+func transform(o int) matrix {
+	t := orientationTransforms[o]
+	m := turn(t.turns)
+	if t.mirror {
+		m = mirror.mul(m)
+	}
+	return m
+}
+
+func TestRotateOrientation(t *testing.T) {
+	// The codes each orientation becomes turned by 90°, -90° and 180°.
+	want := map[int][3]int{
+		1: {6, 8, 3},
+		2: {7, 5, 4},
+		3: {8, 6, 1},
+		4: {5, 7, 2},
+		5: {2, 4, 7},
+		6: {3, 1, 8},
+		7: {4, 2, 5},
+		8: {1, 3, 6},
+	}
+	for o := 1; o <= 8; o++ {
+		for i, degrees := range []int{90, -90, 180} {
+			got := rotateOrientation(o, degrees)
+			if got != want[o][i] {
+				t.Errorf("rotateOrientation(%d, %d) = %d, want %d", o, degrees, got, want[o][i])
+			}
+			// Turning the upright image is turning after the transform.
+			if transform(got) != turn(degrees/90).mul(transform(o)) {
+				t.Errorf("orientation %d turned by %d: transform of %d does not match", o, degrees, got)
+			}
+		}
+		if got := rotateOrientation(o, 360); got != o {
+			t.Errorf("rotateOrientation(%d, 360) = %d", o, got)
+		}
+		if got := rotateOrientation(rotateOrientation(o, 90), -90); got != o {
+			t.Errorf("orientation %d turned by 90 and back = %d", o, got)
+		}
+	}
+
+	// EXIF defines 5 as the transpose and 7 as the transverse.
+	if transform(5) != (matrix{{0, 1}, {1, 0}}) || transform(7) != (matrix{{0, -1}, {-1, 0}}) {
+		t.Errorf("transforms of 5 and 7 = %v and %v", transform(5), transform(7))
+	}
+	// The eight codes are the eight distinct transforms.
+	seen := map[matrix]int{}
+	for o := 1; o <= 8; o++ {
+		if other, ok := seen[transform(o)]; ok {
+			t.Errorf("orientations %d and %d have the same transform", other, o)
+		}
+		seen[transform(o)] = o
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// originalTypes are the content types of the formats the scanner knows
+// that the mime package may not.
+var originalTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"heic": "image/heic",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+	"cr2":  "image/x-canon-cr2",
+	"cr3":  "image/x-canon-cr3",
+	"orf":  "image/x-olympus-orf",
+	"rw2":  "image/x-panasonic-rw2",
+	"raf":  "image/x-fuji-raf",
+	"dng":  "image/x-adobe-dng",
+	"nef":  "image/x-nikon-nef",
+	"arw":  "image/x-sony-arw",
+	"pef":  "image/x-pentax-pef",
+	"srw":  "image/x-samsung-srw",
+	"mov":  "video/quicktime",
+	"3gp":  "video/3gpp",
+	"mp4":  "video/mp4",
+	"avi":  "video/x-msvideo",
+	"mkv":  "video/x-matroska",
+	"mts":  "video/mp2t",
+}
+
+// errOutsideRoot is a foto whose file does not lie inside the configured
+// root it was indexed under, which only a tampered or stale row has.
+var errOutsideRoot = fmt.Errorf("file is outside its library root")
+
+// original is the file of a foto as indexed.
+type original struct {
+	Path   string
+	Root   string
+	Format string
+	Size   int64
+	Mtime  time.Time
+	Hash   string
+}
+
+func (o original) contentType() string {
+	if t, ok := originalTypes[o.Format]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(filepath.Ext(o.Path)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// resolveInRoot returns path with symlinks resolved, or errOutsideRoot
+// unless it lies inside the root of roots named root, resolved likewise.
+// Rows indexed before roots existed have none; their file may lie inside
+// any root.
+func resolveInRoot(path string, root string, roots []RootConfig) (string, error) {
+	resolved, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err = filepath.EvalSymlinks(resolved); err != nil {
+		return "", err
+	}
+	for _, r := range roots {
+		if root != "" && r.Name != root {
+			continue
+		}
+		rootPath, err := filepath.Abs(r.Path)
+		if err != nil {
+			continue
+		}
+		if rootPath, err = filepath.EvalSymlinks(rootPath); err != nil {
+			continue
+		}
+		if under(resolved, rootPath) {
+			return resolved, nil
+		}
+	}
+	return "", errOutsideRoot
+}
+
+// openOriginal opens the file of foto id. The file is opened at its path
+// with symlinks resolved, which must lie inside the foto's root.
+func openOriginal(db *sql.DB, roots []RootConfig, id int32) (*os.File, original, error) {
+	var o original
+	err := db.QueryRow("SELECT path, COALESCE(root, ''), COALESCE(format, ''), COALESCE(size, -1), mtime, COALESCE(hash, '') FROM fotos WHERE id = ? AND status IS NOT ?",
+		id, statusMissing).Scan(&o.Path, &o.Root, &o.Format, &o.Size, &o.Mtime, &o.Hash)
+	if err != nil {
+		return nil, o, storeError(err)
+	}
+	resolved, err := resolveInRoot(o.Path, o.Root, roots)
+	if err != nil {
+		return nil, o, err
+	}
+	f, err := os.Open(resolved)
+	return f, o, err
+}
+
+// serveOriginal streams the file of foto id. Ranges and conditional
+// requests are answered by http.ServeContent, with the content hash as
+// ETag as long as the file is the one that was hashed.
+func serveOriginal(c echo.Context, db *sql.DB, roots []RootConfig, id int32) error {
+	f, o, err := openOriginal(db, roots, id)
+	if err == errOutsideRoot {
+		log.Println("Refused to serve ", o.Path, " of foto ", id, ": outside root ", o.Root)
+		return echo.NewHTTPError(http.StatusForbidden, "The file of this foto is outside its library root.")
+	}
+	if os.IsNotExist(err) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found.")
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found.")
+	}
+
+	header := c.Response().Header()
+	header.Set("Content-Type", o.contentType())
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(o.Path)}))
+	if o.Hash != "" && info.Size() == o.Size && info.ModTime().Equal(o.Mtime) {
+		header.Set("ETag", `"`+o.Hash+`"`)
+	}
+	http.ServeContent(c.Response(), c.Request(), "", info.ModTime(), f)
+	return nil
+}
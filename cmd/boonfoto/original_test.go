@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// originalTree makes a library root with a file, a folder and symlinks
+// into and out of it, next to a file outside of it, and returns its
+// directory.
+func originalTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"lib/sub", "other"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"lib/a.jpg", "lib/sub/b.jpg", "other/secret.txt", "libby.jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"lib/escape.jpg": "../other/secret.txt",
+		"lib/out":        "../other",
+		"lib/in.jpg":     "sub/b.jpg",
+		"liblink":        "lib",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestResolveInRoot(t *testing.T) {
+	dir := originalTree(t)
+	defer os.RemoveAll(dir)
+	roots := []RootConfig{
+		{Name: "family", Path: filepath.Join(dir, "lib")},
+		{Name: "linked", Path: filepath.Join(dir, "liblink")},
+		{Name: "other", Path: filepath.Join(dir, "other")},
+	}
+
+	for _, test := range []struct {
+		path string
+		root string
+		want string
+	}{
+		{"lib/a.jpg", "family", "lib/a.jpg"},
+		{"lib/sub/b.jpg", "family", "lib/sub/b.jpg"},
+		{"lib/in.jpg", "family", "lib/sub/b.jpg"},
+		{"lib/sub/../a.jpg", "family", "lib/a.jpg"},
+		{"liblink/a.jpg", "family", "lib/a.jpg"},
+		{"lib/a.jpg", "linked", "lib/a.jpg"},
+		{"lib/escape.jpg", "family", ""},
+		{"lib/out/secret.txt", "family", ""},
+		{"lib/../other/secret.txt", "family", ""},
+		{"lib/../libby.jpg", "family", ""},
+		{"other/secret.txt", "family", ""},
+		{"lib/a.jpg", "unknown", ""},
+		// Without a root, any root will do.
+		{"lib/a.jpg", "", "lib/a.jpg"},
+		{"other/secret.txt", "", "other/secret.txt"},
+		{"libby.jpg", "", ""},
+		{"lib/../libby.jpg", "", ""},
+	} {
+		got, err := resolveInRoot(filepath.Join(dir, test.path), test.root, roots)
+		if test.want == "" {
+			if err != errOutsideRoot {
+				t.Errorf("%s in %q: %q, %v, want errOutsideRoot", test.path, test.root, got, err)
+			}
+			continue
+		}
+		if want, _ := filepath.EvalSymlinks(filepath.Join(dir, test.want)); err != nil || got != want {
+			t.Errorf("%s in %q: %q, %v, want %q", test.path, test.root, got, err, want)
+		}
+	}
+
+	if _, err := resolveInRoot(filepath.Join(dir, "lib/gone.jpg"), "family", roots); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v, want not exist", err)
+	}
+}
+
+func TestOpenOriginalWithoutRoot(t *testing.T) {
+	dir := originalTree(t)
+	defer os.RemoveAll(dir)
+	db := newTestDB(t)
+	defer db.Close()
+	roots := []RootConfig{{Name: "family", Path: filepath.Join(dir, "lib")}}
+
+	inside := insertTestFoto(t, db, filepath.Join(dir, "lib/a.jpg"), "")
+	f, _, err := openOriginal(db, roots, inside)
+	if err != nil {
+		t.Fatalf("foto without root inside a root: %v", err)
+	}
+	f.Close()
+
+	for _, path := range []string{"libby.jpg", "lib/escape.jpg", "lib/../other/secret.txt"} {
+		id := insertTestFoto(t, db, filepath.Join(dir, path), "")
+		if f, _, err := openOriginal(db, roots, id); err != errOutsideRoot {
+			if f != nil {
+				f.Close()
+			}
+			t.Errorf("%s without root: %v, want errOutsideRoot", path, err)
+		}
+	}
+
+	if _, _, err := openOriginal(db, roots, 1000); err != ErrNotFound {
+		t.Errorf("unknown foto: %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo"
+	"github.com/rainycape/magick"
+)
+
+// renderFormats are the formats /api/fotos/:id/render writes, with their
+// content types.
+var renderFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+	"avif": "image/avif",
+}
+
+// negotiatedFormats are the formats offered to clients that accept them,
+// smallest first. JPEG is the fallback for the others.
+var negotiatedFormats = []string{"avif", "webp"}
+
+var (
+	encodersOnce sync.Once
+	encoders     map[string]bool
+)
+
+// canEncode reports whether the magick build at hand knows format. JPEG
+// and PNG are taken for granted.
+func canEncode(format string) bool {
+	if format == "jpeg" || format == "png" {
+		return true
+	}
+	encodersOnce.Do(func() {
+		encoders = make(map[string]bool)
+		formats, err := magick.SupportedFormats()
+		if err != nil {
+			log.Println("Failed to list image formats: ", err)
+		}
+		for _, name := range formats {
+			encoders[strings.ToLower(name)] = true
+		}
+	})
+	return encoders[format]
+}
+
+// acceptedFormat returns the format to render for an Accept header: the
+// first of negotiatedFormats the client names with a non-zero quality and
+// magick can write, or else JPEG. Wildcards do not count, as browsers send
+// image/* whatever they can decode.
+func acceptedFormat(accept string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(fields[0]))] = q > 0
+	}
+	for _, format := range negotiatedFormats {
+		if accepted[renderFormats[format]] && canEncode(format) {
+			return format
+		}
+	}
+	return "jpeg"
+}
+
+// negotiateFormat sets the format of spec from the Accept header of the
+// request, and tells caches that the response depends on it.
+func negotiateFormat(c echo.Context, spec *renderSpec) {
+	spec.Format = acceptedFormat(c.Request().Header.Get("Accept"))
+	c.Response().Header().Add("Vary", "Accept")
+}
+
+// renderParams are the parameters of /api/fotos/:id/render besides sig.
+var renderParams = []string{"w", "h", "fit", "format", "q"}
+
+// renderSignature returns the signature of a render URL for foto id with
+// params: the HMAC-SHA256 of the id and the sorted, encoded parameters but
+// sig, in unpadded base64url.
+func renderSignature(secret string, id int32, params url.Values) string {
+	signed := url.Values{}
+	for name, values := range params {
+		if name != "sig" {
+			signed[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d?%s", id, signed.Encode())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validRenderSignature(secret string, id int32, params url.Values) bool {
+	return hmac.Equal([]byte(params.Get("sig")), []byte(renderSignature(secret, id, params)))
+}
+
+// renderURL returns the signed path that renders foto id with params.
+func renderURL(secret string, id int32, params url.Values) string {
+	signed := url.Values{}
+	for name, values := range params {
+		signed[name] = values
+	}
+	signed.Set("sig", renderSignature(secret, id, params))
+	return fmt.Sprintf("/api/fotos/%d/render?%s", id, signed.Encode())
+}
+
+// parseRender reads the spec of /api/fotos/:id/render from its parameters.
+// Without a format, the caller negotiates one. A missing width or height
+// leaves that side bounded by maxSize only, which only the contain fit
+// allows.
+func parseRender(params url.Values, config *Config) (renderSpec, error) {
+	bad := func(message string) (renderSpec, error) {
+		return renderSpec{}, echo.NewHTTPError(http.StatusBadRequest, message)
+	}
+	for name := range params {
+		if name != "sig" && !contains(renderParams, name) {
+			return bad("Unknown parameter " + name + ".")
+		}
+	}
+
+	spec := renderSpec{Fit: fitContain, Format: "jpeg", Quality: config.Thumbs.Quality}
+	size := func(name string) (int, bool) {
+		s := params.Get(name)
+		if s == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n >= 1 && n <= config.Render.MaxSize
+	}
+	var ok bool
+	if spec.Width, ok = size("w"); !ok {
+		return bad(fmt.Sprintf("Parameter w must be from 1 to %d.", config.Render.MaxSize))
+	}
+	if spec.Height, ok = size("h"); !ok {
+		return bad(fmt.Sprintf("Parameter h must be from 1 to %d.", config.Render.MaxSize))
+	}
+	if spec.Width == 0 && spec.Height == 0 {
+		return bad("Parameter w or h is required.")
+	}
+
+	if s := params.Get("fit"); s != "" {
+		spec.Fit = s
+	}
+	switch spec.Fit {
+	case fitContain:
+	case fitCover, fitEntropy:
+		if spec.Width == 0 || spec.Height == 0 {
+			return bad("Parameters w and h are required for fit " + spec.Fit + ".")
+		}
+	default:
+		return bad("Parameter fit must be contain, cover or entropy.")
+	}
+	if spec.Width == 0 {
+		spec.Width = config.Render.MaxSize
+	}
+	if spec.Height == 0 {
+		spec.Height = config.Render.MaxSize
+	}
+
+	if s := params.Get("format"); s != "" {
+		if _, ok := renderFormats[s]; !ok {
+			return bad("Parameter format must be jpeg, png, webp or avif.")
+		}
+		if !canEncode(s) {
+			return bad("Format " + s + " is not supported by this server.")
+		}
+		spec.Format = s
+	}
+	if s := params.Get("q"); s != "" {
+		var err error
+		if spec.Quality, err = strconv.Atoi(s); err != nil || spec.Quality < 1 || spec.Quality > 100 {
+			return bad("Parameter q must be from 1 to 100.")
+		}
+	}
+	return spec, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runRenderURL prints the signed render URL of a foto, for apps and
+// scripts that do not sign URLs themselves.
+func runRenderURL(config *Config, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("render-url", flag.ExitOnError)
+	values := make(map[string]*string)
+	for _, name := range renderParams {
+		values[name] = flags.String(name, "", "Parameter "+name+" of the URL.")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] render-url [-w n] [-h n] [-fit f] [-format f] [-q n] id\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if config.Render.Secret == "" {
+		return fmt.Errorf("render.secret is not set")
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one foto id")
+	}
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid foto id %s", flags.Arg(0))
+	}
+	params := url.Values{}
+	for name, value := range values {
+		if *value != "" {
+			params.Set(name, *value)
+		}
+	}
+	if _, err := parseRender(params, config); err != nil {
+		return fmt.Errorf("%v", err.(*echo.HTTPError).Message)
+	}
+	fmt.Fprintln(w, renderURL(config.Render.Secret, int32(id), params))
+	return nil
+}
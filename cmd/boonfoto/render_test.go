@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRenderSignature(t *testing.T) {
+	const secret = "secret"
+	signed := func(id int32, query string) url.Values {
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.Set("sig", renderSignature(secret, id, params))
+		return params
+	}
+	with := func(params url.Values, name string, value string) url.Values {
+		changed := url.Values{}
+		for n, v := range params {
+			changed[n] = v
+		}
+		if value == "" {
+			changed.Del(name)
+		} else {
+			changed.Set(name, value)
+		}
+		return changed
+	}
+	base := signed(3, "w=300&h=200&fit=cover")
+
+	for _, test := range []struct {
+		name   string
+		secret string
+		id     int32
+		params url.Values
+		valid  bool
+	}{
+		{"valid", secret, 3, base, true},
+		{"parameter order", secret, 3, signed(3, "fit=cover&h=200&w=300"), true},
+		{"tampered width", secret, 3, with(base, "w", "3000"), false},
+		{"tampered fit", secret, 3, with(base, "fit", "contain"), false},
+		{"added parameter", secret, 3, with(base, "q", "100"), false},
+		{"removed parameter", secret, 3, with(base, "h", ""), false},
+		{"repeated parameter", secret, 3, func() url.Values {
+			p := with(base, "w", "300")
+			p.Add("w", "4000")
+			return p
+		}(), false},
+		{"other id", secret, 4, base, false},
+		{"other secret", "guess", 3, base, false},
+		{"missing sig", secret, 3, with(base, "sig", ""), false},
+		{"empty sig", secret, 3, with(base, "sig", " "), false},
+		{"truncated sig", secret, 3, with(base, "sig", base.Get("sig")[:10]), false},
+	} {
+		if got := validRenderSignature(test.secret, test.id, test.params); got != test.valid {
+			t.Errorf("%s: validRenderSignature(%v) = %v, want %v", test.name, test.params, got, test.valid)
+		}
+	}
+
+	// renderURL signs what the endpoint checks.
+	u, err := url.Parse(renderURL(secret, 7, url.Values{"w": {"640"}, "format": {"png"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/api/fotos/7/render" || !validRenderSignature(secret, 7, u.Query()) {
+		t.Errorf("renderURL = %s, not validly signed", u)
+	}
+}
+
+func TestParseRender(t *testing.T) {
+	config := defaultConfig()
+	config.Render.MaxSize = 1000
+	config.Thumbs.Quality = 80
+
+	for _, test := range []struct {
+		query string
+		want  renderSpec
+	}{
+		{"w=300&h=200", renderSpec{Width: 300, Height: 200, Fit: fitContain, Format: "jpeg", Quality: 80}},
+		{"w=1&h=1000&sig=x", renderSpec{Width: 1, Height: 1000, Fit: fitContain, Format: "jpeg", Quality: 80}},
+		{"w=300", renderSpec{Width: 300, Height: 1000, Fit: fitContain, Format: "jpeg", Quality: 80}},
+		{"h=300&fit=contain", renderSpec{Width: 1000, Height: 300, Fit: fitContain, Format: "jpeg", Quality: 80}},
+		{"w=300&h=200&fit=cover&format=png&q=100", renderSpec{Width: 300, Height: 200, Fit: fitCover, Format: "png", Quality: 100}},
+		{"w=300&h=200&fit=entropy&q=1", renderSpec{Width: 300, Height: 200, Fit: fitEntropy, Format: "jpeg", Quality: 1}},
+	} {
+		params, _ := url.ParseQuery(test.query)
+		spec, err := parseRender(params, config)
+		if err != nil || spec != test.want {
+			t.Errorf("parseRender(%s) = %+v, %v, want %+v", test.query, spec, err, test.want)
+		}
+	}
+
+	for _, query := range []string{
+		"",
+		"sig=x",
+		"w=0&h=100",
+		"w=-5",
+		"w=1001",
+		"h=1001",
+		"w=abc",
+		"w=300&h=200&fit=fill",
+		"w=300&fit=cover",
+		"h=300&fit=cover",
+		"w=300&fit=entropy",
+		"w=300&format=gif",
+		"w=300&q=0",
+		"w=300&q=101",
+		"w=300&q=high",
+		"w=300&crop=1",
+	} {
+		params, _ := url.ParseQuery(query)
+		if spec, err := parseRender(params, config); err == nil {
+			t.Errorf("parseRender(%s) = %+v, want an error", query, spec)
+		}
+	}
+}
+
+func TestAcceptedFormat(t *testing.T) {
+	// Lists the formats of the magick build at hand once, so that they
+	// can be replaced below.
+	canEncode("webp")
+	saved := encoders
+	defer func() { encoders = saved }()
+
+	for _, test := range []struct {
+		encoders map[string]bool
+		accept   string
+		want     string
+	}{
+		{nil, "", "jpeg"},
+		{nil, "image/avif,image/webp,*/*", "jpeg"},
+		{map[string]bool{"webp": true}, "image/avif,image/webp,*/*", "webp"},
+		{map[string]bool{"avif": true, "webp": true}, "image/webp,image/avif", "avif"},
+		{map[string]bool{"avif": true, "webp": true}, "image/avif;q=0,image/webp;q=0.8", "webp"},
+		{map[string]bool{"avif": true, "webp": true}, "image/avif;q=0.0, image/webp;q=0", "jpeg"},
+		{map[string]bool{"avif": true, "webp": true}, "image/avif; q=bad", "jpeg"},
+		{map[string]bool{"avif": true, "webp": true}, "image/*", "jpeg"},
+		{map[string]bool{"avif": true, "webp": true}, "*/*", "jpeg"},
+		{map[string]bool{"avif": true, "webp": true}, "image/*;q=1, */*;q=0.8", "jpeg"},
+		{map[string]bool{"avif": true, "webp": true}, "IMAGE/WEBP", "webp"},
+		{map[string]bool{"avif": true, "webp": true}, " Image/AVIF ;q=0.9", "avif"},
+		{map[string]bool{"avif": true, "webp": true}, "image/png,image/jpeg", "jpeg"},
+		{map[string]bool{"webp": true}, "image/avif", "jpeg"},
+	} {
+		encoders = test.encoders
+		if got := acceptedFormat(test.accept); got != test.want {
+			t.Errorf("acceptedFormat(%q) with %v = %s, want %s", test.accept, test.encoders, got, test.want)
+		}
+	}
+}
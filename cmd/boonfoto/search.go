@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// SearchQuery selects fotos by place and annotations. The criteria that
+// are set must all match; text matches ignore case and may be part of a
+// word, except Keyword, which must be a whole keyword.
+type SearchQuery struct {
+	Place     string
+	Q         string
+	Keyword   string
+	Byline    string
+	Copyright string
+}
+
+var errEmptySearch = errors.New("give place, q, keyword, byline or copyright")
+
+const keywordMatch = "EXISTS (SELECT 1 FROM foto_keywords WHERE foto_id = fotos.id AND keyword "
+
+func (s SearchQuery) condition() (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	if s.Place != "" {
+		cond, placeArgs := placeCondition(s.Place)
+		conds = append(conds, cond)
+		args = append(args, placeArgs...)
+	}
+	if s.Q != "" {
+		like := "%" + escapeLike(strings.TrimSpace(s.Q)) + "%"
+		var matches []string
+		for _, column := range []string{"title", "description", "byline", "copyright", "location_city"} {
+			matches = append(matches, column+` LIKE ? ESCAPE '\'`)
+			args = append(args, like)
+		}
+		matches = append(matches, keywordMatch+`LIKE ? ESCAPE '\')`)
+		conds = append(conds, "("+strings.Join(matches, " OR ")+")")
+		args = append(args, like)
+	}
+	if s.Keyword != "" {
+		conds = append(conds, keywordMatch+"= ? COLLATE NOCASE)")
+		args = append(args, strings.TrimSpace(s.Keyword))
+	}
+	if s.Byline != "" {
+		conds = append(conds, `byline LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(strings.TrimSpace(s.Byline))+"%")
+	}
+	if s.Copyright != "" {
+		conds = append(conds, `copyright LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(strings.TrimSpace(s.Copyright))+"%")
+	}
+	if len(conds) == 0 {
+		return "", nil, errEmptySearch
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// searchFotos returns the ids of the present fotos matching s, in timeline
+// order.
+func searchFotos(db *sql.DB, s SearchQuery) ([]int32, error) {
+	cond, args, err := s.condition()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT id FROM fotos WHERE status IS NOT 'missing' AND `+cond+`
+		ORDER BY COALESCE(taken_at, mtime), path`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int32{}
+	for rows.Next() {
+		var id int32
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
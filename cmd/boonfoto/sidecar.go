@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+
+	"filescanner"
+	"xmp"
+)
+
+// MetadataUpdate holds the sidecar fields to change; fields left nil keep
+// their value. A rating of 0 removes it.
+type MetadataUpdate struct {
+	Rating      *int      `json:"rating"`
+	Label       *string   `json:"label"`
+	Keywords    *[]string `json:"keywords"`
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+}
+
+var errInvalidRating = errors.New("rating must be from -1 (rejected) to 5")
+
+func (u MetadataUpdate) apply(m *xmp.Metadata) error {
+	if u.Rating != nil {
+		if *u.Rating < -1 || *u.Rating > 5 {
+			return errInvalidRating
+		}
+		m.Rating = *u.Rating
+	}
+	if u.Label != nil {
+		m.Label = strings.TrimSpace(*u.Label)
+	}
+	if u.Keywords != nil {
+		m.Keywords = nil
+		seen := make(map[string]bool)
+		for _, keyword := range *u.Keywords {
+			if keyword = strings.TrimSpace(keyword); keyword != "" && !seen[keyword] {
+				seen[keyword] = true
+				m.Keywords = append(m.Keywords, keyword)
+			}
+		}
+	}
+	if u.Title != nil {
+		m.Title = strings.TrimSpace(*u.Title)
+	}
+	if u.Description != nil {
+		m.Description = strings.TrimSpace(*u.Description)
+	}
+	return nil
+}
+
+// updateSidecar writes u to the sidecar of foto id, creating one next to
+// the file when it has none yet, and stores the annotations that result.
+// ok is false when there is no such foto.
+func updateSidecar(db *sql.DB, id int32, u MetadataUpdate) (ok bool, err error) {
+	var path, sidecar string
+	err = db.QueryRow("SELECT path, COALESCE(sidecar, '') FROM fotos WHERE id = ?", id).Scan(&path, &sidecar)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// The sidecar may have appeared since the last scan.
+	if _, err := os.Stat(sidecar); sidecar == "" || err != nil {
+		if sidecar, _ = filescanner.FindSidecar(path); sidecar == "" {
+			sidecar = filescanner.SidecarPath(path)
+		}
+	}
+
+	m, err := xmp.ReadFile(sidecar)
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	if err := u.apply(&m); err != nil {
+		return true, err
+	}
+	if err := xmp.WriteFile(sidecar, m); err != nil {
+		return true, err
+	}
+	info, err := os.Stat(sidecar)
+	if err != nil {
+		return true, err
+	}
+	format, err := filescanner.Detect(path)
+	if err != nil {
+		return true, err
+	}
+	f := filescanner.File{Path: path, Format: format, Sidecar: sidecar, SidecarModTime: info.ModTime()}
+	if format == nil {
+		// Only the sidecar has annotations then.
+		f.Format = &filescanner.Format{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return true, err
+	}
+	for _, s := range annotationStatements(path, readAnnotations(f), sidecar, info.ModTime()) {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			tx.Rollback()
+			return true, err
+		}
+	}
+	return true, tx.Commit()
+}
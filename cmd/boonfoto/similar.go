@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+
+	"bktree"
+	"filescanner"
+	"github.com/rainycape/magick"
+)
+
+// perceptualHash decodes the image at path and returns its magick pHash,
+// or an error for formats magick cannot read.
+func perceptualHash(path string) (uint64, error) {
+	im, err := magick.DecodeFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer im.Dispose()
+
+	hash, err := im.PHash()
+	if err != nil {
+		return 0, err
+	}
+	return hash.Uint64(), nil
+}
+
+func hasPerceptualHash(format *filescanner.Format) bool {
+	return format.Kind == filescanner.KindImage
+}
+
+// SimilarIndex keeps the perceptual hashes of the present fotos in a
+// BK-tree. Writers only mark it stale; the next search reloads it from the
+// database, so bursts of ingest cost a single reload.
+type SimilarIndex struct {
+	mu    sync.Mutex
+	tree  *bktree.Tree
+	stale bool
+}
+
+var similarIndex = &SimilarIndex{stale: true}
+
+func (si *SimilarIndex) Invalidate() {
+	si.mu.Lock()
+	si.stale = true
+	si.mu.Unlock()
+}
+
+func (si *SimilarIndex) load(db *sql.DB) (*bktree.Tree, error) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	if !si.stale {
+		return si.tree, nil
+	}
+
+	rows, err := db.Query("SELECT id, phash FROM fotos WHERE phash IS NOT NULL AND status IS NOT 'missing'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tree := bktree.New()
+	for rows.Next() {
+		var id, phash int64
+		if err := rows.Scan(&id, &phash); err != nil {
+			return nil, err
+		}
+		tree.Add(uint64(phash), id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	si.tree = tree
+	si.stale = false
+	return tree, nil
+}
+
+// Similar returns the fotos within threshold bits of the perceptual hash
+// of foto id, closest first and without id itself. ok is false when the
+// foto has no perceptual hash.
+func (si *SimilarIndex) Similar(db *sql.DB, id int32, threshold int) (matches []bktree.Match, ok bool, err error) {
+	var phash sql.NullInt64
+	err = db.QueryRow("SELECT phash FROM fotos WHERE id = ?", id).Scan(&phash)
+	if err == sql.ErrNoRows || (err == nil && !phash.Valid) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	tree, err := si.load(db)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matches = []bktree.Match{}
+	for _, m := range tree.Search(uint64(phash.Int64), threshold) {
+		if m.Id != int64(id) {
+			matches = append(matches, m)
+		}
+	}
+	return matches, true, nil
+}
@@ -2,93 +2,221 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"time"
-	"fmt"
-	"filescanner"
 )
 
 type Foto struct {
-	Id    int32     `json:"id"`
-	Path  string    `json:"path"`
-	Mtime time.Time `json:"mtime"`
+	Id              int32            `json:"id"`
+	Path            string           `json:"path"`
+	Root            string           `json:"root"`
+	Mtime           time.Time        `json:"mtime"`
+	Format          string           `json:"format"`
+	Status          string           `json:"status,omitempty"`
+	TakenAt         string           `json:"takenAt,omitempty"`
+	TakenAtOriginal string           `json:"takenAtOriginal,omitempty"`
+	Make            string           `json:"make,omitempty"`
+	Model           string           `json:"model,omitempty"`
+	Lens            string           `json:"lens,omitempty"`
+	FocalLength     float64          `json:"focalLength,omitempty"`
+	Aperture        float64          `json:"aperture,omitempty"`
+	ExposureTime    float64          `json:"exposureTime,omitempty"`
+	Iso             int              `json:"iso,omitempty"`
+	Width           int              `json:"width,omitempty"`
+	Height          int              `json:"height,omitempty"`
+	Orientation     int              `json:"orientation,omitempty"`
+	Rotation        int              `json:"rotation"`
+	RotationSet     bool             `json:"rotationSet,omitempty"`
+	Latitude        *float64         `json:"latitude,omitempty"`
+	Longitude       *float64         `json:"longitude,omitempty"`
+	Altitude        *float64         `json:"altitude,omitempty"`
+	Country         string           `json:"country,omitempty"`
+	Region          string           `json:"region,omitempty"`
+	City            string           `json:"city,omitempty"`
+	DerivedLocation *DerivedLocation `json:"derivedLocation,omitempty"`
+	Rating          int              `json:"rating,omitempty"`
+	Label           string           `json:"label,omitempty"`
+	Keywords        []string         `json:"keywords,omitempty"`
+	Title           string           `json:"title,omitempty"`
+	Description     string           `json:"description,omitempty"`
+	Byline          string           `json:"byline,omitempty"`
+	Copyright       string           `json:"copyright,omitempty"`
+	LocationCity    string           `json:"locationCity,omitempty"`
+	Sidecar         string           `json:"sidecar,omitempty"`
 }
 
-func Count(db *sql.DB, query string, args ...interface{}) (int) {
-	rows, err := db.Query(query, args ...)
-	if err != nil {
-		log.Fatal("Failed to get count: ", err)
-	}
-	defer rows.Close()
+// DerivedLocation is a position matched from a GPX track rather than
+// recorded in the file. Source names the track file.
+type DerivedLocation struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Source    string   `json:"source"`
+}
 
-	rows.Next()
-	var count int
-	rows.Scan(&count)
-	return count
+// NullTime scans a DATETIME column that may be NULL.
+type NullTime struct {
+	Time  time.Time
+	Valid bool
 }
 
-type SqlPopulator struct {
-	db *sql.DB
+func (nt *NullTime) Scan(value interface{}) error {
+	nt.Time, nt.Valid = value.(time.Time)
+	return nil
 }
 
-func (sp SqlPopulator) visitImageFile(path string, modTime time.Time) {
-	c := Count(sp.db, "SELECT COUNT(1) FROM fotos WHERE path = ?", path)
-	if c > 0 {
-		return
-	}
+func Count(db *sql.DB, query string, args ...interface{}) (int, error) {
+	var count int
+	err := db.QueryRow(query, args...).Scan(&count)
+	return count, storeError(err)
+}
 
-	sp.db.Exec("INSERT INTO fotos (path, mtime) VALUES (?, ?)", path, modTime)
-	fmt.Println("Added imageFile: ", path)
+// baselineColumns are the fotos columns added one by one before schema
+// versions, for databases made by those releases. rereadMetadata marks
+// columns that the metadata of fotos indexed before is read again for.
+var baselineColumns = []struct {
+	name           string
+	decl           string
+	rereadMetadata bool
+}{
+	{"format", "TEXT", false}, {"size", "INTEGER", false}, {"hash", "TEXT", false}, {"status", "TEXT", false},
+	{"previous_path", "TEXT", false}, {"root", "TEXT", false}, {"phash", "INTEGER", false},
+	{"taken_at", "DATETIME", false}, {"taken_offset", "TEXT", false}, {"make", "TEXT", false}, {"model", "TEXT", false},
+	{"lens", "TEXT", false}, {"focal_length", "REAL", false}, {"aperture", "REAL", false}, {"exposure_time", "REAL", false},
+	{"iso", "INTEGER", false}, {"width", "INTEGER", false}, {"height", "INTEGER", false}, {"orientation", "INTEGER", false},
+	{"metadata_at", "DATETIME", false}, {"rotation_locked", "INTEGER", false},
+	{"latitude", "REAL", true}, {"longitude", "REAL", false}, {"altitude", "REAL", false},
+	{"place_country", "TEXT", false}, {"place_region", "TEXT", false}, {"place_city", "TEXT", false}, {"place_at", "DATETIME", false},
+	{"derived_latitude", "REAL", false}, {"derived_longitude", "REAL", false}, {"derived_altitude", "REAL", false}, {"derived_source", "TEXT", false},
+	{"taken_at_original", "DATETIME", false}, {"taken_written", "INTEGER", false},
+	{"rating", "INTEGER", false}, {"label", "TEXT", false}, {"title", "TEXT", false}, {"description", "TEXT", false},
+	{"sidecar", "TEXT", false}, {"sidecar_mtime", "DATETIME", false},
+	{"byline", "TEXT", true}, {"copyright", "TEXT", false}, {"location_city", "TEXT", false},
 }
 
-func loadFoto(db *sql.DB, id int32) (*Foto) {
-	rows, err := db.Query("SELECT id, path, mtime FROM fotos WHERE id = ?", id)
+// migrateBaseline brings an empty database, or one made before schema
+// versions, to schema version 1.
+func migrateBaseline(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS fotos (id INTEGER NOT NULL PRIMARY KEY, path TEXT NOT NULL, mtime DATETIME, rotation INTEGER, format TEXT, size INTEGER, hash TEXT, status TEXT, previous_path TEXT, root TEXT, phash INTEGER,
+			taken_at DATETIME, taken_offset TEXT, make TEXT, model TEXT, lens TEXT, focal_length REAL, aperture REAL,
+			exposure_time REAL, iso INTEGER, width INTEGER, height INTEGER, orientation INTEGER, metadata_at DATETIME,
+			rotation_locked INTEGER, latitude REAL, longitude REAL, altitude REAL,
+			place_country TEXT, place_region TEXT, place_city TEXT, place_at DATETIME,
+			derived_latitude REAL, derived_longitude REAL, derived_altitude REAL, derived_source TEXT,
+			taken_at_original DATETIME, taken_written INTEGER,
+			rating INTEGER, label TEXT, title TEXT, description TEXT, sidecar TEXT, sidecar_mtime DATETIME,
+			byline TEXT, copyright TEXT, location_city TEXT)
+	`)
 	if err != nil {
-		log.Fatal("Failed to load foto[id=", id, "]: ", err)
+		return err
 	}
-	defer rows.Close()
-
-	if rows.Next() {
-		var foto Foto
-		rows.Scan(&foto.Id, &foto.Path, &foto.Mtime)
-		return &foto
-	} else {
-		log.Fatal("Failed to find foto[id=", id, "] to load: ", err)
-		return &Foto{}
+
+	reread := false
+	for _, c := range baselineColumns {
+		added, err := addColumn(tx, "fotos", c.name, c.decl)
+		if err != nil {
+			return err
+		}
+		reread = reread || (added && c.rereadMetadata)
+	}
+	if reread {
+		// Read the metadata of fotos indexed before again for the new
+		// columns; their files are not hashed again.
+		if _, err := tx.Exec("UPDATE fotos SET metadata_at = NULL"); err != nil {
+			return err
+		}
 	}
+
+	return execAll(tx,
+		"CREATE TABLE IF NOT EXISTS foto_keywords (foto_id INTEGER NOT NULL, keyword TEXT NOT NULL, PRIMARY KEY (foto_id, keyword))",
+		// Replaced by foto_keywords_nocase, as keyword search ignores case.
+		"DROP INDEX IF EXISTS foto_keywords_keyword",
+		"CREATE INDEX IF NOT EXISTS foto_keywords_nocase ON foto_keywords (keyword COLLATE NOCASE)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS fotos_path ON fotos (path)",
+		"CREATE INDEX IF NOT EXISTS fotos_hash ON fotos (hash)",
+		"CREATE INDEX IF NOT EXISTS fotos_taken ON fotos (COALESCE(taken_at, mtime), path)",
+		"CREATE INDEX IF NOT EXISTS fotos_model ON fotos (model)",
+		"CREATE INDEX IF NOT EXISTS fotos_lens ON fotos (lens)",
+		// Replaced by fotos_position, which covers derived locations as well.
+		"DROP INDEX IF EXISTS fotos_location",
+		"CREATE INDEX IF NOT EXISTS fotos_position ON fotos ("+latitudeExpr+", "+longitudeExpr+")",
+		"CREATE INDEX IF NOT EXISTS fotos_place ON fotos (place_country, place_region, place_city)",
+	)
 }
 
-func createTable(db *sql.DB) {
-	rows, err := db.Query("SELECT COUNT(*) FROM sqlite_master WHERE type = ? AND name = ?", "table", "fotos")
-	if err != nil {
-		log.Fatal(err)
-	}
+// migrateFileWrites adds the journal of metadata written into files, with
+// the segments each write replaced so that it can be reverted.
+func migrateFileWrites(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS file_writes (id INTEGER NOT NULL PRIMARY KEY, foto_id INTEGER NOT NULL, path TEXT NOT NULL,
+			written_at DATETIME NOT NULL, changes TEXT NOT NULL, header BLOB NOT NULL, written_sum TEXT NOT NULL, reverted_at DATETIME)`,
+		"CREATE INDEX IF NOT EXISTS file_writes_foto ON file_writes (foto_id)",
+	)
+}
 
-	rows.Next()
-	var count int
-	rows.Scan(&count)
-	rows.Close()
+// migrateListingIndexes indexes the sort keys of /api/fotos. Each index
+// ends in the rowid, the id that breaks ties between equal keys.
+func migrateListingIndexes(tx *sql.Tx) error {
+	return execAll(tx,
+		"CREATE INDEX IF NOT EXISTS fotos_timeline ON fotos (COALESCE(taken_at, mtime))",
+		"CREATE INDEX IF NOT EXISTS fotos_mtime ON fotos (mtime)",
+		"CREATE INDEX IF NOT EXISTS fotos_rating ON fotos (COALESCE(rating, 0))",
+	)
+}
 
-	if count < 1 {
-		_, err := db.Exec(`
-			CREATE TABLE fotos (id INTEGER NOT NULL PRIMARY KEY, path TEXT NOT NULL, mtime DATETIME, rotation INTEGER)
-		`)
-		if err != nil {
-			log.Fatal("Fail to create table: ", err)
+// migrateJobs adds the background job queue. A foto has at most one
+// queued job of each type; jobs_queued makes further ones no-ops.
+func migrateJobs(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS jobs (id INTEGER NOT NULL PRIMARY KEY, type TEXT NOT NULL, foto_id INTEGER NOT NULL,
+			state TEXT NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, run_at DATETIME NOT NULL, lease_until DATETIME, worker TEXT,
+			last_error TEXT, created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL)`,
+		"CREATE INDEX IF NOT EXISTS jobs_ready ON jobs (type, state, run_at)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS jobs_queued ON jobs (type, foto_id) WHERE state = 'queued'",
+		"CREATE TABLE IF NOT EXISTS job_logs (id INTEGER NOT NULL PRIMARY KEY, job_id INTEGER NOT NULL, at DATETIME NOT NULL, message TEXT NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS job_logs_job ON job_logs (job_id)",
+	)
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, query := range statements {
+		if _, err := tx.Exec(query); err != nil {
+			return err
 		}
-		fmt.Println("Created table fotos.")
 	}
+	return nil
 }
 
-func fillSqlLiteDb() {
-	db, err := sql.Open("sqlite3", "./fotos.db")
+// addColumn adds a column unless the table has it, and reports whether it
+// did.
+func addColumn(tx *sql.Tx, table string, column string, decl string) (bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	defer db.Close()
 
-	createTable(db)
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
 
-	sp := SqlPopulator{db}
-	filescanner.Scan("/mnt/nas/Pictures/boon-phone-sync/2017", sp.visitImageFile)
+	if !found {
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl); err != nil {
+			return false, err
+		}
+	}
+	return !found, nil
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// FotoStore keeps the index of fotos. Implementations return the errors
+// below rather than those of their backend, so that callers can tell a
+// missing foto from a database that is busy.
+type FotoStore interface {
+	// Get returns foto id, or ErrNotFound.
+	Get(id int32) (*Foto, error)
+	// List returns the ids of the fotos that are not missing, in timeline
+	// order.
+	List() ([]int32, error)
+	// Insert adds a foto under a new id, which it returns. A foto with the
+	// same path gives ErrExists.
+	Insert(foto *Foto) (int32, error)
+	// Update replaces the stored fields of foto.Id, or returns ErrNotFound.
+	Update(foto *Foto) error
+	// Delete drops foto id from the index, along with its jobs and file
+	// write journal, leaving its file alone, or returns ErrNotFound.
+	Delete(id int32) error
+	// Query returns the fotos matching q in its sort order, which is the
+	// timeline by default.
+	Query(q FotoQuery) ([]*Foto, error)
+}
+
+var (
+	ErrNotFound    = errors.New("foto not found")
+	ErrExists      = errors.New("a foto with this path exists")
+	ErrInvalid     = errors.New("invalid foto")
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// FotoQuery selects fotos for FotoStore.Query. The criteria that are set
+// must all match; missing fotos never do.
+type FotoQuery struct {
+	Ids    []int32
+	Root   string
+	Folder string
+	Model  string
+	Format string
+	// From and To bound the timeline time, the capture time or else the
+	// file's modification time, to [From, To).
+	From, To time.Time
+	// HasGPS selects fotos with or without a position, from EXIF or a GPX
+	// track.
+	HasGPS *bool
+
+	// Sort orders the fotos by a key and then by id, descending with Desc.
+	Sort SortKey
+	Desc bool
+	// After continues from the foto a previous page ended with.
+	After *Cursor
+	// Limit is the most fotos returned, 0 for all.
+	Limit int
+}
+
+type SortKey string
+
+const (
+	SortTaken  SortKey = "taken"
+	SortMtime  SortKey = "mtime"
+	SortPath   SortKey = "path"
+	SortRating SortKey = "rating"
+)
+
+// sortExprs are the columns each sort key orders by, with id after them.
+var sortExprs = map[SortKey]string{
+	SortTaken:  "COALESCE(taken_at, mtime)",
+	SortMtime:  "mtime",
+	SortPath:   "path",
+	SortRating: "COALESCE(rating, 0)",
+}
+
+// Cursor is the position of a foto in a sort order: its id and the value of
+// the sort key, in the field for the key.
+type Cursor struct {
+	Time   time.Time
+	Path   string
+	Rating int
+	Id     int32
+}
+
+// CursorOf returns the position of foto in the order of key.
+func CursorOf(foto *Foto, key SortKey) Cursor {
+	c := Cursor{Id: foto.Id}
+	switch key {
+	case SortMtime:
+		c.Time = foto.Mtime.UTC()
+	case SortPath:
+		c.Path = foto.Path
+	case SortRating:
+		c.Rating = foto.Rating
+	default:
+		c.Time = timelineTime(foto).UTC()
+	}
+	return c
+}
+
+func (c Cursor) value(key SortKey) interface{} {
+	switch key {
+	case SortPath:
+		return c.Path
+	case SortRating:
+		return c.Rating
+	}
+	return c.Time
+}
+
+// SqlStore is the FotoStore of the SQLite database.
+type SqlStore struct {
+	db *sql.DB
+}
+
+func NewSqlStore(db *sql.DB) *SqlStore {
+	return &SqlStore{db: db}
+}
+
+// storeError turns a database error into the store error for it. Errors
+// without one are returned as they are.
+func storeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err == driver.ErrBadConn {
+		log.Println("Failed to reach database: ", err)
+		return ErrUnavailable
+	}
+	if e, ok := err.(sqlite3.Error); ok {
+		switch {
+		case e.Code == sqlite3.ErrBusy, e.Code == sqlite3.ErrLocked, e.Code == sqlite3.ErrCantOpen, e.Code == sqlite3.ErrIoErr:
+			log.Println("Failed to reach database: ", err)
+			return ErrUnavailable
+		case e.ExtendedCode == sqlite3.ErrConstraintUnique:
+			return ErrExists
+		}
+	}
+	return err
+}
+
+// fotoColumns are the columns scanFoto reads.
+const fotoColumns = `id, path, COALESCE(root, ''), mtime, COALESCE(format, ''), COALESCE(status, ''),
+	taken_at, COALESCE(taken_offset, ''), COALESCE(make, ''), COALESCE(model, ''), COALESCE(lens, ''),
+	COALESCE(focal_length, 0), COALESCE(aperture, 0), COALESCE(exposure_time, 0), COALESCE(iso, 0),
+	COALESCE(width, 0), COALESCE(height, 0), COALESCE(orientation, 0),
+	COALESCE(rotation, orientation, 1), COALESCE(rotation_locked, 0), latitude, longitude, altitude,
+	COALESCE(place_country, ''), COALESCE(place_region, ''), COALESCE(place_city, ''),
+	derived_latitude, derived_longitude, derived_altitude, COALESCE(derived_source, ''), taken_at_original,
+	COALESCE(rating, 0), COALESCE(label, ''), COALESCE(title, ''), COALESCE(description, ''),
+	COALESCE(byline, ''), COALESCE(copyright, ''), COALESCE(location_city, ''), COALESCE(sidecar, '')`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFoto(row scanner) (*Foto, error) {
+	var foto Foto
+	var takenAt, takenAtOriginal NullTime
+	var takenOffset string
+	var latitude, longitude, altitude sql.NullFloat64
+	var derivedLatitude, derivedLongitude, derivedAltitude sql.NullFloat64
+	var derivedSource string
+	err := row.Scan(&foto.Id, &foto.Path, &foto.Root, &foto.Mtime, &foto.Format, &foto.Status,
+		&takenAt, &takenOffset, &foto.Make, &foto.Model, &foto.Lens,
+		&foto.FocalLength, &foto.Aperture, &foto.ExposureTime, &foto.Iso,
+		&foto.Width, &foto.Height, &foto.Orientation, &foto.Rotation, &foto.RotationSet,
+		&latitude, &longitude, &altitude, &foto.Country, &foto.Region, &foto.City,
+		&derivedLatitude, &derivedLongitude, &derivedAltitude, &derivedSource, &takenAtOriginal,
+		&foto.Rating, &foto.Label, &foto.Title, &foto.Description,
+		&foto.Byline, &foto.Copyright, &foto.LocationCity, &foto.Sidecar)
+	if err != nil {
+		return nil, err
+	}
+	if takenAt.Valid {
+		foto.TakenAt = formatTaken(takenAt.Time, takenOffset)
+	}
+	if takenAtOriginal.Valid {
+		foto.TakenAtOriginal = formatTaken(takenAtOriginal.Time, takenOffset)
+	}
+	if latitude.Valid && longitude.Valid {
+		foto.Latitude, foto.Longitude = &latitude.Float64, &longitude.Float64
+	}
+	if altitude.Valid {
+		foto.Altitude = &altitude.Float64
+	}
+	if derivedLatitude.Valid && derivedLongitude.Valid {
+		foto.DerivedLocation = &DerivedLocation{
+			Latitude:  derivedLatitude.Float64,
+			Longitude: derivedLongitude.Float64,
+			Source:    derivedSource,
+		}
+		if derivedAltitude.Valid {
+			foto.DerivedLocation.Altitude = &derivedAltitude.Float64
+		}
+	}
+	return &foto, nil
+}
+
+func (s *SqlStore) Get(id int32) (*Foto, error) {
+	foto, err := scanFoto(s.db.QueryRow("SELECT "+fotoColumns+" FROM fotos WHERE id = ?", id))
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if foto.Keywords, err = loadKeywords(s.db, id); err != nil {
+		return nil, storeError(err)
+	}
+	return foto, nil
+}
+
+func (s *SqlStore) List() ([]int32, error) {
+	rows, err := s.db.Query("SELECT id FROM fotos WHERE status IS NOT 'missing' ORDER BY COALESCE(taken_at, mtime), path")
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer rows.Close()
+
+	ids := []int32{}
+	for rows.Next() {
+		var id int32
+		if err := rows.Scan(&id); err != nil {
+			return nil, storeError(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, storeError(rows.Err())
+}
+
+func (q FotoQuery) condition() (string, []interface{}) {
+	conds := []string{"status IS NOT 'missing'"}
+	var args []interface{}
+	if len(q.Ids) > 0 {
+		conds = append(conds, "id IN (?"+strings.Repeat(", ?", len(q.Ids)-1)+")")
+		for _, id := range q.Ids {
+			args = append(args, id)
+		}
+	}
+	if q.Root != "" {
+		conds = append(conds, "root = ?")
+		args = append(args, q.Root)
+	}
+	if q.Folder != "" {
+		lo, hi := prefixRange(filepath.Clean(q.Folder))
+		conds = append(conds, "path > ? AND path < ?")
+		args = append(args, lo, hi)
+	}
+	if q.Model != "" {
+		conds = append(conds, "model = ?")
+		args = append(args, q.Model)
+	}
+	if q.Format != "" {
+		conds = append(conds, "format = ?")
+		args = append(args, q.Format)
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, sortExprs[SortTaken]+" >= ?")
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, sortExprs[SortTaken]+" < ?")
+		args = append(args, q.To.UTC())
+	}
+	if q.HasGPS != nil {
+		if *q.HasGPS {
+			conds = append(conds, latitudeExpr+" IS NOT NULL")
+		} else {
+			conds = append(conds, latitudeExpr+" IS NULL")
+		}
+	}
+	if q.After != nil {
+		expr, op := q.sortExpr(), ">"
+		if q.Desc {
+			op = "<"
+		}
+		value := q.After.value(q.sort())
+		conds = append(conds, "("+expr+" "+op+" ? OR ("+expr+" = ? AND id "+op+" ?))")
+		args = append(args, value, value, q.After.Id)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (q FotoQuery) sort() SortKey {
+	if _, ok := sortExprs[q.Sort]; ok {
+		return q.Sort
+	}
+	return SortTaken
+}
+
+func (q FotoQuery) sortExpr() string {
+	return sortExprs[q.sort()]
+}
+
+func (q FotoQuery) orderBy() string {
+	if q.Desc {
+		return q.sortExpr() + " DESC, id DESC"
+	}
+	return q.sortExpr() + ", id"
+}
+
+func (s *SqlStore) Query(q FotoQuery) ([]*Foto, error) {
+	cond, args := q.condition()
+	query := "SELECT " + fotoColumns + " FROM fotos WHERE " + cond + " ORDER BY " + q.orderBy()
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	fotos := []*Foto{}
+	for rows.Next() {
+		foto, err := scanFoto(rows)
+		if err != nil {
+			rows.Close()
+			return nil, storeError(err)
+		}
+		fotos = append(fotos, foto)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, storeError(err)
+	}
+	return fotos, storeError(s.loadKeywords(fotos))
+}
+
+// loadKeywords fills in the keywords of fotos in one query.
+func (s *SqlStore) loadKeywords(fotos []*Foto) error {
+	if len(fotos) == 0 {
+		return nil
+	}
+	byId := make(map[int32]*Foto, len(fotos))
+	args := make([]interface{}, 0, len(fotos))
+	for _, foto := range fotos {
+		byId[foto.Id] = foto
+		args = append(args, foto.Id)
+	}
+	rows, err := s.db.Query("SELECT foto_id, keyword FROM foto_keywords WHERE foto_id IN (?"+strings.Repeat(", ?", len(args)-1)+") ORDER BY keyword", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int32
+		var keyword string
+		if err := rows.Scan(&id, &keyword); err != nil {
+			return err
+		}
+		byId[id].Keywords = append(byId[id].Keywords, keyword)
+	}
+	return rows.Err()
+}
+
+// parseTakenOffset parses a capture time in the API format and returns the
+// UTC offset it gives, if any, as stored in taken_offset.
+func parseTakenOffset(s string) (time.Time, string, error) {
+	if t, err := time.Parse(takenOffsetLayout, s); err == nil {
+		return t, t.Format("-07:00"), nil
+	}
+	t, err := time.ParseInLocation(takenLayout, s, time.Local)
+	return t, "", err
+}
+
+// writableColumns are the fotos columns Insert and Update set, in the order
+// of the values returned by fotoValues.
+const writableColumns = "path, root, mtime, format, status, taken_at, taken_offset, make, model, lens, " +
+	"focal_length, aperture, exposure_time, iso, width, height, orientation, rotation, rotation_locked, " +
+	"latitude, longitude, altitude, place_country, place_region, place_city, " +
+	"derived_latitude, derived_longitude, derived_altitude, derived_source, taken_at_original, " +
+	"rating, label, title, description, byline, copyright, location_city, sidecar"
+
+func fotoValues(foto *Foto) ([]interface{}, error) {
+	if foto.Path == "" {
+		return nil, ErrInvalid
+	}
+	var takenAt, takenAtOriginal interface{}
+	var offset string
+	if foto.TakenAt != "" {
+		t, o, err := parseTakenOffset(foto.TakenAt)
+		if err != nil {
+			return nil, ErrInvalid
+		}
+		takenAt, offset = t.UTC(), o
+	}
+	if foto.TakenAtOriginal != "" {
+		t, _, err := parseTakenOffset(foto.TakenAtOriginal)
+		if err != nil {
+			return nil, ErrInvalid
+		}
+		takenAtOriginal = t.UTC()
+	}
+	var latitude, longitude, altitude interface{}
+	if foto.Latitude != nil && foto.Longitude != nil {
+		latitude, longitude = *foto.Latitude, *foto.Longitude
+		if foto.Altitude != nil {
+			altitude = *foto.Altitude
+		}
+	}
+	var derivedLatitude, derivedLongitude, derivedAltitude, derivedSource interface{}
+	if d := foto.DerivedLocation; d != nil {
+		derivedLatitude, derivedLongitude, derivedSource = d.Latitude, d.Longitude, nullString(d.Source)
+		if d.Altitude != nil {
+			derivedAltitude = *d.Altitude
+		}
+	}
+	var rotation interface{}
+	if validOrientation(foto.Rotation) {
+		rotation = foto.Rotation
+	}
+	return []interface{}{
+		foto.Path, nullString(foto.Root), foto.Mtime.UTC(), nullString(foto.Format), nullString(foto.Status),
+		takenAt, nullString(offset), nullString(foto.Make), nullString(foto.Model), nullString(foto.Lens),
+		nullFloat(foto.FocalLength), nullFloat(foto.Aperture), nullFloat(foto.ExposureTime), nullInt(foto.Iso),
+		nullInt(foto.Width), nullInt(foto.Height), nullInt(foto.Orientation), rotation, nullBool(foto.RotationSet),
+		latitude, longitude, altitude, nullString(foto.Country), nullString(foto.Region), nullString(foto.City),
+		derivedLatitude, derivedLongitude, derivedAltitude, derivedSource, takenAtOriginal,
+		nullInt(foto.Rating), nullString(foto.Label), nullString(foto.Title), nullString(foto.Description),
+		nullString(foto.Byline), nullString(foto.Copyright), nullString(foto.LocationCity), nullString(foto.Sidecar),
+	}, nil
+}
+
+func replaceKeywords(tx *sql.Tx, id int32, keywords []string) error {
+	if _, err := tx.Exec("DELETE FROM foto_keywords WHERE foto_id = ?", id); err != nil {
+		return err
+	}
+	for _, keyword := range keywords {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO foto_keywords (foto_id, keyword) VALUES (?, ?)", id, keyword); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTx runs f in a transaction, committing it when f succeeds.
+func (s *SqlStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return storeError(err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return storeError(err)
+	}
+	return storeError(tx.Commit())
+}
+
+func (s *SqlStore) Insert(foto *Foto) (int32, error) {
+	values, err := fotoValues(foto)
+	if err != nil {
+		return 0, err
+	}
+	var id int32
+	err = s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO fotos ("+writableColumns+") VALUES (?"+strings.Repeat(", ?", len(values)-1)+")", values...)
+		if err != nil {
+			return err
+		}
+		lastId, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int32(lastId)
+		return replaceKeywords(tx, id, foto.Keywords)
+	})
+	return id, err
+}
+
+func (s *SqlStore) Update(foto *Foto) error {
+	values, err := fotoValues(foto)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		set := strings.Join(strings.Split(writableColumns, ", "), " = ?, ") + " = ?"
+		res, err := tx.Exec("UPDATE fotos SET "+set+" WHERE id = ?", append(values, foto.Id)...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = sql.ErrNoRows
+			}
+			return err
+		}
+		return replaceKeywords(tx, foto.Id, foto.Keywords)
+	})
+}
+
+func (s *SqlStore) Delete(id int32) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM fotos WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = sql.ErrNoRows
+			}
+			return err
+		}
+		// Its jobs would otherwise be leased for a foto that is gone.
+		for _, st := range []statement{
+			{"DELETE FROM foto_keywords WHERE foto_id = ?", []interface{}{id}},
+			{"DELETE FROM job_logs WHERE job_id IN (SELECT id FROM jobs WHERE foto_id = ?)", []interface{}{id}},
+			{"DELETE FROM jobs WHERE foto_id = ?", []interface{}{id}},
+			{"DELETE FROM file_writes WHERE foto_id = ?", []interface{}{id}},
+		} {
+			if _, err := tx.Exec(st.query, st.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeContract runs the FotoStore contract against the stores newStore
+// returns, each empty.
+func storeContract(t *testing.T, newStore func(t *testing.T) FotoStore) {
+	mtime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Get", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Get(1); err != ErrNotFound {
+			t.Errorf("Get of a missing foto = %v, want ErrNotFound", err)
+		}
+		foto := &Foto{Path: "/lib/a.jpg", Root: "family", Mtime: mtime, Format: "jpeg",
+			TakenAt: "2019-05-01T10:20:30+08:00", Rating: 3, Keywords: []string{"beach", "sea"}}
+		id, err := s.Insert(foto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != id || got.Path != foto.Path || got.Root != foto.Root || !got.Mtime.Equal(mtime) ||
+			got.TakenAt != foto.TakenAt || got.Rating != 3 || !reflect.DeepEqual(got.Keywords, foto.Keywords) {
+			t.Errorf("Get = %+v, want %+v", got, foto)
+		}
+	})
+
+	t.Run("Insert", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Insert(&Foto{Path: "/lib/a.jpg", Mtime: mtime}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Insert(&Foto{Path: "/lib/a.jpg", Mtime: mtime}); err != ErrExists {
+			t.Errorf("Insert of an existing path = %v, want ErrExists", err)
+		}
+		if _, err := s.Insert(&Foto{Mtime: mtime}); err != ErrInvalid {
+			t.Errorf("Insert without a path = %v, want ErrInvalid", err)
+		}
+		if _, err := s.Insert(&Foto{Path: "/lib/b.jpg", Mtime: mtime, TakenAt: "yesterday"}); err != ErrInvalid {
+			t.Errorf("Insert with a bad capture time = %v, want ErrInvalid", err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Update(&Foto{Id: 42, Path: "/lib/a.jpg", Mtime: mtime}); err != ErrNotFound {
+			t.Errorf("Update of a missing foto = %v, want ErrNotFound", err)
+		}
+		a, err := s.Insert(&Foto{Path: "/lib/a.jpg", Mtime: mtime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Insert(&Foto{Path: "/lib/b.jpg", Mtime: mtime}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Update(&Foto{Id: a, Path: "/lib/b.jpg", Mtime: mtime}); err != ErrExists {
+			t.Errorf("Update to an existing path = %v, want ErrExists", err)
+		}
+		if err := s.Update(&Foto{Id: a, Path: "/lib/a.jpg", Mtime: mtime, Rating: 5, Keywords: []string{"kept"}}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Get(a); err != nil || got.Rating != 5 || !reflect.DeepEqual(got.Keywords, []string{"kept"}) {
+			t.Errorf("Get after Update = %+v, %v", got, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Delete(42); err != ErrNotFound {
+			t.Errorf("Delete of a missing foto = %v, want ErrNotFound", err)
+		}
+		id, err := s.Insert(&Foto{Path: "/lib/a.jpg", Mtime: mtime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(id); err != ErrNotFound {
+			t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+		}
+		if err := s.Delete(id); err != ErrNotFound {
+			t.Errorf("second Delete = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		s := newStore(t)
+		// Ties on every sort key: the same capture time in two zones, a
+		// capture time equal to another foto's mtime, shared ratings.
+		fotos := []*Foto{
+			{Path: "/lib/a.jpg", Mtime: mtime, TakenAt: "2019-05-01T10:00:00+08:00", Rating: 2},
+			{Path: "/lib/b.jpg", Mtime: mtime, TakenAt: "2019-05-01T03:00:00+01:00", Rating: 2},
+			{Path: "/lib/c.jpg", Mtime: time.Date(2019, 5, 1, 2, 0, 0, 0, time.UTC)},
+			{Path: "/lib/d.jpg", Mtime: mtime, TakenAt: "2018-12-24T18:00:00+00:00", Rating: 5},
+			{Path: "/lib/e.jpg", Mtime: mtime.Add(time.Hour), Rating: 2},
+			{Path: "/lib/f.jpg", Mtime: mtime, Status: "missing"},
+			{Path: "/lib/g.jpg", Mtime: mtime.Add(time.Hour), TakenAt: "2019-05-01T02:00:00+00:00"},
+		}
+		ids := map[string]int32{}
+		for _, foto := range fotos {
+			id, err := s.Insert(foto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[foto.Path] = id
+		}
+		names := func(fotos []*Foto) string {
+			s := ""
+			for _, foto := range fotos {
+				s += foto.Path[len("/lib/") : len("/lib/")+1]
+			}
+			return s
+		}
+
+		for _, test := range []struct {
+			sort SortKey
+			desc bool
+			want string
+		}{
+			{"", false, "deabcg"},
+			{SortTaken, true, "gcbaed"},
+			{SortMtime, false, "abdegc"},
+			{SortPath, true, "gedcba"},
+			{SortRating, false, "cgabed"},
+			{SortRating, true, "debagc"},
+		} {
+			name := fmt.Sprintf("%s desc=%v", test.sort, test.desc)
+			all, err := s.Query(FotoQuery{Sort: test.sort, Desc: test.desc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(all); got != test.want {
+				t.Errorf("%s: Query = %s, want %s", name, got, test.want)
+			}
+			for _, limit := range []int{1, 2, 4} {
+				var paged []*Foto
+				q := FotoQuery{Sort: test.sort, Desc: test.desc, Limit: limit}
+				for {
+					page, err := s.Query(q)
+					if err != nil {
+						t.Fatal(err)
+					}
+					paged = append(paged, page...)
+					if len(page) < limit {
+						break
+					}
+					after := CursorOf(page[len(page)-1], q.sort())
+					q.After = &after
+				}
+				if got := names(paged); got != test.want {
+					t.Errorf("%s: pages of %d = %s, want %s", name, limit, got, test.want)
+				}
+			}
+		}
+	})
+
+	t.Run("QueryInsertBetweenPages", func(t *testing.T) {
+		s := newStore(t)
+		for _, path := range []string{"/lib/b.jpg", "/lib/d.jpg", "/lib/f.jpg"} {
+			if _, err := s.Insert(&Foto{Path: path, Mtime: mtime}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q := FotoQuery{Sort: SortPath, Limit: 2}
+		first, err := s.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One foto sorts before the cursor and one after it.
+		for _, path := range []string{"/lib/a.jpg", "/lib/e.jpg"} {
+			if _, err := s.Insert(&Foto{Path: path, Mtime: mtime}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		after := CursorOf(first[len(first)-1], SortPath)
+		q.After, q.Limit = &after, 0
+		rest, err := s.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, foto := range append(first, rest...) {
+			got = append(got, foto.Path)
+		}
+		if want := []string{"/lib/b.jpg", "/lib/d.jpg", "/lib/e.jpg", "/lib/f.jpg"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("pages = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestMemStore(t *testing.T) {
+	storeContract(t, func(t *testing.T) FotoStore {
+		return NewMemStore()
+	})
+}
+
+func TestSqlStore(t *testing.T) {
+	storeContract(t, func(t *testing.T) FotoStore {
+		db := newTestDB(t)
+		t.Cleanup(func() { db.Close() })
+		return NewSqlStore(db)
+	})
+}
+
+func TestSqlStoreDeleteDropsJobs(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	s := NewSqlStore(db)
+	mtime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	id, err := s.Insert(&Foto{Path: "/lib/a.jpg", Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := s.Insert(&Foto{Path: "/lib/b.jpg", Mtime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/lib/a.jpg", "/lib/b.jpg"} {
+		for _, jobType := range []string{jobMetadata, jobThumbnails} {
+			st := enqueueJob(jobType, path)
+			if _, err := db.Exec(st.query, st.args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, fotoId := range []int32{id, kept} {
+		if _, err := db.Exec("INSERT INTO job_logs (job_id, at, message) SELECT id, ?, 'Queued.' FROM jobs WHERE foto_id = ?", mtime, fotoId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO file_writes (foto_id, path, written_at, changes, header, written_sum) VALUES (?, '', ?, '{}', x'', '')", fotoId, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	q := NewJobQueue(db, JobsConfig{Lease: Duration{time.Minute}})
+	for _, jobType := range []string{jobMetadata, jobThumbnails} {
+		job, err := q.lease(jobType, "worker")
+		if err != nil || job == nil || job.FotoId != kept {
+			t.Errorf("lease of a %s job = %+v, %v, want the one of foto %d", jobType, job, err, kept)
+		}
+	}
+	for table, want := range map[string]int{"jobs": 2, "job_logs": 2, "file_writes": 1} {
+		if n, err := Count(db, "SELECT COUNT(*) FROM "+table); err != nil || n != want {
+			t.Errorf("%d rows left in %s (%v), want %d", n, table, err, want)
+		}
+	}
+}
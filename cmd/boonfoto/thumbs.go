@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/rainycape/magick"
+)
+
+// How a rendered image fills its box: contain fits the whole foto into
+// it, cover fills it and crops the middle, entropy crops where there is
+// most detail.
+const (
+	fitContain = "contain"
+	fitCover   = "cover"
+	fitEntropy = "entropy"
+)
+
+// renderSpec describes an image rendered from a foto. Width and height
+// bound the upright image; fotos are never enlarged.
+type renderSpec struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+func (spec renderSpec) String() string {
+	return fmt.Sprintf("%dx%d/%s/%s/q%d", spec.Width, spec.Height, spec.Fit, spec.Format, spec.Quality)
+}
+
+// thumbSizes are the named thumbnail sizes; their quality comes from the
+// config.
+var thumbSizes = map[string]renderSpec{
+	"square": {Width: 256, Height: 256, Fit: fitCover, Format: "jpeg"},
+	"small":  {Width: 320, Height: 320, Fit: fitContain, Format: "jpeg"},
+	"large":  {Width: 1600, Height: 1600, Fit: fitContain, Format: "jpeg"},
+}
+
+// renderSource is what an image is rendered from: the file of a foto and
+// how to turn it upright.
+type renderSource struct {
+	Path     string
+	Hash     string
+	Rotation int
+	Mtime    time.Time
+}
+
+func loadRenderSource(db *sql.DB, id int32) (renderSource, error) {
+	var src renderSource
+	err := db.QueryRow("SELECT path, COALESCE(hash, ''), COALESCE(rotation, orientation, 1), mtime FROM fotos WHERE id = ?", id).
+		Scan(&src.Path, &src.Hash, &src.Rotation, &src.Mtime)
+	if !validOrientation(src.Rotation) {
+		src.Rotation = 1
+	}
+	return src, storeError(err)
+}
+
+// key addresses what is rendered from src by spec. It changes with the
+// content of the file and with its rotation, so edits and rotations get
+// new renderings rather than stale cached ones.
+func (src renderSource) key(spec renderSpec) string {
+	content := src.Hash
+	if content == "" {
+		// Not hashed yet; the path and modification time stand in.
+		content = src.Path + "@" + src.Mtime.UTC().Format(time.RFC3339Nano)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%s", content, src.Rotation, spec)))
+	return hex.EncodeToString(sum[:])
+}
+
+// RenderError is a foto that could not be rendered, such as a file that
+// is no image or is damaged.
+type RenderError struct {
+	Err error
+}
+
+func (e *RenderError) Error() string {
+	return "render: " + e.Err.Error()
+}
+
+// renderCache keeps rendered images in a directory, under their key. A
+// rendering in progress is waited for rather than started again, and at
+// most a fixed number run at once.
+type renderCache struct {
+	dir   string
+	slots chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]*rendering
+}
+
+type rendering struct {
+	done chan struct{}
+	err  error
+}
+
+func newRenderCache(dir string, workers int) *renderCache {
+	return &renderCache{dir: dir, slots: make(chan struct{}, workers), inflight: make(map[string]*rendering)}
+}
+
+// get returns the file of the image rendered from src by spec, rendering
+// it first unless it is cached, and its key. A cached file gets the time
+// it is used at as modification time, which prune goes by.
+func (rc *renderCache) get(src renderSource, spec renderSpec) (string, string, error) {
+	key := src.key(spec)
+	path := filepath.Join(rc.dir, key[:2], key+"."+spec.Format)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return path, key, nil
+	}
+
+	rc.mu.Lock()
+	r, ok := rc.inflight[key]
+	if !ok {
+		r = &rendering{done: make(chan struct{})}
+		rc.inflight[key] = r
+	}
+	rc.mu.Unlock()
+	if ok {
+		<-r.done
+		return path, key, r.err
+	}
+
+	rc.slots <- struct{}{}
+	r.err = renderFile(path, src, spec)
+	<-rc.slots
+
+	rc.mu.Lock()
+	delete(rc.inflight, key)
+	rc.mu.Unlock()
+	close(r.done)
+	return path, key, r.err
+}
+
+// prune deletes the rendered images that were not used for maxAge, such as
+// those of changed or deleted fotos and sizes no longer asked for, and
+// returns how many it deleted.
+func (rc *renderCache) prune(maxAge time.Duration) (int, error) {
+	before := time.Now().Add(-maxAge)
+	removed := 0
+	err := filepath.Walk(rc.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// renderFile renders src by spec into a new file at path.
+func renderFile(path string, src renderSource, spec renderSpec) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".render-")
+	if err != nil {
+		return err
+	}
+	if err := render(tmp, src, spec); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fitSize returns the size of an image of w×h scaled down to fit into a
+// box of bw×bh.
+func fitSize(w int, h int, bw int, bh int) (int, int) {
+	scale := math.Min(1, math.Min(float64(bw)/float64(w), float64(bh)/float64(h)))
+	return int(math.Max(1, float64(w)*scale+0.5)), int(math.Max(1, float64(h)*scale+0.5))
+}
+
+func render(f *os.File, src renderSource, spec renderSpec) error {
+	im, err := magick.DecodeFile(src.Path)
+	if err != nil {
+		return &RenderError{err}
+	}
+	defer im.Dispose()
+
+	// Scale before turning the foto upright, which is cheaper on the
+	// smaller image; orientations from 5 on swap width and height.
+	bw, bh := spec.Width, spec.Height
+	if src.Rotation >= 5 {
+		bw, bh = bh, bw
+	}
+	source := im
+	if spec.Fit == fitCover || spec.Fit == fitEntropy {
+		// Crop to the shape of the box, which then fits it exactly.
+		cs := magick.CSCenter
+		if spec.Fit == fitEntropy {
+			cs = magick.CSMaxEntropy
+		}
+		cropped, err := im.CropToRatio(float64(bw)/float64(bh), cs)
+		if err != nil {
+			return &RenderError{err}
+		}
+		if cropped != im {
+			defer cropped.Dispose()
+		}
+		source = cropped
+	}
+	w, h := fitSize(source.Width(), source.Height(), bw, bh)
+	scaled, err := source.Thumbnail(w, h)
+	if err != nil {
+		return &RenderError{err}
+	}
+	defer scaled.Dispose()
+
+	upright, err := orient(scaled, src.Rotation)
+	if err != nil {
+		return &RenderError{err}
+	}
+	if upright != scaled {
+		defer upright.Dispose()
+	}
+
+	info := magick.NewInfo()
+	info.SetFormat(spec.Format)
+	info.SetQuality(uint(spec.Quality))
+	if err := upright.Encode(f, info); err != nil {
+		return &RenderError{err}
+	}
+	return nil
+}
+
+// serveRendered answers with the image rendered from src by spec. Its key
+// is the ETag, so clients revalidate cheaply and see rotations at once;
+// a client that has the image already gets it confirmed without a render.
+func serveRendered(c echo.Context, rc *renderCache, src renderSource, spec renderSpec) error {
+	etag := `"` + src.key(spec) + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	path, _, err := rc.get(src, spec)
+	if renderErr, ok := err.(*RenderError); ok {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Failed to render foto: "+renderErr.Err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Content-Type", renderFormats[spec.Format])
+	return c.File(path)
+}
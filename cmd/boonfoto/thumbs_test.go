@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestServeRenderedRevalidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rc := newRenderCache(dir, 1)
+	src := renderSource{Path: filepath.Join(dir, "gone.jpg"), Hash: "abc", Rotation: 1, Mtime: time.Now()}
+	spec := thumbSizes["small"]
+	etag := `"` + src.key(spec) + `"`
+
+	serve := func(ifNoneMatch string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		return rec, serveRendered(echo.New().NewContext(req, rec), rc, src, spec)
+	}
+
+	rec, err := serve(etag)
+	if err != nil || rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != etag {
+		t.Errorf("revalidation: %d, %v, ETag %s, want 304 without rendering", rec.Code, err, rec.Header().Get("ETag"))
+	}
+	path := filepath.Join(dir, src.key(spec)[:2], src.key(spec)+"."+spec.Format)
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Errorf("revalidation rendered the image (%v)", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, testImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = serve("")
+	if err != nil || rec.Code != http.StatusOK || rec.Header().Get("ETag") != etag || rec.Body.Len() != len(testImage) {
+		t.Errorf("cached image: %d, %v, ETag %s, %d bytes", rec.Code, err, rec.Header().Get("ETag"), rec.Body.Len())
+	}
+}
+
+func TestRenderCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boonfoto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rc := newRenderCache(dir, 1)
+
+	old := time.Now().Add(-48 * time.Hour)
+	files := map[string]time.Time{"ab/old.jpeg": old, "ab/new.jpeg": time.Now(), "cd/old.webp": old, "cd/.render-1": old}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, testImage, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Serving an old rendering keeps it.
+	src := renderSource{Path: "/fotos/a.jpg", Hash: "abc", Rotation: 1}
+	spec := thumbSizes["small"]
+	key := src.key(spec)
+	used := filepath.Join(dir, key[:2], key+"."+spec.Format)
+	if err := os.MkdirAll(filepath.Dir(used), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(used, testImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(used, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if path, _, err := rc.get(src, spec); err != nil || path != used {
+		t.Fatalf("get = %s, %v, want the cached %s", path, err, used)
+	}
+
+	removed, err := rc.prune(24 * time.Hour)
+	if err != nil || removed != 3 {
+		t.Errorf("prune removed %d (%v), want 3", removed, err)
+	}
+	for _, path := range []string{filepath.Join(dir, "ab/new.jpeg"), used} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s: %v, want it kept", path, err)
+		}
+	}
+	for _, name := range []string{"ab/old.jpeg", "cd/old.webp", "cd/.render-1"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: %v, want it deleted", name, err)
+		}
+	}
+
+	if removed, err := newRenderCache(filepath.Join(dir, "none"), 1).prune(time.Hour); err != nil || removed != 0 {
+		t.Errorf("prune of a missing directory: %d, %v", removed, err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"exif"
+)
+
+// TimeSelection picks the fotos whose capture time is shifted: the given
+// ids, the fotos under a folder or those shot with a camera model. The
+// criteria that are set must all match.
+type TimeSelection struct {
+	Ids    []int32 `json:"ids"`
+	Folder string  `json:"folder"`
+	Model  string  `json:"model"`
+}
+
+func (s TimeSelection) condition() (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	if len(s.Ids) > 0 {
+		conds = append(conds, "id IN (?"+strings.Repeat(", ?", len(s.Ids)-1)+")")
+		for _, id := range s.Ids {
+			args = append(args, id)
+		}
+	}
+	if s.Folder != "" {
+		folder, err := filepath.Abs(s.Folder)
+		if err != nil {
+			return "", nil, err
+		}
+		lo, hi := prefixRange(folder)
+		conds = append(conds, "path > ? AND path < ?")
+		args = append(args, lo, hi)
+	}
+	if s.Model != "" {
+		conds = append(conds, "model = ?")
+		args = append(args, s.Model)
+	}
+	if len(conds) == 0 {
+		return "", nil, errEmptySelection
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+var errEmptySelection = errors.New("select fotos by ids, folder or model")
+
+// ShiftedFoto is one foto whose capture time changed from From to To.
+// Written is set when the new time went into the file as well.
+type ShiftedFoto struct {
+	Id      int32  `json:"id"`
+	Path    string `json:"path"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Written bool   `json:"written,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ShiftResult struct {
+	Offset  string        `json:"offset,omitempty"`
+	Fotos   []ShiftedFoto `json:"fotos"`
+	Applied bool          `json:"applied"`
+}
+
+type takenRow struct {
+	id       int32
+	path     string
+	root     string
+	format   string
+	takenAt  time.Time
+	offset   string
+	original NullTime
+	written  bool
+}
+
+func selectTaken(db *sql.DB, sel TimeSelection, extra string) ([]takenRow, error) {
+	cond, args, err := sel.condition()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT id, path, COALESCE(root, ''), COALESCE(format, ''), taken_at, COALESCE(taken_offset, ''), taken_at_original, COALESCE(taken_written, 0) FROM fotos
+		WHERE taken_at IS NOT NULL AND status IS NOT 'missing' AND `+cond+extra+`
+		ORDER BY taken_at, path`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fotos []takenRow
+	for rows.Next() {
+		var r takenRow
+		if err := rows.Scan(&r.id, &r.path, &r.root, &r.format, &r.takenAt, &r.offset, &r.original, &r.written); err != nil {
+			return nil, err
+		}
+		fotos = append(fotos, r)
+	}
+	return fotos, rows.Err()
+}
+
+// anchorOffset returns the shift that gives foto id the capture time
+// correct.
+func anchorOffset(db *sql.DB, id int32, correct time.Time) (time.Duration, error) {
+	var takenAt NullTime
+	err := db.QueryRow("SELECT taken_at FROM fotos WHERE id = ?", id).Scan(&takenAt)
+	if err == sql.ErrNoRows || (err == nil && !takenAt.Valid) {
+		return 0, fmt.Errorf("foto %d has no capture time to anchor to", id)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return correct.Sub(takenAt.Time), nil
+}
+
+// writeTaken writes a capture time into the JPEG file of r, in the zone
+// its time was read in. The write is journaled like any other, so it can
+// be reverted, and the row gets the new size and hash of the file.
+func writeTaken(db *sql.DB, r takenRow, t time.Time) error {
+	fileWriteMu.Lock()
+	defer fileWriteMu.Unlock()
+
+	if r.format != "jpeg" {
+		return errNotJPEG
+	}
+	layout := takenOffsetLayout
+	zone, hasOffset := exif.ParseOffset(r.offset)
+	if !hasOffset {
+		zone, layout = time.Local, takenLayout
+	}
+	t = t.In(zone)
+	takenAt := t.Format(layout)
+	if _, err := writeEdit(db, r.id, r.path, FileEdit{TakenAt: &takenAt}, t, hasOffset); err != nil {
+		return err
+	}
+	// Keep taken_at_original, which undo restores from.
+	return refreshFoto(db, r.path, r.root, false)
+}
+
+// shiftTimes moves the capture time of the selected fotos by offset. The
+// time before the first shift is kept in taken_at_original for undo, and
+// rescans leave shifted times alone. With write, DateTimeOriginal in the
+// files is corrected too; fotos whose file cannot be written are still
+// shifted in the index and report the error. Nothing changes unless every
+// foto can be shifted, and the index changes in one transaction after the
+// files are written.
+func shiftTimes(db *sql.DB, sel TimeSelection, offset time.Duration, write bool, dryRun bool) (ShiftResult, error) {
+	result := ShiftResult{Offset: offset.String(), Fotos: []ShiftedFoto{}}
+	fotos, err := selectTaken(db, sel, "")
+	if err != nil {
+		return result, err
+	}
+
+	for _, r := range fotos {
+		to := r.takenAt.Add(offset)
+		if to.Year() < 1 || to.Year() > 9999 {
+			return result, fmt.Errorf("shifting foto %d by %s leaves the years 1 to 9999", r.id, offset)
+		}
+		result.Fotos = append(result.Fotos, ShiftedFoto{Id: r.id, Path: r.path,
+			From: formatTaken(r.takenAt, r.offset), To: formatTaken(to, r.offset)})
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	updates := make([]statement, len(fotos))
+	for i, r := range fotos {
+		to := r.takenAt.Add(offset)
+		written := r.written
+		if write {
+			if err := writeTaken(db, r, to); err != nil {
+				log.Println("Failed to write capture time of ", r.path, ": ", err)
+				result.Fotos[i].Error = err.Error()
+			} else {
+				written, result.Fotos[i].Written = true, true
+			}
+		}
+		original := r.takenAt
+		if r.original.Valid {
+			original = r.original.Time
+		}
+		updates[i] = statement{"UPDATE fotos SET taken_at = ?, taken_at_original = ?, taken_written = ? WHERE id = ?",
+			[]interface{}{to.UTC(), original.UTC(), nullBool(written), r.id}}
+	}
+	if err := storeTaken(db, updates); err != nil {
+		return result, err
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// undoShift restores the capture time the selected fotos had before they
+// were first shifted, in the files too where it was written there. The
+// index changes in one transaction after the files are written.
+func undoShift(db *sql.DB, sel TimeSelection, dryRun bool) (ShiftResult, error) {
+	result := ShiftResult{Fotos: []ShiftedFoto{}}
+	fotos, err := selectTaken(db, sel, " AND taken_at_original IS NOT NULL")
+	if err != nil {
+		return result, err
+	}
+
+	for _, r := range fotos {
+		result.Fotos = append(result.Fotos, ShiftedFoto{Id: r.id, Path: r.path,
+			From: formatTaken(r.takenAt, r.offset), To: formatTaken(r.original.Time, r.offset)})
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	var updates []statement
+	for i, r := range fotos {
+		if r.written {
+			if err := writeTaken(db, r, r.original.Time); err != nil {
+				// Keep the shift, so that index and file still agree.
+				log.Println("Failed to restore capture time of ", r.path, ": ", err)
+				result.Fotos[i].Error = err.Error()
+				continue
+			}
+			result.Fotos[i].Written = true
+		}
+		updates = append(updates, statement{"UPDATE fotos SET taken_at = ?, taken_at_original = NULL, taken_written = NULL WHERE id = ?",
+			[]interface{}{r.original.Time.UTC(), r.id}})
+	}
+	if err := storeTaken(db, updates); err != nil {
+		return result, err
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// storeTaken runs the updates of capture times in one transaction.
+func storeTaken(db *sql.DB, statements []statement) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func nullBool(b bool) interface{} {
+	if !b {
+		return nil
+	}
+	return 1
+}
+
+// parseAnchor parses id=time, the capture time foto id should have.
+func parseAnchor(s string) (int32, time.Time, error) {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return 0, time.Time{}, fmt.Errorf("expected id=time, got %q", s)
+	}
+	id, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid id %q", s[:i])
+	}
+	t, err := parseTaken(s[i+1:])
+	return int32(id), t, err
+}
+
+// parseTaken parses a capture time in the API format, with or without a
+// UTC offset.
+func parseTaken(s string) (time.Time, error) {
+	if t, err := time.Parse(takenOffsetLayout, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(takenLayout, s, time.Local)
+}
+
+// runShiftTime implements the shift-time command.
+func runShiftTime(db *sql.DB, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("shift-time", flag.ExitOnError)
+	ids := flags.String("ids", "", "Comma separated ids of the fotos to shift.")
+	folder := flags.String("folder", "", "Shift the fotos under this folder.")
+	model := flags.String("model", "", "Shift the fotos shot with this camera model.")
+	offset := flags.Duration("offset", 0, "Duration to add to the capture times.")
+	anchor := flags.String("anchor", "", "id=time: shift so that foto id was taken at time, such as 2017-05-01T10:20:30+08:00.")
+	write := flags.Bool("write", false, "Write the corrected DateTimeOriginal into the files.")
+	undo := flags.Bool("undo", false, "Restore the capture times from before the first shift.")
+	dryRun := flags.Bool("dry-run", false, "List the changes without making them.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] shift-time [-ids 1,2|-folder dir|-model m] [-offset d|-anchor id=time|-undo] [-write] [-dry-run]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	sel := TimeSelection{Folder: *folder, Model: *model}
+	if *ids != "" {
+		for _, s := range strings.Split(*ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid id %q", s)
+			}
+			sel.Ids = append(sel.Ids, int32(id))
+		}
+	}
+
+	var result ShiftResult
+	var err error
+	switch {
+	case *undo:
+		result, err = undoShift(db, sel, *dryRun)
+	case *anchor != "":
+		id, correct, anchorErr := parseAnchor(*anchor)
+		if anchorErr != nil {
+			return anchorErr
+		}
+		d, anchorErr := anchorOffset(db, id, correct)
+		if anchorErr != nil {
+			return anchorErr
+		}
+		result, err = shiftTimes(db, sel, d, *write, *dryRun)
+	case *offset != 0:
+		result, err = shiftTimes(db, sel, *offset, *write, *dryRun)
+	default:
+		flags.Usage()
+		return fmt.Errorf("give -offset, -anchor or -undo")
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range result.Fotos {
+		note := ""
+		if f.Error != "" {
+			note = "  (file not written: " + f.Error + ")"
+		}
+		fmt.Fprintf(w, "%s -> %s  %s%s\n", f.From, f.To, f.Path, note)
+	}
+	verb := "Changed"
+	if *dryRun {
+		verb = "Would change"
+	}
+	fmt.Fprintf(w, "%s the capture time of %d fotos.\n", verb, len(result.Fotos))
+	return nil
+}
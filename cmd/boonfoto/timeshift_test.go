@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"exif"
+)
+
+// fileTaken returns the capture time recorded in the file at path.
+func fileTaken(t *testing.T, path string) time.Time {
+	x, err := exif.DecodeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken, _, ok := x.DateTimeOriginal()
+	if !ok {
+		t.Fatalf("%s has no capture time", path)
+	}
+	return taken
+}
+
+func TestShiftTimesWrite(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	dir := t.TempDir()
+	taken := time.Date(2019, 5, 1, 10, 20, 30, 0, time.FixedZone("", 8*3600))
+	path := filepath.Join(dir, "a.jpg")
+	writeTestJPEG(t, path, taken)
+	id := insertTestFoto(t, db, path, "")
+	if err := refreshFoto(db, path, "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := shiftTimes(db, TimeSelection{Ids: []int32{id}}, time.Hour, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Fotos) != 1 || !result.Fotos[0].Written || result.Fotos[0].To != "2019-05-01T11:20:30+08:00" {
+		t.Fatalf("result = %+v", result)
+	}
+	if got := fileTaken(t, path); !got.Equal(taken.Add(time.Hour)) {
+		t.Errorf("file taken at %v, want %v", got, taken.Add(time.Hour))
+	}
+	writes, err := fileWrites(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 1 {
+		t.Fatalf("%d journaled writes, want 1", len(writes))
+	}
+	foto, err := NewSqlStore(db).Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foto.TakenAt != "2019-05-01T11:20:30+08:00" || foto.TakenAtOriginal != "2019-05-01T10:20:30+08:00" {
+		t.Errorf("taken at %s, originally %s", foto.TakenAt, foto.TakenAtOriginal)
+	}
+	var hash string
+	var size int64
+	if err := db.QueryRow("SELECT hash, size FROM fotos WHERE id = ?", id).Scan(&hash, &size); err != nil {
+		t.Fatal(err)
+	}
+	if hash == "" || size == 0 {
+		t.Errorf("row not refreshed after the write: hash %q, size %d", hash, size)
+	}
+
+	if _, err := undoShift(db, TimeSelection{Ids: []int32{id}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileTaken(t, path); !got.Equal(taken) {
+		t.Errorf("file taken at %v after undo, want %v", got, taken)
+	}
+	if foto, err = NewSqlStore(db).Get(id); err != nil {
+		t.Fatal(err)
+	}
+	if foto.TakenAt != "2019-05-01T10:20:30+08:00" || foto.TakenAtOriginal != "" {
+		t.Errorf("after undo taken at %s, originally %s", foto.TakenAt, foto.TakenAtOriginal)
+	}
+}
+
+func TestShiftTimesAllOrNothing(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	dir := t.TempDir()
+	var ids []int32
+	for i, taken := range []time.Time{
+		time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 0, 0, 0, time.UTC),
+	} {
+		path := filepath.Join(dir, string('a'+rune(i))+".jpg")
+		writeTestJPEG(t, path, time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC))
+		id := insertTestFoto(t, db, path, "")
+		if _, err := db.Exec("UPDATE fotos SET taken_at = ? WHERE id = ?", taken, id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	if _, err := shiftTimes(db, TimeSelection{Ids: ids}, 2*time.Hour, true, false); err == nil {
+		t.Fatal("shift past the year 9999 succeeded")
+	}
+	var shifted, writes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM fotos WHERE taken_at_original IS NOT NULL").Scan(&shifted); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM file_writes").Scan(&writes); err != nil {
+		t.Fatal(err)
+	}
+	if shifted != 0 || writes != 0 {
+		t.Errorf("failed shift changed %d rows and wrote %d files", shifted, writes)
+	}
+
+	result, err := shiftTimes(db, TimeSelection{Ids: ids[:1]}, 2*time.Hour, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Applied || len(result.Fotos) != 1 || result.Fotos[0].Written {
+		t.Errorf("dry run = %+v", result)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM file_writes").Scan(&writes); err != nil || writes != 0 {
+		t.Errorf("dry run wrote %d files, %v", writes, err)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"exif"
+	"filescanner"
+	"jpegseg"
+	"xmp"
+)
+
+// FileEdit holds the metadata to write into a JPEG file; fields left nil
+// are not touched. Capture time and position go into EXIF, rating and
+// keywords into the embedded XMP, and the caption into both.
+type FileEdit struct {
+	TakenAt        *string       `json:"takenAt,omitempty"`
+	Location       *FileLocation `json:"location,omitempty"`
+	RemoveLocation bool          `json:"removeLocation,omitempty"`
+	Caption        *string       `json:"caption,omitempty"`
+	Rating         *int          `json:"rating,omitempty"`
+	Keywords       *[]string     `json:"keywords,omitempty"`
+}
+
+type FileLocation struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// EditError is an edit that cannot be written, with a message for the
+// client.
+type EditError struct {
+	Message string
+}
+
+func (e *EditError) Error() string {
+	return e.Message
+}
+
+var (
+	errNotJPEG         = &EditError{"Only JPEG files can be written."}
+	errFileChanged     = errors.New("the file changed since it was written")
+	errAlreadyReverted = errors.New("the write was reverted already")
+)
+
+// FileWrite is a journal entry of a write into a file. The journal keeps
+// the segments the file had before, so the write can be reverted.
+type FileWrite struct {
+	Id         int64      `json:"id"`
+	FotoId     int32      `json:"fotoId"`
+	Path       string     `json:"path"`
+	WrittenAt  time.Time  `json:"writtenAt"`
+	Changes    FileEdit   `json:"changes"`
+	RevertedAt *time.Time `json:"revertedAt,omitempty"`
+}
+
+// WriteResult is a write into a file with the foto as it is after it.
+type WriteResult struct {
+	Write FileWrite `json:"write"`
+	Foto  *Foto     `json:"foto"`
+}
+
+// fileWriteMu keeps writes from interleaving, as each one reads a file and
+// replaces it.
+var fileWriteMu sync.Mutex
+
+func (edit FileEdit) touchesExif() bool {
+	return edit.TakenAt != nil || edit.Location != nil || edit.RemoveLocation || edit.Caption != nil
+}
+
+func (edit FileEdit) touchesXMP() bool {
+	return edit.Caption != nil || edit.Rating != nil || edit.Keywords != nil
+}
+
+// parse validates the edit and returns its capture time, if any.
+func (edit FileEdit) parse() (taken time.Time, hasOffset bool, err error) {
+	if !edit.touchesExif() && !edit.touchesXMP() {
+		return taken, false, &EditError{"Nothing to write."}
+	}
+	if edit.TakenAt != nil {
+		if t, err := time.Parse(takenOffsetLayout, *edit.TakenAt); err == nil {
+			taken, hasOffset = t, true
+		} else if taken, err = time.ParseInLocation(takenLayout, *edit.TakenAt, time.Local); err != nil {
+			return taken, false, &EditError{"Expected takenAt such as 2017-05-01T10:20:30+08:00."}
+		}
+	}
+	if l := edit.Location; l != nil && (l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180) {
+		return taken, false, &EditError{"Expected latitude from -90 to 90 and longitude from -180 to 180."}
+	}
+	if edit.Rating != nil && (*edit.Rating < -1 || *edit.Rating > 5) {
+		return taken, false, &EditError{"Expected rating from -1 (rejected) to 5."}
+	}
+	return taken, hasOffset, nil
+}
+
+// insertSegment adds s after the leading APP0 and EXIF segments, where
+// readers look for metadata.
+func insertSegment(segments []jpegseg.Segment, s jpegseg.Segment) []jpegseg.Segment {
+	i := 0
+	for i < len(segments) && (segments[i].Marker == jpegseg.APP0 || exif.FindSegment(segments[i:i+1]) != nil) {
+		i++
+	}
+	segments = append(segments, jpegseg.Segment{})
+	copy(segments[i+1:], segments[i:])
+	segments[i] = s
+	return segments
+}
+
+// editSegments applies edit to the metadata segments of a JPEG file.
+func editSegments(segments []jpegseg.Segment, edit FileEdit, taken time.Time, hasOffset bool) ([]jpegseg.Segment, error) {
+	if edit.touchesExif() {
+		var tiff []byte
+		segment := exif.FindSegment(segments)
+		if segment != nil {
+			tiff = exif.SegmentTIFF(segment)
+		}
+		editor, err := exif.NewEditor(tiff)
+		if err != nil {
+			return nil, err
+		}
+		if edit.TakenAt != nil {
+			editor.SetDateTimeOriginal(taken, hasOffset)
+		}
+		if edit.RemoveLocation {
+			editor.RemoveLocation()
+		}
+		if l := edit.Location; l != nil {
+			loc := exif.Location{Latitude: l.Latitude, Longitude: l.Longitude}
+			if l.Altitude != nil {
+				loc.Altitude, loc.HasAltitude = *l.Altitude, true
+			}
+			editor.SetLocation(loc)
+		}
+		if edit.Caption != nil {
+			if caption := strings.TrimSpace(*edit.Caption); caption != "" {
+				editor.SetASCII(exif.MainIFD, exif.TagImageDescription, caption)
+			} else {
+				editor.Remove(exif.MainIFD, exif.TagImageDescription)
+			}
+		}
+		if tiff, err = editor.Bytes(); err != nil {
+			return nil, err
+		}
+		if segment != nil {
+			segment.Data = exif.EmbedTIFF(tiff)
+		} else {
+			segments = insertSegment(segments, jpegseg.Segment{Marker: jpegseg.APP1, Data: exif.EmbedTIFF(tiff)})
+		}
+	}
+
+	if edit.touchesXMP() {
+		var packet []byte
+		var m xmp.Metadata
+		segment := xmp.FindSegment(segments)
+		if segment != nil {
+			packet = xmp.FindPacket(segments)
+			var err error
+			if m, err = xmp.Read(packet); err != nil {
+				return nil, err
+			}
+		}
+		update := MetadataUpdate{Rating: edit.Rating, Keywords: edit.Keywords, Description: edit.Caption}
+		if err := update.apply(&m); err != nil {
+			return nil, err
+		}
+		packet, err := xmp.UpdatePacket(packet, m)
+		if err != nil {
+			return nil, err
+		}
+		if segment != nil {
+			segment.Data = xmp.EmbedPacket(packet)
+		} else {
+			segments = insertSegment(segments, jpegseg.Segment{Marker: jpegseg.APP1, Data: xmp.EmbedPacket(packet)})
+		}
+	}
+	return segments, nil
+}
+
+// replaceFile writes data to path in one rename, keeping its permissions.
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// refreshFoto brings the row of a file boonfoto has just written up to
+// date, so that scans do not take it for modified, and reads its metadata
+// again. A capture time written into the file replaces a shifted one.
+func refreshFoto(db *sql.DB, path string, root string, dropShift bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	format, err := filescanner.Detect(path)
+	if err != nil {
+		return err
+	}
+	hash, err := filescanner.HashFile(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	f := filescanner.File{Path: path, Size: info.Size(), ModTime: info.ModTime(), Format: format, Hash: hash}
+	if sidecar, sidecarInfo := filescanner.FindSidecar(path); sidecarInfo != nil {
+		f.Sidecar, f.SidecarModTime = sidecar, sidecarInfo.ModTime()
+	}
+
+	query := "UPDATE fotos SET mtime = ?, size = ?, hash = ? WHERE path = ?"
+	if dropShift {
+		query = "UPDATE fotos SET mtime = ?, size = ?, hash = ?, taken_at_original = NULL, taken_written = NULL WHERE path = ?"
+	}
+	if _, err := db.Exec(query, f.ModTime.UTC(), f.Size, f.Hash, path); err != nil {
+		return err
+	}
+	return NewLivePopulator(db, RootConfig{Name: root}).queueMetadata(f)
+}
+
+// writeBack writes edit into the JPEG file of foto id without touching
+// the image data, and journals the segments it replaced. ok is false when
+// there is no such foto.
+func writeBack(db *sql.DB, id int32, edit FileEdit) (w FileWrite, ok bool, err error) {
+	fileWriteMu.Lock()
+	defer fileWriteMu.Unlock()
+
+	var path, format, root string
+	err = db.QueryRow("SELECT path, COALESCE(format, ''), COALESCE(root, '') FROM fotos WHERE id = ?", id).Scan(&path, &format, &root)
+	if err == sql.ErrNoRows {
+		return w, false, nil
+	}
+	if err != nil {
+		return w, false, err
+	}
+	if format != "jpeg" {
+		return w, true, errNotJPEG
+	}
+	taken, hasOffset, err := edit.parse()
+	if err != nil {
+		return w, true, err
+	}
+
+	if w, err = writeEdit(db, id, path, edit, taken, hasOffset); err != nil {
+		return w, true, err
+	}
+	return w, true, refreshFoto(db, path, root, edit.TakenAt != nil)
+}
+
+// writeEdit writes edit into the JPEG file at path of foto id without
+// touching the image data, and journals the segments it replaced. The
+// caller holds fileWriteMu and brings the row up to date afterwards.
+func writeEdit(db *sql.DB, id int32, path string, edit FileEdit, taken time.Time, hasOffset bool) (w FileWrite, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return w, err
+	}
+	segments, image, err := jpegseg.Split(data)
+	if err != nil {
+		return w, err
+	}
+	header := data[:len(data)-len(image)]
+	if segments, err = editSegments(segments, edit, taken, hasOffset); err != nil {
+		return w, err
+	}
+	written, err := jpegseg.Join(segments, image)
+	if err == jpegseg.ErrTooLarge {
+		return w, &EditError{"The metadata does not fit into the file."}
+	}
+	if err != nil {
+		return w, err
+	}
+
+	changes, err := json.Marshal(edit)
+	if err != nil {
+		return w, err
+	}
+	w = FileWrite{FotoId: id, Path: path, WrittenAt: time.Now().UTC(), Changes: edit}
+	// Journal first, so that a crash between the two leaves a revertible
+	// entry rather than an unrecorded change.
+	res, err := db.Exec("INSERT INTO file_writes (foto_id, path, written_at, changes, header, written_sum) VALUES (?, ?, ?, ?, ?, ?)",
+		id, path, w.WrittenAt, string(changes), header, checksum(written))
+	if err != nil {
+		return w, err
+	}
+	if w.Id, err = res.LastInsertId(); err != nil {
+		return w, err
+	}
+	if err := replaceFile(path, written); err != nil {
+		db.Exec("DELETE FROM file_writes WHERE id = ?", w.Id)
+		return w, err
+	}
+	return w, nil
+}
+
+// revertWrite puts back the segments a write replaced. Only a file still
+// as written can be reverted, so writes are reverted newest first. ok is
+// false when there is no such write.
+func revertWrite(db *sql.DB, writeId int64) (w FileWrite, ok bool, err error) {
+	fileWriteMu.Lock()
+	defer fileWriteMu.Unlock()
+
+	var changes, sum, path, root string
+	var header []byte
+	var revertedAt NullTime
+	err = db.QueryRow(`SELECT w.id, w.foto_id, w.path, w.written_at, w.changes, w.header, w.written_sum, w.reverted_at,
+		f.path, COALESCE(f.root, '') FROM file_writes w JOIN fotos f ON f.id = w.foto_id WHERE w.id = ?`, writeId).
+		Scan(&w.Id, &w.FotoId, &w.Path, &w.WrittenAt, &changes, &header, &sum, &revertedAt, &path, &root)
+	if err == sql.ErrNoRows {
+		return w, false, nil
+	}
+	if err != nil {
+		return w, false, err
+	}
+	if err := json.Unmarshal([]byte(changes), &w.Changes); err != nil {
+		return w, true, err
+	}
+	if revertedAt.Valid {
+		w.RevertedAt = &revertedAt.Time
+		return w, true, errAlreadyReverted
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return w, true, err
+	}
+	if checksum(data) != sum {
+		return w, true, errFileChanged
+	}
+	_, image, err := jpegseg.Split(data)
+	if err != nil {
+		return w, true, err
+	}
+	if err := replaceFile(path, append(header, image...)); err != nil {
+		return w, true, err
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.Exec("UPDATE file_writes SET reverted_at = ? WHERE id = ?", now, w.Id); err != nil {
+		return w, true, err
+	}
+	w.RevertedAt = &now
+	return w, true, refreshFoto(db, path, root, false)
+}
+
+// fileWrites returns the journal of foto id, newest first.
+func fileWrites(db *sql.DB, id int32) ([]FileWrite, error) {
+	rows, err := db.Query(`SELECT id, foto_id, path, written_at, changes, reverted_at FROM file_writes
+		WHERE foto_id = ? ORDER BY id DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	writes := []FileWrite{}
+	for rows.Next() {
+		var w FileWrite
+		var changes string
+		var revertedAt NullTime
+		if err := rows.Scan(&w.Id, &w.FotoId, &w.Path, &w.WrittenAt, &changes, &revertedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &w.Changes); err != nil {
+			return nil, err
+		}
+		if revertedAt.Valid {
+			w.RevertedAt = &revertedAt.Time
+		}
+		writes = append(writes, w)
+	}
+	return writes, rows.Err()
+}
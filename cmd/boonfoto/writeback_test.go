@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"exif"
+	"jpegseg"
+	"xmp"
+)
+
+func TestWriteBackRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestJPEG(t, path, time.Date(2019, 5, 1, 10, 20, 30, 0, time.FixedZone("", 8*3600)))
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := insertTestFoto(t, db, path, "")
+
+	takenAt, caption, rating, keywords := "2020-02-03T04:05:06-05:00", "Harbour bridge", 4, []string{"bridge", "Sydney"}
+	altitude := 12.5
+	edit := FileEdit{
+		TakenAt:  &takenAt,
+		Location: &FileLocation{Latitude: -33.8568, Longitude: 151.2153, Altitude: &altitude},
+		Caption:  &caption,
+		Rating:   &rating,
+		Keywords: &keywords,
+	}
+	w, ok, err := writeBack(db, id, edit)
+	if err != nil || !ok {
+		t.Fatalf("writeBack = %v, %v", ok, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, image, err := jpegseg.Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, testImage) {
+		t.Errorf("image data = % x, want % x", image, testImage)
+	}
+
+	x, err := exif.Decode(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken, hasOffset, ok := x.DateTimeOriginal()
+	if !ok || !hasOffset || taken.Format(takenOffsetLayout) != takenAt {
+		t.Errorf("DateTimeOriginal = %v, %v, %v, want %s", taken, hasOffset, ok, takenAt)
+	}
+	loc, ok := x.Location()
+	if !ok || math.Abs(loc.Latitude+33.8568) > 1e-6 || math.Abs(loc.Longitude-151.2153) > 1e-6 || loc.Altitude != altitude {
+		t.Errorf("Location = %+v, %v", loc, ok)
+	}
+	if got := x.Description(); got != caption {
+		t.Errorf("EXIF description = %q, want %q", got, caption)
+	}
+
+	m, err := xmp.Read(xmp.FindPacket(segments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Rating != rating || m.Description != caption || strings.Join(m.Keywords, ",") != "bridge,Sydney" {
+		t.Errorf("XMP = %+v", m)
+	}
+
+	var size int64
+	var hash string
+	if err := db.QueryRow("SELECT size, hash FROM fotos WHERE id = ?", id).Scan(&size, &hash); err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || hash == "" {
+		t.Errorf("row not refreshed: size %d, hash %q", size, hash)
+	}
+
+	if _, ok, err := revertWrite(db, w.Id); err != nil || !ok {
+		t.Fatalf("revertWrite = %v, %v", ok, err)
+	}
+	reverted, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reverted, original) {
+		t.Error("revert did not restore the original bytes")
+	}
+	if _, _, err := revertWrite(db, w.Id); err != errAlreadyReverted {
+		t.Errorf("second revert = %v, want errAlreadyReverted", err)
+	}
+	if _, ok, err := revertWrite(db, w.Id+1); ok || err != nil {
+		t.Errorf("revert of a missing write = %v, %v", ok, err)
+	}
+}
+
+func TestRevertChangedFile(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestJPEG(t, path, time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC))
+	id := insertTestFoto(t, db, path, "")
+
+	rating := 3
+	w, _, err := writeBack(db, id, FileEdit{Rating: &rating})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestJPEG(t, path, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	changed, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := revertWrite(db, w.Id); err != errFileChanged {
+		t.Errorf("revertWrite = %v, want errFileChanged", err)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, changed) {
+		t.Error("refused revert changed the file")
+	}
+}
+
+// TestWriteBackTooLarge writes captions until the EXIF segment, which grows
+// with every edit, no longer fits into a JPEG segment.
+func TestWriteBackTooLarge(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestJPEG(t, path, time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC))
+	id := insertTestFoto(t, db, path, "")
+
+	for i := 0; ; i++ {
+		if i == 10 {
+			t.Fatal("edits kept fitting")
+		}
+		before, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caption := strings.Repeat(string('a'+rune(i)), 20000)
+		_, _, err = writeBack(db, id, FileEdit{Caption: &caption})
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*EditError); !ok {
+			t.Fatalf("edit %d: %v, want an EditError", i, err)
+		}
+		after, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(after, before) {
+			t.Error("failed write changed the file")
+		}
+		var writes int
+		if err := db.QueryRow("SELECT COUNT(*) FROM file_writes").Scan(&writes); err != nil {
+			t.Fatal(err)
+		}
+		if writes != i {
+			t.Errorf("%d journal entries after %d writes", writes, i)
+		}
+		if _, image, err := jpegseg.Split(after); err != nil || !bytes.Equal(image, testImage) {
+			t.Errorf("image data lost: %v", err)
+		}
+		break
+	}
+}
@@ -0,0 +1,136 @@
+// Package bktree indexes 64-bit hashes, such as perceptual hashes, by
+// Hamming distance in a Burkhard-Keller tree.
+package bktree
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// Distance returns the number of bits in which a and b differ.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+type Match struct {
+	Id       int64 `json:"id"`
+	Distance int   `json:"distance"`
+}
+
+type node struct {
+	hash     uint64
+	ids      []int64
+	children map[int]*node
+}
+
+// Tree is a BK-tree of hashes, each carrying the ids stored under it. It
+// is safe for concurrent use.
+type Tree struct {
+	mu   sync.RWMutex
+	root *node
+	size int
+}
+
+func New() *Tree {
+	return &Tree{}
+}
+
+// Len returns the number of ids in the tree.
+func (t *Tree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.size
+}
+
+func (t *Tree) Add(hash uint64, id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.size++
+	if t.root == nil {
+		t.root = &node{hash: hash, ids: []int64{id}}
+		return
+	}
+
+	n := t.root
+	for {
+		d := Distance(hash, n.hash)
+		if d == 0 {
+			n.ids = append(n.ids, id)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*node)
+			}
+			n.children[d] = &node{hash: hash, ids: []int64{id}}
+			return
+		}
+		n = child
+	}
+}
+
+// Remove drops id from under hash. The node stays in place, as the tree
+// is routed through it, and is reused when the hash is added again.
+func (t *Tree) Remove(hash uint64, id int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for n := t.root; n != nil; {
+		d := Distance(hash, n.hash)
+		if d == 0 {
+			for i, other := range n.ids {
+				if other == id {
+					n.ids = append(n.ids[:i], n.ids[i+1:]...)
+					t.size--
+					return true
+				}
+			}
+			return false
+		}
+		n = n.children[d]
+	}
+	return false
+}
+
+// Search returns the ids stored under hashes at most maxDistance bits
+// away from hash, closest first.
+func (t *Tree) Search(hash uint64, maxDistance int) []Match {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var matches []Match
+	stack := []*node{}
+	if t.root != nil {
+		stack = append(stack, t.root)
+	}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := Distance(hash, n.hash)
+		if d <= maxDistance {
+			for _, id := range n.ids {
+				matches = append(matches, Match{id, d})
+			}
+		}
+		// By the triangle inequality, only children whose edge lies
+		// within maxDistance of d can hold matches.
+		for edge, child := range n.children {
+			if edge >= d-maxDistance && edge <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Id < matches[j].Id
+	})
+	return matches
+}
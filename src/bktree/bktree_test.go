@@ -0,0 +1,129 @@
+package bktree
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, ^uint64(0), 64},
+		{0x8000000000000001, 1, 1},
+	}
+	for _, test := range tests {
+		if got := Distance(test.a, test.b); got != test.want {
+			t.Errorf("Distance(%x, %x) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tree := New()
+	if got := tree.Search(0, 64); len(got) != 0 {
+		t.Errorf("Search of an empty tree = %v", got)
+	}
+	tree.Add(0x00, 1)
+	tree.Add(0x01, 2)
+	tree.Add(0x03, 3)
+	tree.Add(0x01, 4)
+	tree.Add(0xff, 5)
+
+	tests := []struct {
+		hash        uint64
+		maxDistance int
+		want        []Match
+	}{
+		{0x00, 0, []Match{{1, 0}}},
+		{0x00, 1, []Match{{1, 0}, {2, 1}, {4, 1}}},
+		{0x01, 1, []Match{{2, 0}, {4, 0}, {1, 1}, {3, 1}}},
+		{0x07, 2, []Match{{3, 1}, {2, 2}, {4, 2}}},
+		{0xf0, 3, nil},
+		{0xf0, 64, []Match{{1, 4}, {5, 4}, {2, 5}, {4, 5}, {3, 6}}},
+	}
+	for _, test := range tests {
+		if got := tree.Search(test.hash, test.maxDistance); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Search(%x, %d) = %v, want %v", test.hash, test.maxDistance, got, test.want)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tree := New()
+	tree.Add(0x00, 1)
+	tree.Add(0x01, 2)
+	tree.Add(0x03, 3)
+	if tree.Len() != 3 {
+		t.Fatalf("Len = %d", tree.Len())
+	}
+	if tree.Remove(0x01, 1) || tree.Remove(0x02, 2) {
+		t.Error("Remove of an id under another hash succeeded")
+	}
+	// Removing the node on the way to 0x03 must not cut it off.
+	if !tree.Remove(0x01, 2) {
+		t.Error("Remove failed")
+	}
+	if tree.Remove(0x01, 2) {
+		t.Error("second Remove succeeded")
+	}
+	if got := tree.Search(0x03, 0); !reflect.DeepEqual(got, []Match{{3, 0}}) {
+		t.Errorf("Search after Remove = %v", got)
+	}
+	tree.Add(0x01, 4)
+	if got := tree.Search(0x01, 0); !reflect.DeepEqual(got, []Match{{4, 0}}) {
+		t.Errorf("Search after adding again = %v", got)
+	}
+	if tree.Len() != 3 {
+		t.Errorf("Len = %d, want 3", tree.Len())
+	}
+}
+
+// TestSearchBruteForce checks the pruning against a linear scan.
+func TestSearchBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree := New()
+	hashes := make(map[int64]uint64)
+	base := r.Uint64()
+	for id := int64(0); id < 2000; id++ {
+		// Clustered hashes, like those of similar images.
+		hash := base
+		for i := r.Intn(20); i > 0; i-- {
+			hash ^= 1 << uint(r.Intn(64))
+		}
+		if id%5 == 0 {
+			hash = r.Uint64()
+		}
+		hashes[id] = hash
+		tree.Add(hash, id)
+	}
+	for i := 0; i < 50; i++ {
+		query := base ^ 1<<uint(r.Intn(64))
+		if i%2 == 0 {
+			query = r.Uint64()
+		}
+		for _, maxDistance := range []int{0, 4, 10, 24} {
+			var want []Match
+			for id, hash := range hashes {
+				if d := Distance(query, hash); d <= maxDistance {
+					want = append(want, Match{id, d})
+				}
+			}
+			sort.Slice(want, func(i, j int) bool {
+				if want[i].Distance != want[j].Distance {
+					return want[i].Distance < want[j].Distance
+				}
+				return want[i].Id < want[j].Id
+			})
+			if got := tree.Search(query, maxDistance); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Search(%x, %d) found %d, want %d", query, maxDistance, len(got), len(want))
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package exif
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Directory names the IFDs an Editor can change.
+type Directory int
+
+const (
+	MainIFD Directory = iota
+	SubIFD
+	GPSIFD
+)
+
+var ErrTooLarge = errors.New("exif: TIFF structure too large")
+
+// Editor changes tags of a TIFF structure without moving anything in it.
+// Every IFD with a change is written anew after the end of the structure
+// and the pointer to it redirected; values, maker notes and thumbnails stay
+// where they were, so offsets into them remain valid. The old IFDs are left
+// behind as unused bytes.
+type Editor struct {
+	order   binary.ByteOrder
+	data    []byte
+	changes [3]map[uint16]*field
+}
+
+// field is a raw value to write, or a removal when value is nil.
+type field struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// rawEntry is a 12-byte IFD entry as found in the structure.
+type rawEntry struct {
+	tag uint16
+	raw []byte
+}
+
+// NewEditor returns an editor for the TIFF structure tiff, as found after
+// the "Exif\0\0" header of a JPEG APP1 segment. A nil tiff starts an empty
+// structure.
+func NewEditor(tiff []byte) (*Editor, error) {
+	e := &Editor{}
+	for i := range e.changes {
+		e.changes[i] = make(map[uint16]*field)
+	}
+	if tiff == nil {
+		e.order = binary.LittleEndian
+		// Header and an IFD0 without entries.
+		e.data = []byte{'I', 'I', 0x2a, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		return e, nil
+	}
+	if len(tiff) < 8 || !isTIFF(tiff[:4]) {
+		return nil, ErrInvalid
+	}
+	if tiff[0] == 'I' {
+		e.order = binary.LittleEndian
+	} else {
+		e.order = binary.BigEndian
+	}
+	e.data = append([]byte(nil), tiff...)
+	return e, nil
+}
+
+func (e *Editor) set(dir Directory, tag uint16, typ uint16, count uint32, value []byte) {
+	e.changes[dir][tag] = &field{typ, count, value}
+}
+
+// Remove deletes tag from the IFD, if present.
+func (e *Editor) Remove(dir Directory, tag uint16) {
+	e.changes[dir][tag] = &field{}
+}
+
+// SetASCII sets an ASCII tag.
+func (e *Editor) SetASCII(dir Directory, tag uint16, s string) {
+	value := append([]byte(s), 0)
+	e.set(dir, tag, TypeASCII, uint32(len(value)), value)
+}
+
+// SetBytes sets a BYTE tag.
+func (e *Editor) SetBytes(dir Directory, tag uint16, b []byte) {
+	e.set(dir, tag, TypeByte, uint32(len(b)), append([]byte(nil), b...))
+}
+
+// SetRationals sets a RATIONAL tag from numerator, denominator pairs.
+func (e *Editor) SetRationals(dir Directory, tag uint16, values [][2]uint32) {
+	value := make([]byte, 8*len(values))
+	for i, v := range values {
+		e.order.PutUint32(value[8*i:], v[0])
+		e.order.PutUint32(value[8*i+4:], v[1])
+	}
+	e.set(dir, tag, TypeRational, uint32(len(values)), value)
+}
+
+// SetDateTimeOriginal sets the capture time to the wall clock time of t,
+// and its UTC offset when withOffset is set; otherwise a recorded offset
+// is removed, as it may no longer apply.
+func (e *Editor) SetDateTimeOriginal(t time.Time, withOffset bool) {
+	e.SetASCII(SubIFD, TagDateTimeOriginal, t.Format(DateTimeLayout))
+	if withOffset {
+		e.SetASCII(SubIFD, TagOffsetTimeOriginal, t.Format("-07:00"))
+	} else {
+		e.Remove(SubIFD, TagOffsetTimeOriginal)
+	}
+}
+
+// SetLocation records loc in the GPS IFD.
+func (e *Editor) SetLocation(loc Location) {
+	e.SetBytes(GPSIFD, TagGPSVersionID, []byte{2, 3, 0, 0})
+	latRef, lonRef := "N", "E"
+	if loc.Latitude < 0 {
+		latRef = "S"
+	}
+	if loc.Longitude < 0 {
+		lonRef = "W"
+	}
+	e.SetASCII(GPSIFD, TagGPSLatitudeRef, latRef)
+	e.SetRationals(GPSIFD, TagGPSLatitude, degrees(math.Abs(loc.Latitude)))
+	e.SetASCII(GPSIFD, TagGPSLongitudeRef, lonRef)
+	e.SetRationals(GPSIFD, TagGPSLongitude, degrees(math.Abs(loc.Longitude)))
+	if loc.HasAltitude {
+		ref := byte(0)
+		if loc.Altitude < 0 {
+			ref = 1
+		}
+		e.SetBytes(GPSIFD, TagGPSAltitudeRef, []byte{ref})
+		e.SetRationals(GPSIFD, TagGPSAltitude, [][2]uint32{{uint32(math.Round(math.Abs(loc.Altitude) * 100)), 100}})
+	} else {
+		e.Remove(GPSIFD, TagGPSAltitudeRef)
+		e.Remove(GPSIFD, TagGPSAltitude)
+	}
+}
+
+// RemoveLocation deletes the recorded position.
+func (e *Editor) RemoveLocation() {
+	for _, tag := range []uint16{TagGPSLatitudeRef, TagGPSLatitude, TagGPSLongitudeRef, TagGPSLongitude, TagGPSAltitudeRef, TagGPSAltitude} {
+		e.Remove(GPSIFD, tag)
+	}
+}
+
+// degrees splits a coordinate into degrees, minutes and seconds to a
+// ten-thousandth of a second.
+func degrees(value float64) [][2]uint32 {
+	d := math.Floor(value)
+	m := math.Floor((value - d) * 60)
+	s := math.Round(((value-d)*60 - m) * 60 * 10000)
+	return [][2]uint32{{uint32(d), 1}, {uint32(m), 1}, {uint32(s), 10000}}
+}
+
+// Bytes returns the edited structure. It is meant to be called once.
+func (e *Editor) Bytes() ([]byte, error) {
+	mainOffset := int64(e.order.Uint32(e.data[4:]))
+	main, next, err := e.readRaw(mainOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	mainChanged := len(e.changes[MainIFD]) > 0
+	for _, sub := range []struct {
+		dir     Directory
+		pointer uint16
+	}{{SubIFD, TagExifIFD}, {GPSIFD, TagGPSIFD}} {
+		if len(e.changes[sub.dir]) == 0 {
+			continue
+		}
+		var entries []rawEntry
+		if i := findRaw(main, sub.pointer); i >= 0 {
+			if entries, _, err = e.readRaw(int64(e.order.Uint32(main[i].raw[8:]))); err != nil {
+				return nil, err
+			}
+		}
+		entries = e.apply(entries, e.changes[sub.dir])
+		if len(entries) == 0 {
+			e.changes[MainIFD][sub.pointer] = &field{}
+		} else {
+			offset, err := e.appendIFD(entries, 0)
+			if err != nil {
+				return nil, err
+			}
+			pointer := make([]byte, 4)
+			e.order.PutUint32(pointer, offset)
+			e.changes[MainIFD][sub.pointer] = &field{TypeLong, 1, pointer}
+		}
+		mainChanged = true
+	}
+	if !mainChanged {
+		return e.data, nil
+	}
+
+	offset, err := e.appendIFD(e.apply(main, e.changes[MainIFD]), uint32(next))
+	if err != nil {
+		return nil, err
+	}
+	e.order.PutUint32(e.data[4:], offset)
+	return e.data, nil
+}
+
+// readRaw returns the entries of the IFD at offset and the offset of the
+// next IFD.
+func (e *Editor) readRaw(offset int64) ([]rawEntry, int64, error) {
+	if offset < 8 || offset+2 > int64(len(e.data)) {
+		return nil, 0, ErrInvalid
+	}
+	count := int64(e.order.Uint16(e.data[offset:]))
+	end := offset + 2 + count*12 + 4
+	if count > maxEntries || end > int64(len(e.data)) {
+		return nil, 0, ErrInvalid
+	}
+	entries := make([]rawEntry, count)
+	for i := range entries {
+		raw := e.data[offset+2+int64(i)*12 : offset+2+int64(i)*12+12]
+		entries[i] = rawEntry{e.order.Uint16(raw), append([]byte(nil), raw...)}
+	}
+	return entries, int64(e.order.Uint32(e.data[end-4:])), nil
+}
+
+func findRaw(entries []rawEntry, tag uint16) int {
+	for i, r := range entries {
+		if r.tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply returns entries with changes made, in tag order. Values that do
+// not fit into an entry are appended to the structure.
+func (e *Editor) apply(entries []rawEntry, changes map[uint16]*field) []rawEntry {
+	var result []rawEntry
+	for _, r := range entries {
+		if _, ok := changes[r.tag]; !ok {
+			result = append(result, r)
+		}
+	}
+	for tag, f := range changes {
+		if f.value == nil {
+			continue
+		}
+		raw := make([]byte, 12)
+		e.order.PutUint16(raw, tag)
+		e.order.PutUint16(raw[2:], f.typ)
+		e.order.PutUint32(raw[4:], f.count)
+		if len(f.value) <= 4 {
+			copy(raw[8:], f.value)
+		} else {
+			e.align()
+			e.order.PutUint32(raw[8:], uint32(len(e.data)))
+			e.data = append(e.data, f.value...)
+		}
+		result = append(result, rawEntry{tag, raw})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].tag < result[j].tag })
+	return result
+}
+
+// appendIFD writes an IFD after the end of the structure and returns its
+// offset.
+func (e *Editor) appendIFD(entries []rawEntry, next uint32) (uint32, error) {
+	e.align()
+	offset := len(e.data)
+	buf := make([]byte, 2, 2+12*len(entries)+4)
+	e.order.PutUint16(buf, uint16(len(entries)))
+	for _, r := range entries {
+		buf = append(buf, r.raw...)
+	}
+	buf = append(buf, 0, 0, 0, 0)
+	e.order.PutUint32(buf[len(buf)-4:], next)
+	e.data = append(e.data, buf...)
+	if len(e.data) > math.MaxUint32 {
+		return 0, ErrTooLarge
+	}
+	return uint32(offset), nil
+}
+
+// align pads the structure to a word boundary, where TIFF wants offsets.
+func (e *Editor) align() {
+	if len(e.data)%2 != 0 {
+		e.data = append(e.data, 0)
+	}
+}
@@ -0,0 +1,202 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+const (
+	tagMakerNote             = 0x927c
+	tagJPEGInterchangeFormat = 0x0201
+	tagJPEGInterchangeLength = 0x0202
+)
+
+var (
+	testLensData  = []byte("LENSDATA")
+	testThumbnail = []byte{0xff, 0xd8, 0x01, 0x02, 0x03, 0x04, 0xff, 0xd9}
+)
+
+// cameraTIFF returns a structure as cameras write it: a maker note that
+// points into the structure by absolute offset, and a thumbnail in IFD1.
+func cameraTIFF(order binary.ByteOrder) []byte {
+	b := newTIFFBuilder(order)
+	lens := b.blob(testLensData)
+	thumb := b.blob(testThumbnail)
+
+	note := append([]byte("Maker\x00"), 0, 0, 0, 0)
+	order.PutUint32(note[6:], lens)
+	sub := b.ifd([]testEntry{
+		b.ascii(TagDateTimeOriginal, "2019:05:01 10:20:30"),
+		b.undefined(tagMakerNote, note),
+	}, 0)
+	ifd1 := b.ifd([]testEntry{
+		b.long(tagJPEGInterchangeFormat, thumb),
+		b.long(tagJPEGInterchangeLength, uint32(len(testThumbnail))),
+	}, 0)
+	main := b.ifd([]testEntry{
+		b.ascii(TagMake, "Canon"),
+		b.long(TagExifIFD, sub),
+	}, ifd1)
+	return b.bytes(main)
+}
+
+func parseTIFF(t *testing.T, data []byte) *Exif {
+	x, err := Parse(bytes.NewReader(data), int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+// checkCameraData fails unless the maker note and thumbnail of cameraTIFF
+// still resolve in data.
+func checkCameraData(t *testing.T, x *Exif, data []byte) {
+	if got := x.Make(); got != "Canon" {
+		t.Errorf("Make = %q, want Canon", got)
+	}
+	note := x.Sub.Find(tagMakerNote)
+	if note == nil {
+		t.Fatal("maker note lost")
+	}
+	lens := int(x.Order.Uint32(note.Value[6:]))
+	if lens+len(testLensData) > len(data) || !bytes.Equal(data[lens:lens+len(testLensData)], testLensData) {
+		t.Errorf("maker note offset %d no longer points at its data", lens)
+	}
+	offset, length := x.Thumbnail.Find(tagJPEGInterchangeFormat), x.Thumbnail.Find(tagJPEGInterchangeLength)
+	if offset == nil || length == nil {
+		t.Fatal("thumbnail IFD lost")
+	}
+	start, end := int(offset.Uint(0)), int(offset.Uint(0)+length.Uint(0))
+	if end > len(data) || !bytes.Equal(data[start:end], testThumbnail) {
+		t.Errorf("thumbnail offset %d no longer points at the thumbnail", start)
+	}
+}
+
+func TestEditorRoundTrip(t *testing.T) {
+	taken := time.Date(2020, 2, 3, 4, 5, 6, 0, time.FixedZone("", -5*3600))
+	loc := Location{Latitude: -33.8568, Longitude: 151.2153, Altitude: -12.5, HasAltitude: true}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			original := cameraTIFF(order)
+			before := parseTIFF(t, original)
+			note := before.Sub.Find(tagMakerNote)
+
+			editor, err := NewEditor(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+			editor.SetASCII(MainIFD, TagImageDescription, "Harbour bridge")
+			editor.SetDateTimeOriginal(taken, true)
+			editor.SetLocation(loc)
+			data, err := editor.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data[8:len(original)], original[8:]) {
+				t.Error("bytes of the original structure changed")
+			}
+			x := parseTIFF(t, data)
+			if x.Order != order {
+				t.Errorf("byte order = %v, want %v", x.Order, order)
+			}
+			if got := x.Description(); got != "Harbour bridge" {
+				t.Errorf("Description = %q", got)
+			}
+			got, hasOffset, ok := x.DateTimeOriginal()
+			if !ok || !hasOffset || !got.Equal(taken) {
+				t.Errorf("DateTimeOriginal = %v, %v, %v, want %v", got, hasOffset, ok, taken)
+			}
+			gotLoc, ok := x.Location()
+			if !ok || math.Abs(gotLoc.Latitude-loc.Latitude) > 1e-6 || math.Abs(gotLoc.Longitude-loc.Longitude) > 1e-6 ||
+				!gotLoc.HasAltitude || gotLoc.Altitude != loc.Altitude {
+				t.Errorf("Location = %+v, %v, want %+v", gotLoc, ok, loc)
+			}
+			if e := x.Sub.Find(tagMakerNote); e == nil || e.Offset != note.Offset || !bytes.Equal(e.Value, note.Value) {
+				t.Error("maker note moved or changed")
+			}
+			checkCameraData(t, x, data)
+		})
+	}
+}
+
+func TestEditorRepeatedEdits(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			data := cameraTIFF(order)
+			for i, caption := range []string{"first", "second caption", "third"} {
+				editor, err := NewEditor(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				editor.SetASCII(MainIFD, TagImageDescription, caption)
+				if i == 1 {
+					editor.SetLocation(Location{Latitude: 1.5, Longitude: 103.8})
+				} else {
+					editor.RemoveLocation()
+				}
+				if data, err = editor.Bytes(); err != nil {
+					t.Fatal(err)
+				}
+
+				x := parseTIFF(t, data)
+				if got := x.Description(); got != caption {
+					t.Errorf("edit %d: Description = %q, want %q", i, got, caption)
+				}
+				if _, ok := x.Location(); ok != (i == 1) {
+					t.Errorf("edit %d: has location = %v", i, ok)
+				}
+				checkCameraData(t, x, data)
+			}
+		})
+	}
+}
+
+func TestEditorRemove(t *testing.T) {
+	editor, err := NewEditor(cameraTIFF(binary.BigEndian))
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor.Remove(SubIFD, TagDateTimeOriginal)
+	editor.Remove(SubIFD, tagMakerNote)
+	data, err := editor.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := parseTIFF(t, data)
+	if _, _, ok := x.DateTimeOriginal(); ok {
+		t.Error("DateTimeOriginal not removed")
+	}
+	if x.Sub != nil || x.Main.Find(TagExifIFD) != nil {
+		t.Errorf("empty sub-IFD kept: %v", x.Sub)
+	}
+}
+
+func TestEditorEmpty(t *testing.T) {
+	editor, err := NewEditor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Date(2021, 7, 8, 9, 10, 11, 0, time.UTC)
+	editor.SetDateTimeOriginal(taken, false)
+	data, err := editor.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, hasOffset, ok := parseTIFF(t, data).DateTimeOriginal()
+	if !ok || hasOffset || !got.Equal(taken) {
+		t.Errorf("DateTimeOriginal = %v, %v, %v, want %v", got, hasOffset, ok, taken)
+	}
+}
+
+func TestNewEditorInvalid(t *testing.T) {
+	for _, data := range [][]byte{{}, []byte("II*"), []byte("XX*\x00\x08\x00\x00\x00")} {
+		if _, err := NewEditor(data); err != ErrInvalid {
+			t.Errorf("NewEditor(%q) = %v, want ErrInvalid", data, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Package exif reads the TIFF structure that holds EXIF metadata, either
+// embedded in the APP1 segment of a JPEG file or making up a TIFF or
+// TIFF-based RAW file.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"jpegseg"
+)
+
+var (
+	ErrNoExif  = errors.New("exif: no EXIF data")
+	ErrInvalid = errors.New("exif: invalid TIFF structure")
+)
+
+// Field types.
+const (
+	TypeByte      = 1
+	TypeASCII     = 2
+	TypeShort     = 3
+	TypeLong      = 4
+	TypeRational  = 5
+	TypeUndefined = 7
+	TypeSLong     = 9
+	TypeSRational = 10
+)
+
+var typeSizes = map[uint16]int{
+	TypeByte: 1, TypeASCII: 1, TypeShort: 2, TypeLong: 4, TypeRational: 8,
+	6: 1, TypeUndefined: 1, 8: 2, TypeSLong: 4, TypeSRational: 8, 11: 4, 12: 8,
+}
+
+const (
+	maxEntries   = 1000
+	maxValueSize = 1 << 20
+)
+
+// Entry is one tag of an IFD. Value holds the raw bytes in the byte order
+// of the structure and Offset their position from the TIFF header.
+type Entry struct {
+	Tag    uint16
+	Type   uint16
+	Count  uint32
+	Value  []byte
+	Offset int64
+
+	order binary.ByteOrder
+}
+
+type IFD []Entry
+
+func (ifd IFD) Find(tag uint16) *Entry {
+	for i := range ifd {
+		if ifd[i].Tag == tag {
+			return &ifd[i]
+		}
+	}
+	return nil
+}
+
+// Exif is a decoded TIFF structure. Main is IFD0, Sub the EXIF sub-IFD and
+// Thumbnail IFD1. Base is the position of the TIFF header in the file the
+// structure was read from.
+type Exif struct {
+	Order     binary.ByteOrder
+	Base      int64
+	Main      IFD
+	Sub       IFD
+	GPS       IFD
+	Thumbnail IFD
+}
+
+// DecodeFile reads the EXIF data of a JPEG, TIFF or TIFF-based RAW file.
+func DecodeFile(path string) (*Exif, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Decode(f, info.Size())
+}
+
+// Decode reads the EXIF data of a JPEG, TIFF or TIFF-based RAW file of
+// the given size.
+func Decode(r io.ReaderAt, size int64) (*Exif, error) {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return nil, ErrNoExif
+	}
+
+	if magic[0] == 0xff && magic[1] == jpegseg.SOI {
+		return decodeJPEG(io.NewSectionReader(r, 0, size))
+	}
+	if isTIFF(magic[:]) {
+		return Parse(r, size, 0)
+	}
+	return nil, ErrNoExif
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// FindSegment returns the APP1 segment holding EXIF data, or nil.
+func FindSegment(segments []jpegseg.Segment) *jpegseg.Segment {
+	for i := range segments {
+		if segments[i].Marker == jpegseg.APP1 && bytes.HasPrefix(segments[i].Data, exifHeader) {
+			return &segments[i]
+		}
+	}
+	return nil
+}
+
+// SegmentTIFF returns the TIFF structure in an APP1 segment found by
+// FindSegment.
+func SegmentTIFF(s *jpegseg.Segment) []byte {
+	return s.Data[len(exifHeader):]
+}
+
+// EmbedTIFF returns the payload of the APP1 segment that embeds tiff in a
+// JPEG file.
+func EmbedTIFF(tiff []byte) []byte {
+	return append(append([]byte(nil), exifHeader...), tiff...)
+}
+
+func decodeJPEG(r io.Reader) (*Exif, error) {
+	segments, err := jpegseg.ReadSegments(r, func(marker byte) bool {
+		return marker == jpegseg.APP1
+	})
+	segment := FindSegment(segments)
+	if segment == nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrNoExif
+	}
+
+	tiff := segment.Data[len(exifHeader):]
+	return Parse(bytes.NewReader(tiff), int64(len(tiff)), segment.Offset+int64(len(exifHeader)))
+}
+
+// isTIFF accepts the standard header as well as the variants used by
+// Olympus ORF and Panasonic RW2 files.
+func isTIFF(magic []byte) bool {
+	switch string(magic) {
+	case "II*\x00", "MM\x00*", "IIRO", "IIRS", "MMOR", "IIU\x00":
+		return true
+	}
+	return false
+}
+
+type parser struct {
+	r     io.ReaderAt
+	size  int64
+	order binary.ByteOrder
+	seen  map[int64]bool
+}
+
+// Parse reads a TIFF structure of the given size from r. base is recorded
+// as Exif.Base.
+func Parse(r io.ReaderAt, size int64, base int64) (*Exif, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil || !isTIFF(header[:4]) {
+		return nil, ErrInvalid
+	}
+
+	p := &parser{r: r, size: size, seen: make(map[int64]bool)}
+	if header[0] == 'I' {
+		p.order = binary.LittleEndian
+	} else {
+		p.order = binary.BigEndian
+	}
+
+	x := &Exif{Order: p.order, Base: base}
+	main, next, err := p.readIFD(int64(p.order.Uint32(header[4:])))
+	if err != nil {
+		return nil, err
+	}
+	x.Main = main
+
+	if next != 0 {
+		x.Thumbnail, _, _ = p.readIFD(next)
+	}
+	// Broken sub-IFDs only cost their own tags.
+	if e := main.Find(TagExifIFD); e != nil {
+		x.Sub, _, _ = p.readIFD(int64(e.Uint(0)))
+	}
+	if e := main.Find(TagGPSIFD); e != nil {
+		x.GPS, _, _ = p.readIFD(int64(e.Uint(0)))
+	}
+	return x, nil
+}
+
+func (p *parser) read(offset int64, n int) ([]byte, error) {
+	if offset < 0 || n < 0 || offset+int64(n) > p.size {
+		return nil, ErrInvalid
+	}
+	buf := make([]byte, n)
+	if _, err := p.r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readIFD returns the entries of the IFD at offset and the offset of the
+// next IFD in the chain.
+func (p *parser) readIFD(offset int64) (IFD, int64, error) {
+	if p.seen[offset] {
+		return nil, 0, fmt.Errorf("exif: IFD loop at offset %d", offset)
+	}
+	p.seen[offset] = true
+
+	buf, err := p.read(offset, 2)
+	if err != nil {
+		return nil, 0, err
+	}
+	count := int(p.order.Uint16(buf))
+	if count > maxEntries {
+		return nil, 0, ErrInvalid
+	}
+
+	buf, err = p.read(offset+2, count*12+4)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ifd := make(IFD, 0, count)
+	for i := 0; i < count; i++ {
+		raw := buf[i*12 : i*12+12]
+		e := Entry{
+			Tag:   p.order.Uint16(raw[0:]),
+			Type:  p.order.Uint16(raw[2:]),
+			Count: p.order.Uint32(raw[4:]),
+		}
+		size, ok := typeSizes[e.Type]
+		if !ok || int64(e.Count)*int64(size) > maxValueSize {
+			// Unknown types cannot be sized; skip rather than fail.
+			continue
+		}
+
+		n := int(e.Count) * size
+		if n <= 4 {
+			e.Offset = offset + 2 + int64(i*12) + 8
+			e.Value = append([]byte(nil), raw[8:8+n]...)
+		} else {
+			e.Offset = int64(p.order.Uint32(raw[8:]))
+			if e.Value, err = p.read(e.Offset, n); err != nil {
+				continue
+			}
+		}
+		e.order = p.order
+		ifd = append(ifd, e)
+	}
+
+	return ifd, int64(p.order.Uint32(buf[count*12:])), nil
+}
@@ -0,0 +1,323 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jpegseg"
+)
+
+// photoTIFF returns a structure with a capture time, its offset and a
+// position, in order.
+func photoTIFF(order binary.ByteOrder, offset string) []byte {
+	b := newTIFFBuilder(order)
+	subEntries := []testEntry{b.ascii(TagDateTimeOriginal, "2019:05:01 10:20:30")}
+	if offset != "" {
+		subEntries = append(subEntries, b.ascii(TagOffsetTimeOriginal, offset))
+	}
+	sub := b.ifd(subEntries, 0)
+	gps := b.ifd([]testEntry{
+		b.ascii(TagGPSLatitudeRef, "S"),
+		b.rationals(TagGPSLatitude, 33, 1, 51, 1, 246, 10),
+		b.ascii(TagGPSLongitudeRef, "E"),
+		b.rationals(TagGPSLongitude, 151, 1, 12, 1, 55, 1),
+	}, 0)
+	main := b.ifd([]testEntry{
+		b.ascii(TagMake, "Canon"),
+		b.short(TagOrientation, 6),
+		b.long(TagExifIFD, sub),
+		b.long(TagGPSIFD, gps),
+	}, 0)
+	return b.bytes(main)
+}
+
+func TestParse(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			data := photoTIFF(order, "+08:00")
+			x := parseTIFF(t, data)
+			if x.Order != order {
+				t.Errorf("Order = %v", x.Order)
+			}
+			if x.Make() != "Canon" || x.Orientation() != 6 {
+				t.Errorf("Make = %q, Orientation = %d", x.Make(), x.Orientation())
+			}
+			taken, hasOffset, ok := x.DateTimeOriginal()
+			want := time.Date(2019, 5, 1, 10, 20, 30, 0, time.FixedZone("", 8*3600))
+			if !ok || !hasOffset || !taken.Equal(want) {
+				t.Errorf("DateTimeOriginal = %v, %v, %v, want %v", taken, hasOffset, ok, want)
+			}
+			loc, ok := x.Location()
+			if !ok || math.Abs(loc.Latitude+(33+51.0/60+24.6/3600)) > 1e-9 || math.Abs(loc.Longitude-(151+12.0/60+55.0/3600)) > 1e-9 || loc.HasAltitude {
+				t.Errorf("Location = %+v, %v", loc, ok)
+			}
+		})
+	}
+}
+
+func TestParseBroken(t *testing.T) {
+	order := binary.ByteOrder(binary.BigEndian)
+	tests := []struct {
+		name string
+		tiff func() []byte
+		// err is the error of Parse; with none, main and sub are the
+		// number of entries read from IFD0 and the EXIF sub-IFD.
+		err       error
+		main, sub int
+	}{
+		{"empty", func() []byte { return nil }, ErrInvalid, 0, 0},
+		{"bad magic", func() []byte { return []byte("II+\x00\x08\x00\x00\x00") }, ErrInvalid, 0, 0},
+		{"IFD0 past the end", func() []byte {
+			return newTIFFBuilder(order).bytes(100)
+		}, ErrInvalid, 0, 0},
+		{"truncated IFD0", func() []byte {
+			data := photoTIFF(order, "")
+			main := order.Uint32(data[4:])
+			return data[:main+2+12]
+		}, ErrInvalid, 0, 0},
+		{"too many entries", func() []byte {
+			data := photoTIFF(order, "")
+			order.PutUint16(data[order.Uint32(data[4:]):], maxEntries+1)
+			return data
+		}, ErrInvalid, 0, 0},
+		{"truncated value", func() []byte {
+			b := newTIFFBuilder(order)
+			main := b.ifd([]testEntry{b.short(TagOrientation, 1), b.ascii(TagMake, "A long camera make")}, 0)
+			data := b.bytes(main)
+			return data[:len(data)-4]
+		}, nil, 1, 0},
+		{"unknown type", func() []byte {
+			b := newTIFFBuilder(order)
+			return b.bytes(b.ifd([]testEntry{{TagMake, 99, 1, []byte{1}}, b.short(TagOrientation, 1)}, 0))
+		}, nil, 1, 0},
+		{"oversized value", func() []byte {
+			b := newTIFFBuilder(order)
+			return b.bytes(b.ifd([]testEntry{{TagMake, TypeLong, maxValueSize, []byte{0, 0, 0, 8}}}, 0))
+		}, nil, 0, 0},
+		{"sub-IFD past the end", func() []byte {
+			b := newTIFFBuilder(order)
+			return b.bytes(b.ifd([]testEntry{b.long(TagExifIFD, 1<<20)}, 0))
+		}, nil, 1, 0},
+		{"IFD0 chained to itself", func() []byte {
+			b := newTIFFBuilder(order)
+			return b.bytes(b.ifd([]testEntry{b.short(TagOrientation, 1)}, 8))
+		}, nil, 1, 0},
+		{"sub-IFD pointing at IFD0", func() []byte {
+			b := newTIFFBuilder(order)
+			return b.bytes(b.ifd([]testEntry{b.short(TagOrientation, 1), b.long(TagExifIFD, 8)}, 0))
+		}, nil, 2, 0},
+		{"GPS IFD pointing at the sub-IFD", func() []byte {
+			b := newTIFFBuilder(order)
+			sub := b.ifd([]testEntry{b.ascii(TagDateTimeOriginal, "2019:05:01 10:20:30")}, 0)
+			return b.bytes(b.ifd([]testEntry{b.long(TagExifIFD, sub), b.long(TagGPSIFD, sub)}, 0))
+		}, nil, 2, 1},
+	}
+	for _, test := range tests {
+		data := test.tiff()
+		x, err := Parse(bytes.NewReader(data), int64(len(data)), 0)
+		if err != test.err {
+			t.Errorf("%s: Parse = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(x.Main) != test.main || len(x.Sub) != test.sub {
+			t.Errorf("%s: %d main and %d sub entries, want %d and %d", test.name, len(x.Main), len(x.Sub), test.main, test.sub)
+		}
+	}
+}
+
+func TestDateTimeOriginal(t *testing.T) {
+	tests := []struct {
+		value, offset string
+		want          time.Time
+		hasOffset, ok bool
+	}{
+		{"2019:05:01 10:20:30", "+08:00", time.Date(2019, 5, 1, 2, 20, 30, 0, time.UTC), true, true},
+		{"2019:05:01 10:20:30", "-03:30", time.Date(2019, 5, 1, 13, 50, 30, 0, time.UTC), true, true},
+		{"2019:05:01 10:20:30", "", time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC), false, true},
+		{"2019:05:01 10:20:30", "+8:00", time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC), false, true},
+		{"2019:05:01 10:20:30", "   :  ", time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC), false, true},
+		{"2019:05:01 10:20:30 ", "", time.Date(2019, 5, 1, 10, 20, 30, 0, time.UTC), false, true},
+		{"0000:00:00 00:00:00", "+08:00", time.Time{}, false, false},
+		{"    :  :     :  :  ", "", time.Time{}, false, false},
+		{"", "+08:00", time.Time{}, false, false},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, test := range tests {
+			b := newTIFFBuilder(order)
+			entries := []testEntry{b.ascii(TagDateTimeOriginal, test.value)}
+			if test.offset != "" {
+				entries = append(entries, b.ascii(TagOffsetTimeOriginal, test.offset))
+			}
+			sub := b.ifd(entries, 0)
+			x := parseTIFF(t, b.bytes(b.ifd([]testEntry{b.long(TagExifIFD, sub)}, 0)))
+
+			got, hasOffset, ok := x.DateTimeOriginal()
+			if ok != test.ok || hasOffset != test.hasOffset || !got.Equal(test.want) {
+				t.Errorf("%v %q %q: DateTimeOriginal = %v, %v, %v, want %v, %v, %v", order, test.value, test.offset,
+					got, hasOffset, ok, test.want, test.hasOffset, test.ok)
+			}
+		}
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		s       string
+		seconds int
+		ok      bool
+	}{
+		{"+08:00", 8 * 3600, true},
+		{"-05:30", -(5*3600 + 30*60), true},
+		{"+00:00", 0, true},
+		{"08:00", 0, false},
+		{"+0800", 0, false},
+		{"+08:00:00", 0, false},
+		{"+ab:cd", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		loc, ok := ParseOffset(test.s)
+		if ok != test.ok {
+			t.Errorf("ParseOffset(%q) ok = %v", test.s, ok)
+			continue
+		}
+		if ok {
+			if _, seconds := time.Date(2019, 1, 1, 0, 0, 0, 0, loc).Zone(); seconds != test.seconds {
+				t.Errorf("ParseOffset(%q) = %d s, want %d", test.s, seconds, test.seconds)
+			}
+		}
+	}
+}
+
+func TestLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  func(b *tiffBuilder) []testEntry
+		lat, lon float64
+		ok       bool
+	}{
+		{"south west", func(b *tiffBuilder) []testEntry {
+			return []testEntry{
+				b.ascii(TagGPSLatitudeRef, "S"), b.rationals(TagGPSLatitude, 12, 1, 30, 1, 0, 1),
+				b.ascii(TagGPSLongitudeRef, "W"), b.rationals(TagGPSLongitude, 45, 1, 15, 1, 0, 1),
+			}
+		}, -12.5, -45.25, true},
+		{"decimal degrees", func(b *tiffBuilder) []testEntry {
+			return []testEntry{b.rationals(TagGPSLatitude, 1235, 100), b.rationals(TagGPSLongitude, 10375, 100)}
+		}, 12.35, 103.75, true},
+		{"no fix", func(b *tiffBuilder) []testEntry {
+			return []testEntry{b.rationals(TagGPSLatitude, 0, 1, 0, 1, 0, 1), b.rationals(TagGPSLongitude, 0, 1, 0, 1, 0, 1)}
+		}, 0, 0, false},
+		{"zero denominator", func(b *tiffBuilder) []testEntry {
+			return []testEntry{b.rationals(TagGPSLatitude, 1, 0), b.rationals(TagGPSLongitude, 1, 1)}
+		}, 0, 0, false},
+		{"out of range", func(b *tiffBuilder) []testEntry {
+			return []testEntry{b.rationals(TagGPSLatitude, 91, 1), b.rationals(TagGPSLongitude, 1, 1)}
+		}, 0, 0, false},
+		{"no longitude", func(b *tiffBuilder) []testEntry {
+			return []testEntry{b.rationals(TagGPSLatitude, 1, 1)}
+		}, 0, 0, false},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, test := range tests {
+			b := newTIFFBuilder(order)
+			gps := b.ifd(test.entries(b), 0)
+			x := parseTIFF(t, b.bytes(b.ifd([]testEntry{b.long(TagGPSIFD, gps)}, 0)))
+			loc, ok := x.Location()
+			if ok != test.ok || math.Abs(loc.Latitude-test.lat) > 1e-9 || math.Abs(loc.Longitude-test.lon) > 1e-9 {
+				t.Errorf("%v %s: Location = %+v, %v", order, test.name, loc, ok)
+			}
+		}
+	}
+}
+
+// testJPEG returns a JPEG file embedding tiff after an APP0 segment, or
+// without EXIF data for a nil tiff.
+func testJPEG(t *testing.T, tiff []byte) []byte {
+	segments := []jpegseg.Segment{{Marker: jpegseg.APP0, Data: []byte("JFIF\x00")}}
+	if tiff != nil {
+		segments = append(segments, jpegseg.Segment{Marker: jpegseg.APP1, Data: EmbedTIFF(tiff)})
+	}
+	data, err := jpegseg.Join(segments, []byte{0xff, jpegseg.SOS, 0x00, 0x02, 0xff, jpegseg.EOI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecode(t *testing.T) {
+	tiff := photoTIFF(binary.LittleEndian, "")
+	jpeg := testJPEG(t, tiff)
+	tests := []struct {
+		name string
+		data []byte
+		base int64
+		err  error
+	}{
+		{"jpeg", jpeg, int64(bytes.Index(jpeg, tiff)), nil},
+		{"tiff", tiff, 0, nil},
+		{"jpeg without exif", testJPEG(t, nil), 0, ErrNoExif},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), 0, ErrNoExif},
+		{"empty", nil, 0, ErrNoExif},
+	}
+	for _, test := range tests {
+		x, err := Decode(bytes.NewReader(test.data), int64(len(test.data)))
+		if err != test.err && (test.err != nil || err != nil) {
+			t.Errorf("%s: Decode = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && (x.Base != test.base || x.Make() != "Canon") {
+			t.Errorf("%s: Base = %d, Make = %q, want %d", test.name, x.Base, x.Make(), test.base)
+		}
+	}
+}
+
+func TestSetDateTimeOriginal(t *testing.T) {
+	dir := t.TempDir()
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		path := filepath.Join(dir, order.String()+".jpg")
+		original := testJPEG(t, photoTIFF(order, "+08:00"))
+		if err := ioutil.WriteFile(path, original, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetDateTimeOriginal(path, time.Date(2020, 12, 31, 23, 59, 58, 0, time.UTC)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != len(original) {
+			t.Errorf("%v: file size changed from %d to %d", order, len(original), len(data))
+		}
+		x, err := DecodeFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken, _, _ := x.DateTimeOriginal()
+		if want := time.Date(2020, 12, 31, 23, 59, 58, 0, time.FixedZone("", 8*3600)); !taken.Equal(want) {
+			t.Errorf("%v: DateTimeOriginal = %v, want %v", order, taken, want)
+		}
+	}
+
+	path := filepath.Join(dir, "none.jpg")
+	b := newTIFFBuilder(binary.LittleEndian)
+	original := testJPEG(t, b.bytes(b.ifd([]testEntry{b.ascii(TagMake, "Canon")}, 0)))
+	if err := ioutil.WriteFile(path, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDateTimeOriginal(path, time.Now()); err != ErrNoDateTimeOriginal {
+		t.Errorf("SetDateTimeOriginal without the field = %v, want ErrNoDateTimeOriginal", err)
+	}
+	if data, _ := ioutil.ReadFile(path); !bytes.Equal(data, original) {
+		t.Error("file without the field changed")
+	}
+}
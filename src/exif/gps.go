@@ -0,0 +1,101 @@
+package exif
+
+import (
+	"math"
+	"time"
+)
+
+// GPS IFD tags.
+const (
+	TagGPSVersionID    = 0x0000
+	TagGPSLatitudeRef  = 0x0001
+	TagGPSLatitude     = 0x0002
+	TagGPSLongitudeRef = 0x0003
+	TagGPSLongitude    = 0x0004
+	TagGPSAltitudeRef  = 0x0005
+	TagGPSAltitude     = 0x0006
+	TagGPSTimeStamp    = 0x0007
+	TagGPSDateStamp    = 0x001d
+)
+
+// Location is a position recorded in the GPS IFD, in decimal degrees and
+// metres above sea level.
+type Location struct {
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64
+	HasAltitude bool
+}
+
+// Location returns the recorded position. ok is false when the file has no
+// usable GPS coordinates; receivers without a fix often write zeros, which
+// are treated as missing too.
+func (x *Exif) Location() (loc Location, ok bool) {
+	lat, ok := x.coordinate(TagGPSLatitude, TagGPSLatitudeRef, "S", 90)
+	if !ok {
+		return loc, false
+	}
+	lon, ok := x.coordinate(TagGPSLongitude, TagGPSLongitudeRef, "W", 180)
+	if !ok || (lat == 0 && lon == 0) {
+		return loc, false
+	}
+	loc.Latitude, loc.Longitude = lat, lon
+
+	if e := x.GPS.Find(TagGPSAltitude); e != nil {
+		if alt := e.Float(0); !math.IsNaN(alt) && !math.IsInf(alt, 0) {
+			if ref := x.GPS.Find(TagGPSAltitudeRef); ref != nil && ref.Uint(0) == 1 {
+				alt = -alt
+			}
+			loc.Altitude, loc.HasAltitude = alt, true
+		}
+	}
+	return loc, true
+}
+
+// coordinate reads a degrees, minutes, seconds triple and negates it when
+// its reference tag is negative.
+func (x *Exif) coordinate(tag uint16, refTag uint16, negative string, max float64) (float64, bool) {
+	e := x.GPS.Find(tag)
+	if e == nil || e.Count < 1 {
+		return 0, false
+	}
+
+	value := 0.0
+	for i, scale := range []float64{1, 60, 3600} {
+		if uint32(i) >= e.Count {
+			break
+		}
+		part := e.Float(i)
+		if math.IsNaN(part) || math.IsInf(part, 0) {
+			return 0, false
+		}
+		value += part / scale
+	}
+	if value > max {
+		return 0, false
+	}
+
+	if ref := x.GPS.Find(refTag); ref != nil && ref.String() == negative {
+		value = -value
+	}
+	return value, true
+}
+
+// GPSTime returns the UTC time of the GPS fix, when recorded.
+func (x *Exif) GPSTime() (time.Time, bool) {
+	date := x.GPS.Find(TagGPSDateStamp)
+	stamp := x.GPS.Find(TagGPSTimeStamp)
+	if date == nil || stamp == nil || stamp.Count < 3 {
+		return time.Time{}, false
+	}
+
+	day, err := time.Parse("2006:01:02", date.String())
+	if err != nil {
+		return time.Time{}, false
+	}
+	seconds := stamp.Float(0)*3600 + stamp.Float(1)*60 + stamp.Float(2)
+	if math.IsNaN(seconds) || seconds < 0 || seconds >= 86400 {
+		return time.Time{}, false
+	}
+	return day.Add(time.Duration(seconds * float64(time.Second))), true
+}
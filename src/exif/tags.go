@@ -0,0 +1,194 @@
+package exif
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// IFD0 tags.
+const (
+	TagImageWidth       = 0x0100
+	TagImageLength      = 0x0101
+	TagImageDescription = 0x010e
+	TagMake             = 0x010f
+	TagModel            = 0x0110
+	TagOrientation      = 0x0112
+	TagDateTime         = 0x0132
+	TagArtist           = 0x013b
+	TagXMP              = 0x02bc
+	TagCopyright        = 0x8298
+	TagIPTC             = 0x83bb
+	TagExifIFD          = 0x8769
+	TagGPSIFD           = 0x8825
+)
+
+// EXIF sub-IFD tags.
+const (
+	TagExposureTime       = 0x829a
+	TagFNumber            = 0x829d
+	TagISOSpeed           = 0x8827
+	TagDateTimeOriginal   = 0x9003
+	TagOffsetTime         = 0x9010
+	TagOffsetTimeOriginal = 0x9011
+	TagFocalLength        = 0x920a
+	TagPixelXDimension    = 0xa002
+	TagPixelYDimension    = 0xa003
+	TagLensModel          = 0xa434
+)
+
+// DateTimeLayout is the layout of the EXIF date and time fields.
+const DateTimeLayout = "2006:01:02 15:04:05"
+
+// Uint returns the i-th value of an integer entry.
+func (e *Entry) Uint(i int) uint32 {
+	switch e.Type {
+	case TypeByte, TypeUndefined:
+		if i < len(e.Value) {
+			return uint32(e.Value[i])
+		}
+	case TypeShort:
+		if 2*i+2 <= len(e.Value) {
+			return uint32(e.order.Uint16(e.Value[2*i:]))
+		}
+	case TypeLong, TypeSLong:
+		if 4*i+4 <= len(e.Value) {
+			return e.order.Uint32(e.Value[4*i:])
+		}
+	}
+	return 0
+}
+
+// Float returns the i-th value of a rational or integer entry, or NaN
+// when the value is missing or has a zero denominator.
+func (e *Entry) Float(i int) float64 {
+	switch e.Type {
+	case TypeRational, TypeSRational:
+		if 8*i+8 > len(e.Value) {
+			return math.NaN()
+		}
+		num := e.order.Uint32(e.Value[8*i:])
+		den := e.order.Uint32(e.Value[8*i+4:])
+		if den == 0 {
+			return math.NaN()
+		}
+		if e.Type == TypeSRational {
+			return float64(int32(num)) / float64(int32(den))
+		}
+		return float64(num) / float64(den)
+	case TypeSLong:
+		return float64(int32(e.Uint(i)))
+	}
+	return float64(e.Uint(i))
+}
+
+// String returns an ASCII entry without its terminating NULs and
+// surrounding spaces.
+func (e *Entry) String() string {
+	return strings.TrimSpace(strings.TrimRight(string(e.Value), "\x00"))
+}
+
+func (x *Exif) find(tag uint16) *Entry {
+	if e := x.Sub.Find(tag); e != nil {
+		return e
+	}
+	return x.Main.Find(tag)
+}
+
+func (x *Exif) str(tag uint16) string {
+	if e := x.find(tag); e != nil && e.Type == TypeASCII {
+		return e.String()
+	}
+	return ""
+}
+
+func (x *Exif) float(tag uint16) float64 {
+	if e := x.find(tag); e != nil {
+		if v := e.Float(0); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return v
+		}
+	}
+	return 0
+}
+
+func (x *Exif) Make() string        { return x.str(TagMake) }
+func (x *Exif) Model() string       { return x.str(TagModel) }
+func (x *Exif) LensModel() string   { return x.str(TagLensModel) }
+func (x *Exif) Description() string { return x.str(TagImageDescription) }
+func (x *Exif) Artist() string      { return x.str(TagArtist) }
+func (x *Exif) Copyright() string   { return x.str(TagCopyright) }
+
+// FocalLength returns the focal length in millimetres, or 0.
+func (x *Exif) FocalLength() float64 { return x.float(TagFocalLength) }
+
+// FNumber returns the aperture as an f-number, or 0.
+func (x *Exif) FNumber() float64 { return x.float(TagFNumber) }
+
+// ExposureTime returns the shutter speed in seconds, or 0.
+func (x *Exif) ExposureTime() float64 { return x.float(TagExposureTime) }
+
+func (x *Exif) ISO() int {
+	if e := x.find(TagISOSpeed); e != nil {
+		return int(e.Uint(0))
+	}
+	return 0
+}
+
+// Dimensions returns the pixel size recorded by the camera, preferring the
+// EXIF sub-IFD over IFD0.
+func (x *Exif) Dimensions() (width int, height int) {
+	for _, tags := range [][2]uint16{{TagPixelXDimension, TagPixelYDimension}, {TagImageWidth, TagImageLength}} {
+		w, h := x.find(tags[0]), x.find(tags[1])
+		if w != nil && h != nil && w.Uint(0) > 0 && h.Uint(0) > 0 {
+			return int(w.Uint(0)), int(h.Uint(0))
+		}
+	}
+	return 0, 0
+}
+
+// Orientation returns the EXIF orientation from 1 to 8, defaulting to 1.
+func (x *Exif) Orientation() int {
+	if e := x.Main.Find(TagOrientation); e != nil {
+		if o := int(e.Uint(0)); o >= 1 && o <= 8 {
+			return o
+		}
+	}
+	return 1
+}
+
+// DateTimeOriginal returns the capture time. When the file records its UTC
+// offset the time is in a fixed zone for it and hasOffset is true;
+// otherwise it is the camera's wall clock time, given in UTC.
+func (x *Exif) DateTimeOriginal() (t time.Time, hasOffset bool, ok bool) {
+	value := x.str(TagDateTimeOriginal)
+	if value == "" {
+		return time.Time{}, false, false
+	}
+	t, err := time.Parse(DateTimeLayout, value)
+	if err != nil {
+		return time.Time{}, false, false
+	}
+
+	if offset, ok := ParseOffset(x.str(TagOffsetTimeOriginal)); ok {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, offset)
+		return t, true, true
+	}
+	return t, false, true
+}
+
+// ParseOffset parses an EXIF offset such as "+08:00" into a fixed zone.
+func ParseOffset(s string) (*time.Location, bool) {
+	if len(s) != 6 || (s[0] != '+' && s[0] != '-') || s[3] != ':' {
+		return nil, false
+	}
+	var hours, minutes int
+	if _, err := fmt.Sscanf(s[1:], "%02d:%02d", &hours, &minutes); err != nil {
+		return nil, false
+	}
+	seconds := hours*3600 + minutes*60
+	if s[0] == '-' {
+		seconds = -seconds
+	}
+	return time.FixedZone(s, seconds), true
+}
@@ -0,0 +1,105 @@
+package exif
+
+import "encoding/binary"
+
+// testEntry is an IFD entry for tiffBuilder, with its value encoded.
+type testEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// tiffBuilder lays out TIFF structures for tests, piece by piece, so that
+// tests can point offsets anywhere they like.
+type tiffBuilder struct {
+	order binary.ByteOrder
+	data  []byte
+}
+
+func newTIFFBuilder(order binary.ByteOrder) *tiffBuilder {
+	b := &tiffBuilder{order: order, data: make([]byte, 8)}
+	if order == binary.LittleEndian {
+		copy(b.data, "II*\x00")
+	} else {
+		copy(b.data, "MM\x00*")
+	}
+	return b
+}
+
+func (b *tiffBuilder) ascii(tag uint16, s string) testEntry {
+	return testEntry{tag, TypeASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func (b *tiffBuilder) short(tag uint16, v uint16) testEntry {
+	value := make([]byte, 2)
+	b.order.PutUint16(value, v)
+	return testEntry{tag, TypeShort, 1, value}
+}
+
+func (b *tiffBuilder) long(tag uint16, v uint32) testEntry {
+	value := make([]byte, 4)
+	b.order.PutUint32(value, v)
+	return testEntry{tag, TypeLong, 1, value}
+}
+
+func (b *tiffBuilder) rationals(tag uint16, values ...uint32) testEntry {
+	value := make([]byte, 4*len(values))
+	for i, v := range values {
+		b.order.PutUint32(value[4*i:], v)
+	}
+	return testEntry{tag, TypeRational, uint32(len(values) / 2), value}
+}
+
+func (b *tiffBuilder) undefined(tag uint16, data []byte) testEntry {
+	return testEntry{tag, TypeUndefined, uint32(len(data)), data}
+}
+
+// blob appends data and returns its offset.
+func (b *tiffBuilder) blob(data []byte) uint32 {
+	if len(b.data)%2 != 0 {
+		b.data = append(b.data, 0)
+	}
+	offset := len(b.data)
+	b.data = append(b.data, data...)
+	return uint32(offset)
+}
+
+// ifd appends an IFD followed by its values that do not fit into their
+// entries, and returns its offset.
+func (b *tiffBuilder) ifd(entries []testEntry, next uint32) uint32 {
+	if len(b.data)%2 != 0 {
+		b.data = append(b.data, 0)
+	}
+	offset := uint32(len(b.data))
+	values := offset + 2 + 12*uint32(len(entries)) + 4
+	buf := make([]byte, 2, values-offset)
+	b.order.PutUint16(buf, uint16(len(entries)))
+	var extra []byte
+	for _, e := range entries {
+		raw := make([]byte, 12)
+		b.order.PutUint16(raw, e.tag)
+		b.order.PutUint16(raw[2:], e.typ)
+		b.order.PutUint32(raw[4:], e.count)
+		if len(e.value) <= 4 {
+			copy(raw[8:], e.value)
+		} else {
+			b.order.PutUint32(raw[8:], values+uint32(len(extra)))
+			extra = append(extra, e.value...)
+			if len(extra)%2 != 0 {
+				extra = append(extra, 0)
+			}
+		}
+		buf = append(buf, raw...)
+	}
+	buf = append(buf, 0, 0, 0, 0)
+	b.order.PutUint32(buf[len(buf)-4:], next)
+	b.data = append(append(b.data, buf...), extra...)
+	return offset
+}
+
+// bytes returns the structure with IFD0 at main.
+func (b *tiffBuilder) bytes(main uint32) []byte {
+	b.order.PutUint32(b.data[4:], main)
+	return b.data
+}
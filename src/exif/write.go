@@ -0,0 +1,53 @@
+package exif
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"time"
+)
+
+var ErrNoDateTimeOriginal = errors.New("exif: no DateTimeOriginal to overwrite")
+
+// SetDateTimeOriginal overwrites the DateTimeOriginal of the file at path
+// with the wall clock time of t. The field has a fixed size, so it is
+// patched in place and nothing else in the file moves. Files without the
+// field are left alone and get ErrNoDateTimeOriginal.
+func SetDateTimeOriginal(path string, t time.Time) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	x, err := Decode(f, info.Size())
+	if err != nil {
+		return err
+	}
+
+	e := x.Sub.Find(TagDateTimeOriginal)
+	value := []byte(t.Format(DateTimeLayout) + "\x00")
+	if e == nil || e.Type != TypeASCII || len(e.Value) != len(value) {
+		return ErrNoDateTimeOriginal
+	}
+
+	// Read the field back before writing, in case the file changed since
+	// it was decoded.
+	offset := x.Base + e.Offset
+	current := make([]byte, len(e.Value))
+	if _, err := f.ReadAt(current, offset); err != nil {
+		return err
+	}
+	if !bytes.Equal(current, e.Value) {
+		return ErrInvalid
+	}
+
+	if _, err := f.WriteAt(value, offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -1,27 +1,290 @@
 package filescanner
 
 import (
+	"context"
+	"encoding/hex"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// File is a classified file handed to the visitor. Hash is the hex
+// BLAKE2b-256 digest of the contents and is only set when the file was
+// hashed, see Options.Hash. Sidecar is the path of the XMP sidecar paired
+// with the file, if any; sidecars are not visited on their own.
+type File struct {
+	Path           string
+	Size           int64
+	ModTime        time.Time
+	Format         *Format
+	Hash           string
+	Sidecar        string
+	SidecarModTime time.Time
+}
+
+type ScannerVisitorFunc func(f File) error
+
+// ErrorFunc receives every path that could not be read, classified or
+// visited. The scan carries on after reporting it.
+type ErrorFunc func(path string, err error)
+
+type Options struct {
+	OnError ErrorFunc
+	// Workers is the number of files classified and hashed at once.
+	Workers int
+	// QueueSize bounds both the paths waiting for a worker and the files
+	// waiting for the visitor, so a slow visitor throttles the walk.
+	QueueSize int
+	Hash      bool
+	// ShouldHash, when set, narrows Options.Hash down to the files it
+	// returns true for, so a rescan can skip files it already knows. It is
+	// called concurrently from the workers.
+	ShouldHash func(f File) bool
+	// Include and Exclude filter the tree, see the pattern syntax in
+	// filter.go. IgnoreFile names per-directory files holding more
+	// exclude patterns, such as ".boonignore".
+	Include    []string
+	Exclude    []string
+	IgnoreFile string
+}
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 64
 )
 
-type ScannerVisitorFunc func(path string, modTime time.Time)
+// Summary counts what a scan did. Seen covers every non-directory entry,
+// which ends up either matched, counted as a sidecar, skipped as an
+// unknown format, or errored.
+type Summary struct {
+	Seen     int           `json:"seen"`
+	Matched  int           `json:"matched"`
+	Sidecars int           `json:"sidecars"`
+	Skipped  int           `json:"skipped"`
+	Errored  int           `json:"errored"`
+	Duration time.Duration `json:"duration"`
+}
+
+type entry struct {
+	path string
+	info os.FileInfo
+}
+
+// result carries either a classified file or an error. walkErr marks
+// errors raised by the walk itself, which are not counted as seen files.
+type result struct {
+	file    File
+	err     error
+	walkErr bool
+}
 
 type filescanner struct {
-	fsvisit ScannerVisitorFunc
+	ctx     context.Context
+	opts    Options
+	filter  *filter
+	entries chan entry
+	results chan result
+}
+
+// send delivers r to the visitor unless the scan has been cancelled.
+func (fs *filescanner) send(r result) bool {
+	select {
+	case fs.results <- r:
+		return true
+	case <-fs.ctx.Done():
+		return false
+	}
+}
+
+func (fs *filescanner) walk(path string, f os.FileInfo, err error) error {
+	if err != nil {
+		// Either the entry could not be stat'ed or the directory could
+		// not be listed; in both cases Walk moves on to the next entry.
+		if !fs.send(result{file: File{Path: path}, err: err, walkErr: true}) {
+			return fs.ctx.Err()
+		}
+		return nil
+	}
+
+	if f.IsDir() {
+		if fs.filter.skip(path, true) {
+			return filepath.SkipDir
+		}
+		return fs.ctx.Err()
+	}
+	if fs.filter.skip(path, false) {
+		// Counted as a seen file of no interest.
+		if !fs.send(result{file: File{Path: path}}) {
+			return fs.ctx.Err()
+		}
+		return nil
+	}
+
+	select {
+	case fs.entries <- entry{path, f}:
+		return nil
+	case <-fs.ctx.Done():
+		return fs.ctx.Err()
+	}
+}
+
+func (fs *filescanner) work() {
+	for e := range fs.entries {
+		file, err := inspect(fs.ctx, fs.opts, e.path, e.info)
+		if !fs.send(result{file: file, err: err}) {
+			return
+		}
+	}
+}
+
+// inspect classifies the file at path and hashes it when opts ask for it.
+// A file of unknown format comes back with a nil Format and no error.
+func inspect(ctx context.Context, opts Options, path string, info os.FileInfo) (File, error) {
+	file := File{Path: path, Size: info.Size(), ModTime: info.ModTime()}
+
+	format, err := Detect(path)
+	if err != nil || format == nil {
+		return file, err
+	}
+	file.Format = format
+	if format.Kind == KindSidecar {
+		return file, nil
+	}
+	if sidecar, info := FindSidecar(path); info != nil {
+		file.Sidecar, file.SidecarModTime = sidecar, info.ModTime()
+	}
+
+	if opts.Hash && (opts.ShouldHash == nil || opts.ShouldHash(file)) {
+		file.Hash, err = HashFile(ctx, path)
+	}
+	return file, err
 }
 
-func (fs filescanner) visit(path string, f os.FileInfo, err error) error {
-	if !f.IsDir() && strings.HasSuffix(f.Name(), ".jpg") {
-		fs.fsvisit(path, f.ModTime())
+// HashFile streams the file through BLAKE2b-256, giving up early when ctx
+// is cancelled so that hashing a large video does not hold up shutdown.
+// The result is the File.Hash of the file.
+func HashFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	buf := make([]byte, 256*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		n, err := f.Read(buf)
+		h.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func Scan(path string, svc ScannerVisitorFunc) {
-	fs := filescanner{svc}
-	filepath.Walk(path, fs.visit)
+// Scan walks the tree under root and calls visit for every file of a
+// registered format other than sidecars. One goroutine walks the tree and
+// feeds a pool of Options.Workers goroutines that classify and hash files;
+// visit is always called from the goroutine that called Scan, one file at
+// a time.
+//
+// Per-path failures go to opts.OnError and do not stop the scan; Scan
+// only returns an error when ctx is done before the walk completes. The
+// summary is filled in either way.
+func Scan(ctx context.Context, root string, visit ScannerVisitorFunc, opts Options) (Summary, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	fs := &filescanner{
+		ctx:     ctx,
+		opts:    opts,
+		filter:  newFilter(root, opts),
+		entries: make(chan entry, opts.QueueSize),
+		results: make(chan result, opts.QueueSize),
+	}
+
+	walkDone := make(chan error, 1)
+	go func() {
+		walkDone <- filepath.Walk(root, fs.walk)
+		close(fs.entries)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.work()
+		}()
+	}
+	go func() {
+		// The walker is done once entries is closed and drained, so no
+		// one can send on results after the workers return.
+		wg.Wait()
+		close(fs.results)
+	}()
+
+	var summary Summary
+	fail := func(path string, err error) {
+		summary.Errored++
+		if opts.OnError != nil {
+			opts.OnError(path, err)
+		}
+	}
+
+	for r := range fs.results {
+		if ctx.Err() != nil {
+			break
+		}
+		if !r.walkErr {
+			summary.Seen++
+		}
+		switch {
+		case r.err != nil:
+			fail(r.file.Path, r.err)
+		case r.file.Format == nil:
+			summary.Skipped++
+		case r.file.Format.Kind == KindSidecar:
+			// Read along with the files they belong to.
+			summary.Sidecars++
+		default:
+			if err := visit(r.file); err != nil {
+				fail(r.file.Path, err)
+				continue
+			}
+			summary.Matched++
+		}
+	}
+	summary.Duration = time.Since(start)
+
+	// When ctx is done the walker gives up at its next entry, so this
+	// does not wait for the rest of the tree.
+	err := <-walkDone
+	if err == nil {
+		err = ctx.Err()
+	}
+	return summary, err
 }
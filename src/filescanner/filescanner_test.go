@@ -0,0 +1,195 @@
+package filescanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const jpegHeader = "\xff\xd8\xff\xe0"
+
+// scanErrors collects what a scan reports to Options.OnError.
+type scanErrors map[string]error
+
+func (e scanErrors) onError(path string, err error) {
+	e[path] = err
+}
+
+func TestScanSummary(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.jpg"), jpegHeader)
+	writeFile(t, filepath.Join(root, "a.xmp"), "<x:xmpmeta/>")
+	writeFile(t, filepath.Join(root, "notes.txt"), "hello")
+	writeFile(t, filepath.Join(root, "c.jpg"), "not a jpeg")
+	writeFile(t, filepath.Join(root, "fail.jpg"), jpegHeader)
+	writeFile(t, filepath.Join(root, "sub", "d.png"), "\x89PNG\r\n\x1a\n")
+	if err := os.Symlink(filepath.Join(root, "gone.jpg"), filepath.Join(root, "dangling.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := scanErrors{}
+	var visited []string
+	var sidecar string
+	summary, err := Scan(context.Background(), root, func(f File) error {
+		if filepath.Base(f.Path) == "fail.jpg" {
+			return errors.New("visitor failed")
+		}
+		if filepath.Base(f.Path) == "a.jpg" {
+			sidecar = f.Sidecar
+		}
+		visited = append(visited, filepath.Base(f.Path))
+		return nil
+	}, Options{OnError: errs.onError})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(visited)
+	if fmt.Sprint(visited) != "[a.jpg d.png]" {
+		t.Errorf("visited %v, want a.jpg and d.png", visited)
+	}
+	if sidecar != filepath.Join(root, "a.xmp") {
+		t.Errorf("sidecar of a.jpg %q", sidecar)
+	}
+	want := Summary{Seen: 7, Matched: 2, Sidecars: 1, Skipped: 2, Errored: 2}
+	summary.Duration = 0
+	if summary != want {
+		t.Errorf("summary %+v, want %+v", summary, want)
+	}
+	if len(errs) != 2 || errs[filepath.Join(root, "fail.jpg")] == nil || errs[filepath.Join(root, "dangling.jpg")] == nil {
+		t.Errorf("errors %v, want those of fail.jpg and dangling.jpg", errs)
+	}
+}
+
+func TestScanUnreadableDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root reads every directory")
+	}
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.jpg"), jpegHeader)
+	writeFile(t, filepath.Join(root, "locked", "b.jpg"), jpegHeader)
+	writeFile(t, filepath.Join(root, "z", "c.jpg"), jpegHeader)
+	locked := filepath.Join(root, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+
+	errs := scanErrors{}
+	summary, err := Scan(context.Background(), root, func(f File) error { return nil }, Options{OnError: errs.onError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory is not a file seen, but the scan carries on past it.
+	if summary.Seen != 2 || summary.Matched != 2 || summary.Errored != 1 || errs[locked] == nil {
+		t.Errorf("summary %+v, errors %v, want 2 matched and %s errored", summary, errs, locked)
+	}
+}
+
+func TestScanMissingRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "gone")
+	errs := scanErrors{}
+	summary, err := Scan(context.Background(), root, func(f File) error { return nil }, Options{OnError: errs.onError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Seen != 0 || summary.Errored != 1 || errs[root] == nil {
+		t.Errorf("summary %+v, errors %v, want the root errored", summary, errs)
+	}
+}
+
+func TestScanCancelled(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 200; i++ {
+		writeFile(t, filepath.Join(root, fmt.Sprintf("d%d", i%10), fmt.Sprintf("%03d.jpg", i)), jpegHeader)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	summary, err := Scan(ctx, root, func(f File) error {
+		t.Errorf("visited %s after cancelling", f.Path)
+		return nil
+	}, Options{})
+	if err != context.Canceled || summary.Matched != 0 {
+		t.Errorf("Scan with a done context = %+v, %v, want context.Canceled", summary, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	visits := 0
+	summary, err = Scan(ctx, root, func(f File) error {
+		visits++
+		if visits == 5 {
+			cancel()
+		}
+		return nil
+	}, Options{Workers: 2, QueueSize: 4})
+	if err != context.Canceled {
+		t.Errorf("Scan cancelled by the visitor = %v, want context.Canceled", err)
+	}
+	if visits != 5 || summary.Matched != 5 {
+		t.Errorf("%d visits, summary %+v, want the scan to stop after 5", visits, summary)
+	}
+}
+
+func TestScanWorkers(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 50; i++ {
+		writeFile(t, filepath.Join(root, fmt.Sprintf("%02d.jpg", i)), fmt.Sprintf("%s%d", jpegHeader, i))
+	}
+
+	var mu sync.Mutex
+	hashed := map[string]bool{}
+	inVisit := int32(0)
+	var visited []File
+	summary, err := Scan(context.Background(), root, func(f File) error {
+		if atomic.AddInt32(&inVisit, 1) != 1 {
+			t.Errorf("visit of %s runs alongside another", f.Path)
+		}
+		time.Sleep(time.Millisecond)
+		visited = append(visited, f)
+		atomic.AddInt32(&inVisit, -1)
+		return nil
+	}, Options{
+		Workers:   4,
+		QueueSize: 2,
+		Hash:      true,
+		// Only even files are hashed, as a rescan hashes changed ones.
+		ShouldHash: func(f File) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			var n int
+			fmt.Sscanf(filepath.Base(f.Path), "%d.jpg", &n)
+			hashed[f.Path] = n%2 == 0
+			return n%2 == 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Matched != 50 || len(visited) != 50 || len(hashed) != 50 {
+		t.Fatalf("summary %+v, %d visited, %d asked to hash, want 50", summary, len(visited), len(hashed))
+	}
+	for _, f := range visited {
+		if !hashed[f.Path] {
+			if f.Hash != "" {
+				t.Errorf("%s hashed, want it skipped", f.Path)
+			}
+			continue
+		}
+		want, err := HashFile(context.Background(), f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Hash != want {
+			t.Errorf("hash of %s = %q, want %q", f.Path, f.Hash, want)
+		}
+	}
+}
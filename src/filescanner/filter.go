@@ -0,0 +1,190 @@
+package filescanner
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Patterns in Options.Include, Options.Exclude and ignore files are
+// slash-separated globs in the syntax of path.Match, with a few additions
+// borrowed from .gitignore:
+//
+//   - a pattern without a slash matches the base name at any depth
+//   - a pattern with a slash matches the path relative to the scan root,
+//     or to the directory holding the ignore file
+//   - "**" matches any number of directories
+//   - a trailing slash only matches directories
+//
+// Excluded directories are not descended into. When Include is not empty,
+// only files matching one of its patterns are visited.
+type pattern struct {
+	parts    []string
+	anchored bool
+	dirOnly  bool
+}
+
+func parsePattern(s string) pattern {
+	p := pattern{}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	if strings.Contains(s, "/") {
+		p.anchored = true
+		s = strings.TrimPrefix(s, "/")
+	}
+	p.parts = strings.Split(s, "/")
+	return p
+}
+
+func parsePatterns(list []string) []pattern {
+	var patterns []pattern
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s != "" {
+			patterns = append(patterns, parsePattern(s))
+		}
+	}
+	return patterns
+}
+
+func (p pattern) match(rel string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	segs := strings.Split(rel, "/")
+	if !p.anchored {
+		ok, _ := path.Match(p.parts[0], segs[len(segs)-1])
+		return ok
+	}
+	return matchParts(p.parts, segs)
+}
+
+func matchParts(parts []string, segs []string) bool {
+	for len(parts) > 0 {
+		if parts[0] == "**" {
+			parts = parts[1:]
+			if len(parts) == 0 {
+				return true
+			}
+			for i := range segs {
+				if matchParts(parts, segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(parts[0], segs[0]); !ok {
+			return false
+		}
+		parts, segs = parts[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+func matchAny(patterns []pattern, rel string, dir bool) bool {
+	for _, p := range patterns {
+		if p.match(rel, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter decides which paths under root are scanned. Ignore files are
+// read on first use and cached per directory.
+type filter struct {
+	root       string
+	include    []pattern
+	exclude    []pattern
+	ignoreFile string
+
+	mu      sync.Mutex
+	ignores map[string][]pattern
+}
+
+func newFilter(root string, opts Options) *filter {
+	return &filter{
+		root:       filepath.Clean(root),
+		include:    parsePatterns(opts.Include),
+		exclude:    parsePatterns(opts.Exclude),
+		ignoreFile: opts.IgnoreFile,
+		ignores:    make(map[string][]pattern),
+	}
+}
+
+// skip reports whether path, which is below the root, should be left out.
+func (f *filter) skip(p string, dir bool) bool {
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	if matchAny(f.exclude, rel, dir) {
+		return true
+	}
+	if !dir && len(f.include) > 0 && !matchAny(f.include, rel, dir) {
+		return true
+	}
+	if f.ignoreFile == "" {
+		return false
+	}
+
+	// Check the ignore file of every directory from the root down to the
+	// one holding p, each against the path relative to itself.
+	segs := strings.Split(rel, "/")
+	ancestor := f.root
+	for i := 0; i < len(segs); i++ {
+		if matchAny(f.ignored(ancestor), strings.Join(segs[i:], "/"), dir) {
+			return true
+		}
+		ancestor = filepath.Join(ancestor, segs[i])
+	}
+	return false
+}
+
+func (f *filter) ignored(dir string) []pattern {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	patterns, ok := f.ignores[dir]
+	if !ok {
+		patterns = readIgnoreFile(filepath.Join(dir, f.ignoreFile))
+		f.ignores[dir] = patterns
+	}
+	return patterns
+}
+
+// forget drops the cached ignore file of dir, after it changed.
+func (f *filter) forget(dir string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.ignores, dir)
+}
+
+// readIgnoreFile reads one pattern per line, skipping blank lines and
+// lines starting with '#'. A missing or unreadable file ignores nothing.
+func readIgnoreFile(name string) []pattern {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return parsePatterns(lines)
+}
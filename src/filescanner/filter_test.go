@@ -0,0 +1,130 @@
+package filescanner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		dir     bool
+		want    bool
+	}{
+		{"*.tmp", "a.tmp", false, true},
+		{"*.tmp", "x/y/a.tmp", false, true},
+		{"*.tmp", "a.tmp/b.jpg", false, false},
+		{".thumbnails", "x/.thumbnails", true, true},
+		{"@eaDir/", "x/@eaDir", true, true},
+		{"@eaDir/", "x/@eaDir", false, false},
+		{"raw/*.cr2", "raw/a.cr2", false, true},
+		{"raw/*.cr2", "x/raw/a.cr2", false, false},
+		{"/raw", "raw", true, true},
+		{"/raw", "x/raw", true, false},
+		{"raw/*", "raw/sub/a.cr2", false, false},
+		{"**/cache", "cache", true, true},
+		{"**/cache", "x/y/cache", true, true},
+		{"x/**", "x/y/z.jpg", false, true},
+		{"x/**/*.jpg", "x/a.jpg", false, true},
+		{"x/**/*.jpg", "x/y/z/a.jpg", false, true},
+		{"x/**/*.jpg", "y/a.jpg", false, false},
+		{"x/**/*.jpg", "x/y/a.png", false, false},
+		{"IMG_[0-9]*.JPG", "IMG_1234.JPG", false, true},
+		{"IMG_[0-9]*.JPG", "IMG_abc.JPG", false, false},
+		{"[", "[", false, false},
+	}
+	for _, test := range tests {
+		if got := parsePattern(test.pattern).match(test.rel, test.dir); got != test.want {
+			t.Errorf("%q matches %q (dir %v) = %v, want %v", test.pattern, test.rel, test.dir, got, test.want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, name string, data string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterSkip(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".boonignore"), "# exports\n\nexport/\n*.tmp\n")
+	writeFile(t, filepath.Join(root, "trip", ".boonignore"), "rejects/*.jpg\n/best.jpg\n")
+
+	f := newFilter(root+"/", Options{
+		Include:    []string{"*.jpg", "*.cr2", " "},
+		Exclude:    []string{"@eaDir/", "private/**"},
+		IgnoreFile: ".boonignore",
+	})
+	tests := []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{".", true, false},
+		{"a.jpg", false, false},
+		{"a.png", false, true},
+		{"sub", true, false},
+		{"sub/a.cr2", false, false},
+		{"sub/@eaDir", true, true},
+		{"sub/@eaDir", false, true},
+		{"private/a.jpg", false, true},
+		{"export", true, true},
+		{"trip/export", true, true},
+		{"trip/a.jpg.tmp", false, true},
+		{"trip/rejects/a.jpg", false, true},
+		{"trip/day1/rejects/a.jpg", false, false},
+		{"rejects/a.jpg", false, false},
+		{"trip/best.jpg", false, true},
+		{"trip/day1/best.jpg", false, false},
+		{"best.jpg", false, false},
+	}
+	for _, test := range tests {
+		if got := f.skip(filepath.Join(root, filepath.FromSlash(test.rel)), test.dir); got != test.want {
+			t.Errorf("skip(%s, dir %v) = %v, want %v", test.rel, test.dir, got, test.want)
+		}
+	}
+
+	// Changes to an ignore file apply once it is forgotten.
+	best := filepath.Join(root, "trip", "best.jpg")
+	writeFile(t, filepath.Join(root, "trip", ".boonignore"), "")
+	if !f.skip(best, false) {
+		t.Error("cached ignore file not used")
+	}
+	f.forget(filepath.Join(root, "trip"))
+	if f.skip(best, false) {
+		t.Error("forgotten ignore file still used")
+	}
+}
+
+func TestScanSkipsIgnored(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, ".boonignore"), "skipped/\n*.tmp.jpg\n")
+	for _, name := range []string{"a.jpg", "b.tmp.jpg", "skipped/c.jpg", "kept/d.jpg"} {
+		writeFile(t, filepath.Join(root, filepath.FromSlash(name)), "\xff\xd8\xff\xe0")
+	}
+	var visited []string
+	summary, err := Scan(context.Background(), root, func(f File) error {
+		rel, _ := filepath.Rel(root, f.Path)
+		visited = append(visited, filepath.ToSlash(rel))
+		return nil
+	}, Options{IgnoreFile: ".boonignore", Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(visited)
+	if len(visited) != 2 || visited[0] != "a.jpg" || visited[1] != "kept/d.jpg" {
+		t.Errorf("visited %v", visited)
+	}
+	if summary.Seen != 4 || summary.Matched != 2 {
+		t.Errorf("summary = %+v, want 4 seen and 2 matched", summary)
+	}
+}
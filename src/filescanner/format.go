@@ -0,0 +1,192 @@
+package filescanner
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Kind classifies a file format by how boonfoto treats it.
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindImage
+	KindRaw
+	KindVideo
+	KindSidecar
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindImage:
+		return "image"
+	case KindRaw:
+		return "raw"
+	case KindVideo:
+		return "video"
+	case KindSidecar:
+		return "sidecar"
+	}
+	return "unknown"
+}
+
+// Format describes a file format known to the scanner. Extensions are
+// lower case and include the leading dot. Each entry in Magic is a
+// prefix of the file header where '?' matches any byte, in the same
+// way as image.RegisterFormat.
+type Format struct {
+	Name       string
+	Kind       Kind
+	Extensions []string
+	Magic      []string
+}
+
+func (f *Format) match(header []byte) bool {
+	for _, m := range f.Magic {
+		if matchMagic(m, header) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMagic(magic string, header []byte) bool {
+	if len(header) < len(magic) {
+		return false
+	}
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != '?' && magic[i] != header[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// headerSize is the number of leading bytes read for magic sniffing.
+const headerSize = 64
+
+var (
+	formatsMu sync.RWMutex
+	formats   []*Format
+	byExt     = map[string]*Format{}
+)
+
+// Register adds a format to the registry. Formats registered later win
+// extension lookups, formats registered earlier win magic sniffing.
+func Register(f *Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+
+	formats = append(formats, f)
+	for _, ext := range f.Extensions {
+		byExt[strings.ToLower(ext)] = f
+	}
+}
+
+// Formats returns the registered formats in registration order.
+func Formats() []*Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	return append([]*Format(nil), formats...)
+}
+
+// Lookup returns the format registered for the extension of name,
+// ignoring case, or nil.
+func Lookup(name string) *Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	return byExt[strings.ToLower(filepath.Ext(name))]
+}
+
+// Detect classifies the file at path. The format claimed by the extension
+// is used when its magic matches the file header or when it has no magic
+// at all; otherwise the header is sniffed against every registered format.
+// Detect returns nil when the file is not a known format.
+func Detect(path string) (*Format, error) {
+	candidate := Lookup(path)
+	if candidate != nil && len(candidate.Magic) == 0 {
+		return candidate, nil
+	}
+
+	header, err := readHeader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if candidate != nil && candidate.match(header) {
+		return candidate, nil
+	}
+	return sniff(header), nil
+}
+
+func sniff(header []byte) *Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	for _, f := range formats {
+		if f.match(header) {
+			return f
+		}
+	}
+	return nil
+}
+
+func readHeader(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+func init() {
+	// Specific ISO base media brands go before the generic "ftyp" box so
+	// that sniffing a HEIC or CR3 file does not classify it as MP4.
+	Register(&Format{Name: "jpeg", Kind: KindImage, Extensions: []string{".jpg", ".jpeg", ".jpe"}, Magic: []string{"\xff\xd8\xff"}})
+	Register(&Format{Name: "png", Kind: KindImage, Extensions: []string{".png"}, Magic: []string{"\x89PNG\r\n\x1a\n"}})
+	Register(&Format{Name: "gif", Kind: KindImage, Extensions: []string{".gif"}, Magic: []string{"GIF87a", "GIF89a"}})
+	Register(&Format{Name: "webp", Kind: KindImage, Extensions: []string{".webp"}, Magic: []string{"RIFF????WEBP"}})
+	Register(&Format{Name: "heic", Kind: KindImage, Extensions: []string{".heic", ".heif"}, Magic: []string{"????ftypheic", "????ftypheix", "????ftyphevc", "????ftypmif1", "????ftypmsf1"}})
+	// "BM" alone starts plenty of text files, so the reserved fields must
+	// be zero and the size of one of the known info headers must follow.
+	var bmpMagic []string
+	for _, infoSize := range "\x0c(4@8l|" {
+		bmpMagic = append(bmpMagic, "BM????\x00\x00\x00\x00????"+string(infoSize)+"\x00\x00\x00")
+	}
+	Register(&Format{Name: "bmp", Kind: KindImage, Extensions: []string{".bmp"}, Magic: bmpMagic})
+
+	Register(&Format{Name: "cr2", Kind: KindRaw, Extensions: []string{".cr2"}, Magic: []string{"II*\x00????CR"}})
+	Register(&Format{Name: "cr3", Kind: KindRaw, Extensions: []string{".cr3"}, Magic: []string{"????ftypcrx "}})
+	Register(&Format{Name: "orf", Kind: KindRaw, Extensions: []string{".orf"}, Magic: []string{"IIRO", "IIRS", "MMOR"}})
+	Register(&Format{Name: "rw2", Kind: KindRaw, Extensions: []string{".rw2"}, Magic: []string{"IIU\x00"}})
+	Register(&Format{Name: "raf", Kind: KindRaw, Extensions: []string{".raf"}, Magic: []string{"FUJIFILMCCD-RAW"}})
+	// These RAW formats are plain TIFF containers, so only the extension
+	// tells them apart from an ordinary TIFF.
+	Register(&Format{Name: "dng", Kind: KindRaw, Extensions: []string{".dng"}})
+	Register(&Format{Name: "nef", Kind: KindRaw, Extensions: []string{".nef", ".nrw"}})
+	Register(&Format{Name: "arw", Kind: KindRaw, Extensions: []string{".arw", ".srf", ".sr2"}})
+	Register(&Format{Name: "pef", Kind: KindRaw, Extensions: []string{".pef"}})
+	Register(&Format{Name: "srw", Kind: KindRaw, Extensions: []string{".srw"}})
+	Register(&Format{Name: "tiff", Kind: KindImage, Extensions: []string{".tif", ".tiff"}, Magic: []string{"II*\x00", "MM\x00*"}})
+
+	Register(&Format{Name: "mov", Kind: KindVideo, Extensions: []string{".mov", ".qt"}, Magic: []string{"????ftypqt  ", "????moov", "????mdat", "????wide", "????free"}})
+	Register(&Format{Name: "3gp", Kind: KindVideo, Extensions: []string{".3gp", ".3g2"}, Magic: []string{"????ftyp3g"}})
+	Register(&Format{Name: "mp4", Kind: KindVideo, Extensions: []string{".mp4", ".m4v"}, Magic: []string{"????ftyp"}})
+	Register(&Format{Name: "avi", Kind: KindVideo, Extensions: []string{".avi"}, Magic: []string{"RIFF????AVI "}})
+	Register(&Format{Name: "mkv", Kind: KindVideo, Extensions: []string{".mkv", ".webm"}, Magic: []string{"\x1a\x45\xdf\xa3"}})
+	Register(&Format{Name: "mts", Kind: KindVideo, Extensions: []string{".mts", ".m2ts"}})
+
+	Register(&Format{Name: "xmp", Kind: KindSidecar, Extensions: []string{".xmp"}})
+}
@@ -0,0 +1,121 @@
+package filescanner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bmpHeader is the start of a BMP file with a BITMAPINFOHEADER.
+const bmpHeader = "BM\x46\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00\x00\x01\x00\x18\x00"
+
+func TestDetect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filescanner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		// Extensions in any case.
+		{"a.jpg", "\xff\xd8\xff\xe1", "jpeg"},
+		{"b.JPG", "\xff\xd8\xff\xe1", "jpeg"},
+		{"c.JpEg", "\xff\xd8\xff\xe0", "jpeg"},
+		{"d.Png", "\x89PNG\r\n\x1a\n\x00", "png"},
+		{"e.XMP", "<x:xmpmeta>", "xmp"},
+		{"f.MTS", "\x47\x40\x00", "mts"},
+
+		// The magic wins over a wrong extension.
+		{"g.png", "\xff\xd8\xff\xe1", "jpeg"},
+		{"h.jpg", "GIF89a", "gif"},
+		{"i.jpg", "not an image", ""},
+
+		// ISO base media files are told apart by their brand; a specific
+		// brand wins over the generic MP4 box when sniffing.
+		{"j.heic", "\x00\x00\x00\x18ftypheic", "heic"},
+		{"k.HEIF", "\x00\x00\x00\x18ftypmif1", "heic"},
+		{"l.jpg", "\x00\x00\x00\x18ftypheic", "heic"},
+		{"m.mp4", "\x00\x00\x00\x18ftypisom", "mp4"},
+		{"n.mov", "\x00\x00\x00\x14ftypqt  ", "mov"},
+		{"o.mov", "\x00\x00\x00\x08wide", "mov"},
+		{"p.jpg", "\x00\x00\x00\x18ftypcrx ", "cr3"},
+		{"q.3gp", "\x00\x00\x00\x14ftyp3gp4", "3gp"},
+		// A HEIC file named .mp4 still has an MP4 box.
+		{"r.mp4", "\x00\x00\x00\x18ftypheic", "mp4"},
+
+		// TIFF containers: the extension names the RAW format.
+		{"s.tif", "II*\x00\x08\x00\x00\x00", "tiff"},
+		{"t.TIFF", "MM\x00*\x00\x00\x00\x08", "tiff"},
+		{"u.NEF", "MM\x00*\x00\x00\x00\x08", "nef"},
+		{"v.dng", "II*\x00\x08\x00\x00\x00", "dng"},
+		{"w.arw", "II*\x00\x08\x00\x00\x00", "arw"},
+		{"x.Sr2", "II*\x00\x08\x00\x00\x00", "arw"},
+		{"y.pef", "MM\x00*\x00\x00\x00\x08", "pef"},
+		{"z.CR2", "II*\x00\x10\x00\x00\x00CR\x02\x00", "cr2"},
+		// A CR2 file is a TIFF as well, so .tif stands.
+		{"za.tif", "II*\x00\x10\x00\x00\x00CR\x02\x00", "tiff"},
+		{"zb.orf", "IIRO\x08\x00\x00\x00", "orf"},
+		{"zc.rw2", "IIU\x00\x18\x00\x00\x00", "rw2"},
+
+		// No extension: only the magic counts.
+		{"noext-jpeg", "\xff\xd8\xff\xdb", "jpeg"},
+		{"noext-png", "\x89PNG\r\n\x1a\n", "png"},
+		{"noext-heic", "\x00\x00\x00\x18ftypheic", "heic"},
+		{"noext-mp4", "\x00\x00\x00\x18ftypmp42", "mp4"},
+		{"noext-tiff", "II*\x00\x08\x00\x00\x00", "tiff"},
+		{"noext-cr2", "II*\x00\x10\x00\x00\x00CR\x02\x00", "cr2"},
+		{"noext-raf", "FUJIFILMCCD-RAW 0201", "raf"},
+		{"noext-bmp", bmpHeader, "bmp"},
+		{"noext-text", "hello", ""},
+		{"noext-empty", "", ""},
+
+		// BM needs the rest of a BMP header.
+		{"a.bmp", bmpHeader, "bmp"},
+		{"b.bmp", "BMW service notes", ""},
+		{"BMW.txt", "BMW service notes\n2019-05-01\n", ""},
+		{"c.bmp", "BM\x46\x00\x00\x00\x01\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00", ""},
+		{"d.bmp", "BM\x46\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x29\x00\x00\x00", ""},
+		{"e.bmp", "BM\x46\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x7c\x00\x00\x00", "bmp"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, []byte(test.header), 0644); err != nil {
+			t.Fatal(err)
+		}
+		format, err := Detect(path)
+		if err != nil {
+			t.Errorf("Detect(%s): %v", test.name, err)
+			continue
+		}
+		got := ""
+		if format != nil {
+			got = format.Name
+		}
+		if got != test.want {
+			t.Errorf("Detect(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if _, err := Detect(filepath.Join(dir, "missing.jpg")); err == nil {
+		t.Errorf("Detect of a missing file succeeded")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.jpg": "jpeg", "A.JPE": "jpeg", "dir.jpg/a.NRW": "nef", "a.tar.gz": "", "jpg": "", ".jpg": "jpeg", "a.": "",
+	} {
+		got := ""
+		if f := Lookup(name); f != nil {
+			got = f.Name
+		}
+		if got != want {
+			t.Errorf("Lookup(%s) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package filescanner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarNames returns the names a sidecar of the file at path may have,
+// in order of preference: darktable and digiKam append ".xmp" to the full
+// name, Lightroom replaces the extension.
+func sidecarNames(path string) []string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	return []string{path + ".xmp", path + ".XMP", base + ".xmp", base + ".XMP"}
+}
+
+// FindSidecar returns the path and info of the XMP sidecar next to the file
+// at path, or "" and nil when it has none.
+func FindSidecar(path string) (string, os.FileInfo) {
+	for _, name := range sidecarNames(path) {
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			return name, info
+		}
+	}
+	return "", nil
+}
+
+// SidecarPath returns the path a new sidecar for the file at path is
+// written to.
+func SidecarPath(path string) string {
+	return path + ".xmp"
+}
+
+func isSidecar(path string) bool {
+	f := Lookup(path)
+	return f != nil && f.Kind == KindSidecar
+}
+
+// sidecarImages returns the files in the directory of a sidecar that it
+// may belong to, so that a change to it can be applied to them.
+func sidecarImages(sidecar string) []string {
+	base := strings.TrimSuffix(sidecar, filepath.Ext(sidecar))
+	infos, err := ioutil.ReadDir(filepath.Dir(sidecar))
+	if err != nil {
+		return nil
+	}
+
+	prefix := filepath.Base(base)
+	var images []string
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// Either the sidecar name minus ".xmp", or that plus an extension.
+		if rest := name[len(prefix):]; rest != "" && rest != filepath.Ext(name) {
+			continue
+		}
+		if f := Lookup(name); f != nil && f.Kind != KindSidecar {
+			images = append(images, filepath.Join(filepath.Dir(sidecar), name))
+		}
+	}
+	return images
+}
@@ -0,0 +1,22 @@
+package filescanner
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrOverflow is reported through Options.OnError when the kernel dropped
+// events, so changes may have been missed until the next full scan.
+var ErrOverflow = errors.New("filescanner: watch event queue overflowed")
+
+type WatchOptions struct {
+	Options
+	// Debounce is how long a file has to stay untouched before it is
+	// visited, so files still being copied are not picked up half written.
+	Debounce time.Duration
+	// OnRemove is called with every path deleted or moved away from the
+	// watched tree. The path may have been a directory.
+	OnRemove func(path string) error
+}
+
+const defaultDebounce = 2 * time.Second
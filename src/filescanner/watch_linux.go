@@ -0,0 +1,282 @@
+package filescanner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	dirMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM |
+		syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_ONLYDIR
+	changeMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO
+	removeMask = syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+	// maxWait bounds how long the loop sleeps, so cancellation is noticed.
+	maxWait = 500 * time.Millisecond
+)
+
+type watcher struct {
+	ctx     context.Context
+	visit   ScannerVisitorFunc
+	opts    WatchOptions
+	filter  *filter
+	fd      int
+	dirs    map[int32]string
+	wds     map[string]int32
+	pending map[string]time.Time
+}
+
+// Watch subscribes to inotify events for every directory under root and
+// calls visit for files that are created, written or moved into the tree
+// once they have been quiet for opts.Debounce. Deleted and moved away
+// paths go to opts.OnRemove. A sidecar that changes or goes away has the
+// files it belongs to visited again. visit and OnRemove are called from the
+// goroutine that called Watch, which returns when ctx is done.
+//
+// Watch does not visit the files already in the tree; run Scan for that.
+func Watch(ctx context.Context, root string, visit ScannerVisitorFunc, opts WatchOptions) error {
+	if opts.Debounce <= 0 {
+		opts.Debounce = defaultDebounce
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	defer syscall.Close(fd)
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	defer syscall.Close(epfd)
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		return os.NewSyscallError("epoll_ctl", err)
+	}
+
+	w := &watcher{
+		ctx:     ctx,
+		visit:   visit,
+		opts:    opts,
+		filter:  newFilter(root, opts.Options),
+		fd:      fd,
+		dirs:    make(map[int32]string),
+		wds:     make(map[string]int32),
+		pending: make(map[string]time.Time),
+	}
+	if err := w.addTree(filepath.Clean(root), false); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	events := make([]syscall.EpollEvent, 1)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := syscall.EpollWait(epfd, events, int(w.wait()/time.Millisecond))
+		if err != nil && err != syscall.EINTR {
+			return os.NewSyscallError("epoll_wait", err)
+		}
+		if n > 0 {
+			if err := w.read(buf); err != nil {
+				return err
+			}
+		}
+		w.flush(time.Now())
+	}
+}
+
+func (w *watcher) fail(path string, err error) {
+	if w.opts.OnError != nil {
+		w.opts.OnError(path, err)
+	}
+}
+
+// wait returns how long to sleep until the next pending file is due.
+func (w *watcher) wait() time.Duration {
+	wait := maxWait
+	now := time.Now()
+	for _, last := range w.pending {
+		if d := last.Add(w.opts.Debounce).Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+func (w *watcher) read(buf []byte) error {
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return nil
+		}
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := buf[nameStart : nameStart+int(raw.Len)]
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.handle(raw.Wd, raw.Mask, string(name))
+			offset = nameStart + int(raw.Len)
+		}
+	}
+}
+
+func (w *watcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.fail(w.dirs[wd], ErrOverflow)
+		return
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		if w.wds[dir] == wd {
+			delete(w.wds, dir)
+		}
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	if w.opts.IgnoreFile != "" && name == w.opts.IgnoreFile && mask&(changeMask|removeMask) != 0 {
+		// Takes effect for new events; the next full scan applies it to
+		// what is already indexed.
+		w.filter.forget(dir)
+		return
+	}
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO|syscall.IN_CLOSE_WRITE|syscall.IN_MODIFY) != 0 &&
+		w.filter.skip(path, mask&syscall.IN_ISDIR != 0) {
+		return
+	}
+
+	switch {
+	case mask&syscall.IN_ISDIR == 0 && mask&(changeMask|removeMask) != 0 && isSidecar(path):
+		// A sidecar changed or went away, so its files have to be read again.
+		for _, image := range sidecarImages(path) {
+			w.pending[image] = time.Now()
+		}
+	case mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if err := w.addTree(path, true); err != nil {
+			w.fail(path, err)
+		}
+	case mask&removeMask != 0:
+		if mask&syscall.IN_ISDIR != 0 {
+			w.removeTree(path)
+		}
+		delete(w.pending, path)
+		if w.opts.OnRemove != nil {
+			if err := w.opts.OnRemove(path); err != nil {
+				w.fail(path, err)
+			}
+		}
+	case mask&changeMask != 0:
+		w.pending[path] = time.Now()
+	}
+}
+
+// addTree watches dir and every directory below it. Files found on the
+// way are queued when the directory is new to the tree, since they may
+// have landed before the watch was in place.
+func (w *watcher) addTree(dir string, queueFiles bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			w.fail(path, err)
+			return nil
+		}
+		if w.filter.skip(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			if queueFiles {
+				w.pending[path] = time.Now()
+			}
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, dirMask)
+		if err != nil {
+			w.fail(path, os.NewSyscallError("inotify_add_watch", err))
+			return filepath.SkipDir
+		}
+		w.dirs[int32(wd)] = path
+		w.wds[path] = int32(wd)
+		return nil
+	})
+}
+
+// removeTree stops watching dir and everything below it. A directory moved
+// elsewhere keeps its watch in the kernel and would otherwise go on
+// reporting events under its old path.
+func (w *watcher) removeTree(dir string) {
+	for path, wd := range w.wds {
+		if path == dir || isUnder(path, dir) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, path)
+			delete(w.dirs, wd)
+		}
+	}
+	for path := range w.pending {
+		if isUnder(path, dir) {
+			delete(w.pending, path)
+		}
+	}
+}
+
+// flush visits the pending files that have been quiet long enough.
+func (w *watcher) flush(now time.Time) {
+	for path, last := range w.pending {
+		if now.Sub(last) < w.opts.Debounce {
+			continue
+		}
+		delete(w.pending, path)
+
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			w.fail(path, err)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		file, err := inspect(w.ctx, w.opts.Options, path, info)
+		if err != nil {
+			w.fail(path, err)
+			continue
+		}
+		if file.Format == nil || file.Format.Kind == KindSidecar {
+			continue
+		}
+		if err := w.visit(file); err != nil {
+			w.fail(path, err)
+		}
+	}
+}
+
+func isUnder(path string, dir string) bool {
+	return len(path) > len(dir) && path[:len(dir)] == dir && path[len(dir)] == filepath.Separator
+}
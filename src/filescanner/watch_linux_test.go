@@ -0,0 +1,221 @@
+package filescanner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+const testDebounce = 150 * time.Millisecond
+
+// testWatch watches root until the test ends and hands out the files
+// visited and the paths removed.
+type testWatch struct {
+	visits  chan File
+	removes chan string
+}
+
+func startWatch(t *testing.T, root string) *testWatch {
+	tw := &testWatch{visits: make(chan File, 100), removes: make(chan string, 100)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, root, func(f File) error {
+			tw.visits <- f
+			return nil
+		}, WatchOptions{
+			Debounce: testDebounce,
+			OnRemove: func(path string) error {
+				tw.removes <- path
+				return nil
+			},
+			Options: Options{OnError: func(path string, err error) {
+				t.Errorf("watch error for %s: %v", path, err)
+			}},
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("Watch = %v, want context.Canceled", err)
+		}
+	})
+	// Watch adds its watches before it waits for events.
+	time.Sleep(100 * time.Millisecond)
+	return tw
+}
+
+// visited returns the paths of the files visited within d, sorted.
+func (tw *testWatch) visited(d time.Duration) []string {
+	var paths []string
+	timeout := time.After(d)
+	for {
+		select {
+		case f := <-tw.visits:
+			paths = append(paths, f.Path)
+		case <-timeout:
+			sort.Strings(paths)
+			return paths
+		}
+	}
+}
+
+func (tw *testWatch) removed(d time.Duration) []string {
+	var paths []string
+	timeout := time.After(d)
+	for {
+		select {
+		case path := <-tw.removes:
+			paths = append(paths, path)
+		case <-timeout:
+			sort.Strings(paths)
+			return paths
+		}
+	}
+}
+
+func equalPaths(got []string, want ...string) bool {
+	sort.Strings(want)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWatchDebounce(t *testing.T) {
+	root := t.TempDir()
+	tw := startWatch(t, root)
+
+	path := filepath.Join(root, "a.jpg")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(jpegHeader); err != nil {
+		t.Fatal(err)
+	}
+	// Writes closer together than the debounce delay keep the file
+	// pending.
+	for i := 0; i < 5; i++ {
+		time.Sleep(testDebounce / 3)
+		if _, err := f.WriteString("more data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastWrite := time.Now()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case visited := <-tw.visits:
+		if visited.Path != path || visited.Format == nil || visited.Format.Name != "jpeg" {
+			t.Errorf("visited %+v, want the JPEG at %s", visited, path)
+		}
+		if since := time.Since(lastWrite); since < testDebounce {
+			t.Errorf("visited %s after the last write, want at least %s", since, testDebounce)
+		}
+	case <-time.After(5 * testDebounce):
+		t.Fatalf("%s not visited", path)
+	}
+	if more := tw.visited(3 * testDebounce); len(more) != 0 {
+		t.Errorf("visited %v again, want one visit for the burst", more)
+	}
+}
+
+func TestWatchRemove(t *testing.T) {
+	root := t.TempDir()
+	elsewhere := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg", "sub/c.jpg"} {
+		writeFile(t, filepath.Join(root, name), jpegHeader)
+	}
+	tw := startWatch(t, root)
+
+	if err := os.Remove(filepath.Join(root, "a.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(root, "b.jpg"), filepath.Join(elsewhere, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(root, "sub"), filepath.Join(elsewhere, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if got := tw.removed(2 * testDebounce); !equalPaths(got, filepath.Join(root, "a.jpg"), filepath.Join(root, "b.jpg"), filepath.Join(root, "sub")) {
+		t.Errorf("removed %v, want a.jpg, b.jpg and sub", got)
+	}
+
+	// The directory moved away is no longer watched.
+	writeFile(t, filepath.Join(elsewhere, "sub", "d.jpg"), jpegHeader)
+	if got := tw.visited(3 * testDebounce); len(got) != 0 {
+		t.Errorf("visited %v outside the tree", got)
+	}
+}
+
+func TestWatchNewDirectory(t *testing.T) {
+	root := t.TempDir()
+	elsewhere := t.TempDir()
+	tw := startWatch(t, root)
+
+	// A directory moved in arrives with its files, which no watch saw.
+	writeFile(t, filepath.Join(elsewhere, "trip", "a.jpg"), jpegHeader)
+	writeFile(t, filepath.Join(elsewhere, "trip", "day2", "b.jpg"), jpegHeader)
+	trip := filepath.Join(root, "trip")
+	if err := os.Rename(filepath.Join(elsewhere, "trip"), trip); err != nil {
+		t.Fatal(err)
+	}
+	if got := tw.visited(3 * testDebounce); !equalPaths(got, filepath.Join(trip, "a.jpg"), filepath.Join(trip, "day2", "b.jpg")) {
+		t.Errorf("visited %v, want the files of the moved directory", got)
+	}
+
+	// Its directories are watched from then on.
+	writeFile(t, filepath.Join(trip, "day2", "c.jpg"), jpegHeader)
+	if got := tw.visited(3 * testDebounce); !equalPaths(got, filepath.Join(trip, "day2", "c.jpg")) {
+		t.Errorf("visited %v, want the file written into the new directory", got)
+	}
+}
+
+func TestWatchSidecar(t *testing.T) {
+	root := t.TempDir()
+	image := filepath.Join(root, "a.jpg")
+	writeFile(t, image, jpegHeader)
+	writeFile(t, filepath.Join(root, "b.jpg"), jpegHeader)
+	tw := startWatch(t, root)
+
+	sidecar := filepath.Join(root, "a.xmp")
+	writeFile(t, sidecar, "<x:xmpmeta/>")
+	select {
+	case f := <-tw.visits:
+		if f.Path != image || f.Sidecar != sidecar {
+			t.Errorf("visited %s with sidecar %q, want %s with %s", f.Path, f.Sidecar, image, sidecar)
+		}
+	case <-time.After(5 * testDebounce):
+		t.Fatalf("%s not visited for its new sidecar", image)
+	}
+	if got := tw.visited(2 * testDebounce); len(got) != 0 {
+		t.Errorf("visited %v as well, want only the image of the sidecar", got)
+	}
+
+	if err := os.Remove(sidecar); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-tw.visits:
+		if f.Path != image || f.Sidecar != "" {
+			t.Errorf("visited %s with sidecar %q, want %s without", f.Path, f.Sidecar, image)
+		}
+	case <-time.After(5 * testDebounce):
+		t.Fatalf("%s not visited after its sidecar was deleted", image)
+	}
+	// Sidecars are not visited on their own, so neither are they removed.
+	if got := tw.removed(testDebounce); len(got) != 0 {
+		t.Errorf("removed %v, want nothing", got)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package filescanner
+
+import (
+	"context"
+	"errors"
+)
+
+// Watch is only implemented on Linux.
+func Watch(ctx context.Context, root string, visit ScannerVisitorFunc, opts WatchOptions) error {
+	return errors.New("filescanner: watching is only supported on Linux")
+}
@@ -0,0 +1,81 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+// MaxZoom is the deepest zoom level clustered; beyond it every point is
+// its own cluster.
+const MaxZoom = 20
+
+// CellSize is the size of a clustering cell in pixels of a 256 pixel tile.
+const CellSize = 64
+
+// Cluster is a group of points that fall into the same grid cell at some
+// zoom level. Center is the mean of its points.
+type Cluster struct {
+	Center Point
+	Ids    []int64
+}
+
+// ClusterPoints groups points into cells of CellSize pixels of the Web
+// Mercator projection at zoom. ids and points are parallel slices. The
+// clusters are ordered by their first id so that output is stable.
+func ClusterPoints(ids []int64, points []Point, zoom int) []Cluster {
+	if zoom > MaxZoom {
+		clusters := make([]Cluster, len(points))
+		for i := range points {
+			clusters[i] = Cluster{Center: points[i], Ids: []int64{ids[i]}}
+		}
+		return clusters
+	}
+	if zoom < 0 {
+		zoom = 0
+	}
+
+	type cell struct{ x, y int64 }
+	type sum struct {
+		first     Point
+		lat, x, y float64
+		ids       []int64
+	}
+	cells := make(map[cell]*sum)
+	cellsPerSide := math.Exp2(float64(zoom)) * 256 / CellSize
+	for i, p := range points {
+		x, y := project(p)
+		c := cell{int64(x * cellsPerSide), int64(y * cellsPerSide)}
+		s := cells[c]
+		if s == nil {
+			s = &sum{first: p}
+			cells[c] = s
+		}
+		// Longitudes are averaged as unit vectors so that a cell on the
+		// antimeridian does not center on the prime meridian.
+		s.lat += p.Lat
+		s.x += math.Cos(radians(p.Lon))
+		s.y += math.Sin(radians(p.Lon))
+		s.ids = append(s.ids, ids[i])
+	}
+
+	clusters := make([]Cluster, 0, len(cells))
+	for _, s := range cells {
+		center := s.first
+		if n := float64(len(s.ids)); n > 1 {
+			center = Point{Lat: s.lat / n, Lon: degrees(math.Atan2(s.y, s.x))}
+		}
+		clusters = append(clusters, Cluster{Center: center, Ids: s.ids})
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Ids[0] < clusters[j].Ids[0] })
+	return clusters
+}
+
+// project returns the Web Mercator position of p, both coordinates in
+// [0, 1) from the north-west corner.
+func project(p Point) (float64, float64) {
+	lat := math.Max(-85.05112878, math.Min(85.05112878, p.Lat))
+	x := (p.Lon + 180) / 360
+	sin := math.Sin(radians(lat))
+	y := 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+	return math.Min(x, math.Nextafter(1, 0)), math.Min(math.Max(y, 0), math.Nextafter(1, 0))
+}
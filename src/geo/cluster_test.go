@@ -0,0 +1,80 @@
+package geo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestClusterPoints(t *testing.T) {
+	ids := []int64{1, 2, 3, 4, 5}
+	points := []Point{
+		{52.3731, 4.8926}, // Dam, Amsterdam
+		{52.3791, 4.9003}, // Amsterdam Centraal
+		{48.8566, 2.3522}, // Paris
+		{0, 179.5},        // two points in the cell next to
+		{0, 179.9},        // the antimeridian
+	}
+	tests := []struct {
+		zoom int
+		want [][]int64
+	}{
+		{-1, [][]int64{{1, 2, 3}, {4, 5}}},
+		{0, [][]int64{{1, 2, 3}, {4, 5}}},
+		{5, [][]int64{{1, 2}, {3}, {4, 5}}},
+		{10, [][]int64{{1}, {2}, {3}, {4}, {5}}},
+		{MaxZoom + 1, [][]int64{{1}, {2}, {3}, {4}, {5}}},
+	}
+	for _, test := range tests {
+		clusters := ClusterPoints(ids, points, test.zoom)
+		var got [][]int64
+		for _, c := range clusters {
+			got = append(got, c.Ids)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("zoom %d: clusters %v, want %v", test.zoom, got, test.want)
+			continue
+		}
+
+		for _, c := range clusters {
+			if len(c.Ids) == 1 {
+				if p := points[c.Ids[0]-1]; c.Center != p {
+					t.Errorf("zoom %d: single point %v centered on %+v", test.zoom, p, c.Center)
+				}
+				continue
+			}
+			var lat, lon float64
+			for _, id := range c.Ids {
+				lat += points[id-1].Lat
+				lon += points[id-1].Lon
+			}
+			n := float64(len(c.Ids))
+			if math.Abs(c.Center.Lat-lat/n) > 1e-9 || math.Abs(c.Center.Lon-lon/n) > 1e-3 {
+				t.Errorf("zoom %d: cluster %v centered on %+v, want near %v,%v", test.zoom, c.Ids, c.Center, lat/n, lon/n)
+			}
+		}
+	}
+
+	if got := ClusterPoints(nil, nil, 3); len(got) != 0 {
+		t.Errorf("clusters of no points = %v", got)
+	}
+}
+
+func TestClusterAntimeridian(t *testing.T) {
+	// A cell is never split by the antimeridian, so place two points in
+	// one cell and check that the unit vector mean stays near 180.
+	points := []Point{{5, 179.99}, {15, 179.95}, {10, 179.97}}
+	clusters := ClusterPoints([]int64{7, 8, 9}, points, 2)
+	if len(clusters) != 1 {
+		t.Fatalf("clusters = %v, want one", clusters)
+	}
+	if c := clusters[0].Center; math.Abs(c.Lon-179.97) > 1e-6 || math.Abs(c.Lat-10) > 1e-9 {
+		t.Errorf("center = %+v, want 10,179.97", c)
+	}
+
+	// The poles are clamped rather than projected to infinity.
+	polar := ClusterPoints([]int64{1, 2}, []Point{{90, 0}, {89.9, 0}}, 4)
+	if len(polar) != 1 {
+		t.Errorf("polar clusters = %v, want one", polar)
+	}
+}
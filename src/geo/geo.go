@@ -0,0 +1,118 @@
+// Package geo has the geometry behind the map API: distances, bounding
+// boxes, clustering by zoom level and GeoJSON output.
+package geo
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// EarthRadius is the mean radius of the earth in metres.
+const EarthRadius = 6371008.8
+
+var ErrInvalidBounds = errors.New("geo: expected west,south,east,north in degrees")
+
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+func (p Point) Valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func degrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// Distance returns the great-circle distance between a and b in metres.
+func Distance(a Point, b Point) float64 {
+	dLat := radians(b.Lat - a.Lat)
+	dLon := radians(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(radians(a.Lat))*math.Cos(radians(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Bounds is a box in degrees. West is greater than East when the box
+// crosses the antimeridian.
+type Bounds struct {
+	West  float64
+	South float64
+	East  float64
+	North float64
+}
+
+// ParseBounds parses "west,south,east,north", the order of a GeoJSON bbox.
+func ParseBounds(s string) (Bounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Bounds{}, ErrInvalidBounds
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return Bounds{}, ErrInvalidBounds
+		}
+		v[i] = f
+	}
+
+	b := Bounds{West: v[0], South: v[1], East: v[2], North: v[3]}
+	if !(Point{b.South, b.West}).Valid() || !(Point{b.North, b.East}).Valid() || b.South > b.North {
+		return Bounds{}, ErrInvalidBounds
+	}
+	return b, nil
+}
+
+// CrossesAntimeridian reports whether the box wraps from 180 to -180.
+func (b Bounds) CrossesAntimeridian() bool {
+	return b.West > b.East
+}
+
+func (b Bounds) Contains(p Point) bool {
+	if p.Lat < b.South || p.Lat > b.North {
+		return false
+	}
+	if b.CrossesAntimeridian() {
+		return p.Lon >= b.West || p.Lon <= b.East
+	}
+	return p.Lon >= b.West && p.Lon <= b.East
+}
+
+// Around returns a box holding every point within radius metres of p.
+// Near the poles it covers every longitude.
+func Around(p Point, radius float64) Bounds {
+	dLat := degrees(radius / EarthRadius)
+	b := Bounds{South: p.Lat - dLat, North: p.Lat + dLat, West: -180, East: 180}
+	if b.South <= -90 || b.North >= 90 {
+		b.South = math.Max(b.South, -90)
+		b.North = math.Min(b.North, 90)
+		return b
+	}
+
+	dLon := degrees(math.Asin(math.Min(1, math.Sin(radius/EarthRadius)/math.Cos(radians(p.Lat)))))
+	if dLon >= 180 {
+		return b
+	}
+	b.West = wrap(p.Lon - dLon)
+	b.East = wrap(p.Lon + dLon)
+	return b
+}
+
+// wrap brings a longitude back into [-180, 180].
+func wrap(lon float64) float64 {
+	for lon < -180 {
+		lon += 360
+	}
+	for lon > 180 {
+		lon -= 360
+	}
+	return lon
+}
@@ -0,0 +1,115 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseBounds(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Bounds
+		crosses bool
+	}{
+		{"-10,-20,30,40", Bounds{West: -10, South: -20, East: 30, North: 40}, false},
+		{" 4.7, 52.2 ,5.1,52.5 ", Bounds{West: 4.7, South: 52.2, East: 5.1, North: 52.5}, false},
+		{"-180,-90,180,90", Bounds{West: -180, South: -90, East: 180, North: 90}, false},
+		{"0,10,0,10", Bounds{South: 10, North: 10}, false},
+		{"170,-10,-170,10", Bounds{West: 170, South: -10, East: -170, North: 10}, true},
+		{"180,0,-180,1", Bounds{West: 180, South: 0, East: -180, North: 1}, true},
+	}
+	for _, test := range tests {
+		b, err := ParseBounds(test.s)
+		if err != nil {
+			t.Errorf("ParseBounds(%q) = %v", test.s, err)
+			continue
+		}
+		if b != test.want {
+			t.Errorf("ParseBounds(%q) = %+v, want %+v", test.s, b, test.want)
+		}
+		if b.CrossesAntimeridian() != test.crosses {
+			t.Errorf("ParseBounds(%q).CrossesAntimeridian() = %v", test.s, !test.crosses)
+		}
+	}
+
+	for _, s := range []string{
+		// Inverted latitudes; inverted longitudes cross the antimeridian.
+		"0,10,10,-10",
+		// Out of range.
+		"-181,0,0,0",
+		"0,-91,0,0",
+		"0,0,181,0",
+		"0,0,0,91",
+		"-Inf,0,0,0",
+		"NaN,0,0,0",
+		// Malformed.
+		"",
+		"1,2,3",
+		"1,2,3,4,5",
+		"1,,3,4",
+		"a,b,c,d",
+		"1;2;3;4",
+		"0x1p-2,0,1,1,",
+	} {
+		if b, err := ParseBounds(s); err != ErrInvalidBounds {
+			t.Errorf("ParseBounds(%q) = %+v, %v, want ErrInvalidBounds", s, b, err)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	box := Bounds{West: -10, South: -20, East: 30, North: 40}
+	across := Bounds{West: 170, South: -10, East: -170, North: 10}
+	tests := []struct {
+		b    Bounds
+		p    Point
+		want bool
+	}{
+		{box, Point{0, 0}, true},
+		{box, Point{40, 30}, true},
+		{box, Point{-20, -10}, true},
+		{box, Point{41, 0}, false},
+		{box, Point{0, 31}, false},
+		{across, Point{0, 175}, true},
+		{across, Point{0, -175}, true},
+		{across, Point{0, 180}, true},
+		{across, Point{0, -180}, true},
+		{across, Point{0, 0}, false},
+		{across, Point{0, 169}, false},
+		{across, Point{11, 175}, false},
+	}
+	for _, test := range tests {
+		if got := test.b.Contains(test.p); got != test.want {
+			t.Errorf("%+v contains %+v = %v, want %v", test.b, test.p, got, test.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	degree := 2 * math.Pi * EarthRadius / 360
+	tests := []struct {
+		a, b      Point
+		want, tol float64
+	}{
+		{Point{52.3731, 4.8926}, Point{52.3731, 4.8926}, 0, 1e-9},
+		{Point{0, 0}, Point{0, 1}, degree, 1e-6},
+		{Point{0, 0}, Point{1, 0}, degree, 1e-6},
+		{Point{0, 179.5}, Point{0, -179.5}, degree, 1e-6},
+		{Point{90, 0}, Point{-90, 0}, math.Pi * EarthRadius, 1e-6},
+		{Point{0, 0}, Point{0, 180}, math.Pi * EarthRadius, 1e-6},
+		{Point{90, 0}, Point{90, 120}, 0, 1e-6},
+		// London to Paris is about 343.5 km.
+		{Point{51.5074, -0.1278}, Point{48.8566, 2.3522}, 343.5e3, 500},
+		// New York to Los Angeles is about 3936 km.
+		{Point{40.7128, -74.0060}, Point{34.0522, -118.2437}, 3936e3, 5e3},
+	}
+	for _, test := range tests {
+		got := Distance(test.a, test.b)
+		if math.Abs(got-test.want) > test.tol {
+			t.Errorf("Distance(%+v, %+v) = %.1f, want %.1f", test.a, test.b, got, test.want)
+		}
+		if back := Distance(test.b, test.a); math.Abs(back-got) > 1e-6 {
+			t.Errorf("Distance(%+v, %+v) = %.1f, but %.1f the other way", test.a, test.b, got, back)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package gpx reads track logs in the GPS Exchange Format and finds where
+// the track was at a given time.
+package gpx
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+var ErrNoPoints = errors.New("gpx: no timed track points")
+
+// FormatError reports a document that is not well-formed GPX.
+type FormatError struct {
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	return "gpx: " + e.Err.Error()
+}
+
+// Point is a timed track point. Elevation is in metres.
+type Point struct {
+	Time         time.Time
+	Latitude     float64
+	Longitude    float64
+	Elevation    float64
+	HasElevation bool
+}
+
+// Track holds the segments of every track in a file. Positions are only
+// interpolated within a segment, since a gap between segments means the
+// receiver was off.
+type Track struct {
+	Segments [][]Point
+}
+
+type document struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []struct {
+				Lat  float64  `xml:"lat,attr"`
+				Lon  float64  `xml:"lon,attr"`
+				Ele  *float64 `xml:"ele"`
+				Time string   `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// Decode reads a GPX document. Points without a valid time are dropped and
+// each segment is sorted by time.
+func Decode(r io.Reader) (*Track, error) {
+	var doc document
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		if _, ok := err.(*xml.SyntaxError); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, &FormatError{err}
+		}
+		return nil, err
+	}
+
+	track := &Track{}
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			var points []Point
+			for _, pt := range seg.Points {
+				t, err := time.Parse(time.RFC3339, pt.Time)
+				if err != nil || pt.Lat < -90 || pt.Lat > 90 || pt.Lon < -180 || pt.Lon > 180 {
+					continue
+				}
+				p := Point{Time: t.UTC(), Latitude: pt.Lat, Longitude: pt.Lon}
+				if pt.Ele != nil {
+					p.Elevation, p.HasElevation = *pt.Ele, true
+				}
+				points = append(points, p)
+			}
+			if len(points) == 0 {
+				continue
+			}
+			sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+			track.Segments = append(track.Segments, points)
+		}
+	}
+	if len(track.Segments) == 0 {
+		return nil, ErrNoPoints
+	}
+	return track, nil
+}
+
+// Add appends the segments of another track.
+func (t *Track) Add(other *Track) {
+	t.Segments = append(t.Segments, other.Segments...)
+}
+
+// Start and End bound the times covered by the track.
+func (t *Track) Start() time.Time {
+	start := t.Segments[0][0].Time
+	for _, seg := range t.Segments[1:] {
+		if seg[0].Time.Before(start) {
+			start = seg[0].Time
+		}
+	}
+	return start
+}
+
+func (t *Track) End() time.Time {
+	end := t.Segments[0][len(t.Segments[0])-1].Time
+	for _, seg := range t.Segments[1:] {
+		if last := seg[len(seg)-1].Time; last.After(end) {
+			end = last
+		}
+	}
+	return end
+}
+
+// Locate returns the position at time at, interpolated linearly between
+// the two track points around it. ok is false when at is outside every
+// segment or the points around it are more than maxGap apart. gap is the
+// time to the nearer of the two points.
+func (t *Track) Locate(at time.Time, maxGap time.Duration) (p Point, gap time.Duration, ok bool) {
+	for _, seg := range t.Segments {
+		i := sort.Search(len(seg), func(i int) bool { return !seg[i].Time.Before(at) })
+		if i == len(seg) {
+			continue
+		}
+		if seg[i].Time.Equal(at) {
+			return seg[i], 0, true
+		}
+		if i == 0 {
+			continue
+		}
+
+		before, after := seg[i-1], seg[i]
+		span := after.Time.Sub(before.Time)
+		if span > maxGap {
+			continue
+		}
+		f := float64(at.Sub(before.Time)) / float64(span)
+		p = Point{
+			Time:      at,
+			Latitude:  before.Latitude + f*(after.Latitude-before.Latitude),
+			Longitude: interpolateLongitude(before.Longitude, after.Longitude, f),
+		}
+		if before.HasElevation && after.HasElevation {
+			p.Elevation, p.HasElevation = before.Elevation+f*(after.Elevation-before.Elevation), true
+		}
+		gap = at.Sub(before.Time)
+		if d := after.Time.Sub(at); d < gap {
+			gap = d
+		}
+		return p, gap, true
+	}
+	return Point{}, 0, false
+}
+
+// interpolateLongitude goes the short way round, across the antimeridian
+// if need be.
+func interpolateLongitude(a float64, b float64, f float64) float64 {
+	d := b - a
+	if d > 180 {
+		d -= 360
+	} else if d < -180 {
+		d += 360
+	}
+	lon := a + f*d
+	if lon > 180 {
+		lon -= 360
+	} else if lon < -180 {
+		lon += 360
+	}
+	return lon
+}
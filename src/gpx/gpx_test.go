@@ -0,0 +1,113 @@
+package gpx
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTrack = `<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+ <trk>
+  <trkseg>
+   <trkpt lat="1.0" lon="103.0"><ele>10</ele><time>2019-05-01T10:00:00Z</time></trkpt>
+   <trkpt lat="1.2" lon="103.4"><ele>30</ele><time>2019-05-01T10:10:00+08:00</time></trkpt>
+   <trkpt lat="1.1" lon="103.2"><ele>20</ele><time>2019-05-01T10:05:00Z</time></trkpt>
+   <trkpt lat="5" lon="5"><time>not a time</time></trkpt>
+   <trkpt lat="95" lon="5"><time>2019-05-01T10:06:00Z</time></trkpt>
+   <trkpt lat="2.0" lon="104.0"><time>2019-05-01T11:00:00Z</time></trkpt>
+  </trkseg>
+  <trkseg>
+   <trkpt lat="10" lon="179.5"><time>2019-05-02T00:00:00Z</time></trkpt>
+   <trkpt lat="11" lon="-179.5"><ele>5</ele><time>2019-05-02T00:10:00Z</time></trkpt>
+  </trkseg>
+ </trk>
+</gpx>`
+
+func TestDecode(t *testing.T) {
+	track, err := Decode(strings.NewReader(testTrack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(track.Segments) != 2 || len(track.Segments[0]) != 4 || len(track.Segments[1]) != 2 {
+		t.Fatalf("segments = %v", track.Segments)
+	}
+	first := track.Segments[0]
+	for i := 1; i < len(first); i++ {
+		if first[i].Time.Before(first[i-1].Time) {
+			t.Errorf("segment not sorted: %v", first)
+		}
+	}
+	if first[0].Time.Location() != time.UTC || first[0].Time.Hour() != 2 {
+		t.Errorf("first point at %v, want the +08:00 point in UTC", first[0].Time)
+	}
+	if got, want := track.Start(), time.Date(2019, 5, 1, 2, 10, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Start = %v, want %v", got, want)
+	}
+	if got, want := track.End(), time.Date(2019, 5, 2, 0, 10, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("End = %v, want %v", got, want)
+	}
+
+	for _, doc := range []string{"", "<gpx><trk>", "not xml <"} {
+		if _, err := Decode(strings.NewReader(doc)); err == nil {
+			t.Errorf("Decode(%q) = nil error", doc)
+		} else if _, ok := err.(*FormatError); !ok {
+			t.Errorf("Decode(%q) = %v, want a FormatError", doc, err)
+		}
+	}
+	if _, err := Decode(strings.NewReader(`<gpx><trk><trkseg><trkpt lat="1" lon="1"/></trkseg></trk></gpx>`)); err != ErrNoPoints {
+		t.Errorf("Decode without timed points = %v, want ErrNoPoints", err)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	track, err := Decode(strings.NewReader(testTrack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name     string
+		at       string
+		maxGap   time.Duration
+		lat, lon float64
+		ele      float64
+		hasEle   bool
+		gap      time.Duration
+		ok       bool
+	}{
+		{"on a point", "2019-05-01T10:05:00Z", time.Minute, 1.1, 103.2, 20, true, 0, true},
+		{"between points", "2019-05-01T10:02:00Z", 10 * time.Minute, 1.04, 103.08, 14, true, 2 * time.Minute, true},
+		{"nearer the later point", "2019-05-01T10:04:00Z", time.Hour, 1.08, 103.16, 18, true, time.Minute, true},
+		{"gap of maxGap", "2019-05-01T10:02:00Z", 5 * time.Minute, 1.04, 103.08, 14, true, 2 * time.Minute, true},
+		{"gap just over maxGap", "2019-05-01T10:02:00Z", 5*time.Minute - time.Nanosecond, 0, 0, 0, false, 0, false},
+		{"across a long gap", "2019-05-01T10:30:00Z", 20 * time.Minute, 0, 0, 0, false, 0, false},
+		{"long gap allowed", "2019-05-01T10:35:00Z", time.Hour, 1.1 + 0.9*6/11, 103.2 + 0.8*6/11, 0, false, 25 * time.Minute, true},
+		{"before the track", "2019-05-01T01:00:00Z", time.Hour, 0, 0, 0, false, 0, false},
+		{"after the track", "2019-05-03T00:00:00Z", time.Hour, 0, 0, 0, false, 0, false},
+		{"between segments", "2019-05-01T18:00:00Z", 24 * time.Hour, 0, 0, 0, false, 0, false},
+		{"across the antimeridian", "2019-05-02T00:05:00Z", time.Hour, 10.5, 180, 0, false, 5 * time.Minute, true},
+		{"just past the antimeridian", "2019-05-02T00:07:30Z", time.Hour, 10.75, -179.75, 0, false, 2*time.Minute + 30*time.Second, true},
+	}
+	for _, test := range tests {
+		p, gap, ok := track.Locate(at(test.at), test.maxGap)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v", test.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if math.Abs(p.Latitude-test.lat) > 1e-9 || math.Abs(math.Abs(p.Longitude)-math.Abs(test.lon)) > 1e-9 ||
+			p.HasElevation != test.hasEle || math.Abs(p.Elevation-test.ele) > 1e-9 || gap != test.gap {
+			t.Errorf("%s: Locate = %+v, %v, want %v, %v, %v, %v", test.name, p, gap, test.lat, test.lon, test.ele, test.gap)
+		}
+	}
+}
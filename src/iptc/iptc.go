@@ -0,0 +1,209 @@
+// Package iptc reads the IPTC-IIM block that news agencies, scanning
+// software and older editors write into the APP13 segment of JPEG files,
+// and into TIFF files as the IPTC-NAA tag.
+package iptc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"jpegseg"
+)
+
+var (
+	ErrNoIPTC  = errors.New("iptc: no IPTC data")
+	ErrInvalid = errors.New("iptc: invalid IPTC data")
+)
+
+// Datasets of the application record, record 2.
+const (
+	ObjectName        = 5
+	Keywords          = 25
+	Byline            = 80
+	City              = 90
+	CopyrightNotice   = 116
+	CaptionAbstract   = 120
+	codedCharacterSet = 90 // in the envelope record, record 1
+)
+
+// Metadata holds the datasets boonfoto uses.
+type Metadata struct {
+	Title     string
+	Caption   string
+	Byline    string
+	Copyright string
+	City      string
+	Keywords  []string
+}
+
+// Parse reads an IIM stream, a run of tagged datasets. Text is decoded as
+// UTF-8 when the envelope declares it or when it is valid UTF-8 anyway,
+// and as ISO 8859-1 otherwise.
+func Parse(data []byte) (Metadata, error) {
+	var m Metadata
+	utf8Declared := false
+	type dataset struct {
+		number byte
+		value  []byte
+	}
+	var datasets []dataset
+
+	for len(data) > 0 {
+		if data[0] != 0x1c {
+			// Padding after the last dataset.
+			break
+		}
+		if len(data) < 5 {
+			return m, ErrInvalid
+		}
+		record, number := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		data = data[5:]
+		if size&0x8000 != 0 {
+			// Extended dataset: the low bits give the size of the length.
+			n := size & 0x7fff
+			if n > 4 || len(data) < n {
+				return m, ErrInvalid
+			}
+			size = 0
+			for _, b := range data[:n] {
+				size = size<<8 | int(b)
+			}
+			data = data[n:]
+		}
+		if size < 0 || size > len(data) {
+			return m, ErrInvalid
+		}
+		value := data[:size]
+		data = data[size:]
+
+		switch record {
+		case 1:
+			if number == codedCharacterSet && bytes.Equal(value, []byte("\x1b%G")) {
+				utf8Declared = true
+			}
+		case 2:
+			datasets = append(datasets, dataset{number, value})
+		}
+	}
+	if len(datasets) == 0 {
+		return m, ErrNoIPTC
+	}
+
+	for _, d := range datasets {
+		s := strings.TrimSpace(decodeText(d.value, utf8Declared))
+		if s == "" {
+			continue
+		}
+		switch d.number {
+		case ObjectName:
+			m.Title = s
+		case Keywords:
+			m.Keywords = append(m.Keywords, s)
+		case Byline:
+			if m.Byline != "" {
+				s = m.Byline + ", " + s
+			}
+			m.Byline = s
+		case City:
+			m.City = s
+		case CopyrightNotice:
+			m.Copyright = s
+		case CaptionAbstract:
+			m.Caption = s
+		}
+	}
+	return m, nil
+}
+
+func decodeText(b []byte, utf8Declared bool) string {
+	if utf8Declared || utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+var photoshopHeader = []byte("Photoshop 3.0\x00")
+
+// resourceIPTC is the Photoshop image resource holding the IIM stream.
+const resourceIPTC = 0x0404
+
+// FindSegment returns the APP13 segment holding Photoshop image resources,
+// or nil.
+func FindSegment(segments []jpegseg.Segment) *jpegseg.Segment {
+	for i := range segments {
+		if segments[i].Marker == jpegseg.APP13 && bytes.HasPrefix(segments[i].Data, photoshopHeader) {
+			return &segments[i]
+		}
+	}
+	return nil
+}
+
+// ParsePhotoshop reads the IIM stream among the image resources of an
+// APP13 segment.
+func ParsePhotoshop(data []byte) (Metadata, error) {
+	if !bytes.HasPrefix(data, photoshopHeader) {
+		return Metadata{}, ErrNoIPTC
+	}
+	data = data[len(photoshopHeader):]
+
+	// Each resource is "8BIM", an id, a padded Pascal name and the size
+	// of the padded data.
+	for len(data) >= 12 && bytes.HasPrefix(data, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(data[4:])
+		nameSize := int(data[6]) + 1
+		nameSize += nameSize & 1
+		if len(data) < 6+nameSize+4 {
+			return Metadata{}, ErrInvalid
+		}
+		data = data[6+nameSize:]
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size < 0 || size > len(data) {
+			return Metadata{}, ErrInvalid
+		}
+		if id == resourceIPTC {
+			return Parse(data[:size])
+		}
+		size += size & 1
+		if size > len(data) {
+			break
+		}
+		data = data[size:]
+	}
+	return Metadata{}, ErrNoIPTC
+}
+
+// DecodeJPEG reads the IPTC data of the JPEG file in r.
+func DecodeJPEG(r io.Reader) (Metadata, error) {
+	segments, err := jpegseg.ReadSegments(r, func(marker byte) bool {
+		return marker == jpegseg.APP13
+	})
+	segment := FindSegment(segments)
+	if segment == nil {
+		if err != nil {
+			return Metadata{}, err
+		}
+		return Metadata{}, ErrNoIPTC
+	}
+	return ParsePhotoshop(segment.Data)
+}
+
+// DecodeFile reads the IPTC data of a JPEG file.
+func DecodeFile(path string) (Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer f.Close()
+	return DecodeJPEG(f)
+}
@@ -0,0 +1,122 @@
+package iptc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"jpegseg"
+)
+
+// dataset returns a dataset of record with value, extended when it does not
+// fit a standard one.
+func dataset(record byte, number byte, value string) []byte {
+	b := []byte{0x1c, record, number, 0, 0}
+	if len(value) < 0x8000 {
+		binary.BigEndian.PutUint16(b[3:], uint16(len(value)))
+	} else {
+		binary.BigEndian.PutUint16(b[3:], 0x8004)
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[5:], uint32(len(value)))
+	}
+	return append(b, value...)
+}
+
+func stream(datasets ...[]byte) []byte {
+	return bytes.Join(datasets, nil)
+}
+
+func TestParse(t *testing.T) {
+	utf8 := dataset(1, codedCharacterSet, "\x1b%G")
+	tests := []struct {
+		name string
+		data []byte
+		want Metadata
+		err  error
+	}{
+		{"latin-1", stream(dataset(2, CaptionAbstract, "Caf\xe9 in M\xfcnchen"), dataset(2, City, "M\xfcnchen")),
+			Metadata{Caption: "Café in München", City: "München"}, nil},
+		{"undeclared utf-8", stream(dataset(2, CaptionAbstract, "Café in München")),
+			Metadata{Caption: "Café in München"}, nil},
+		{"declared utf-8", stream(utf8, dataset(2, ObjectName, "東京"), dataset(2, Byline, "Zoë")),
+			Metadata{Title: "東京", Byline: "Zoë"}, nil},
+		{"declared after the text", stream(dataset(2, ObjectName, "Zo\xc3\xab"), utf8),
+			Metadata{Title: "Zoë"}, nil},
+		{"other character set", stream(dataset(1, codedCharacterSet, "\x1b-A"), dataset(2, ObjectName, "Zo\xeb")),
+			Metadata{Title: "Zoë"}, nil},
+		{"repeated datasets", stream(
+			dataset(2, Keywords, "beach"), dataset(2, Keywords, " "), dataset(2, Keywords, "sea "),
+			dataset(2, Byline, "Ann"), dataset(2, Byline, "Bob"), dataset(2, CopyrightNotice, "© Ann")),
+			Metadata{Keywords: []string{"beach", "sea"}, Byline: "Ann, Bob", Copyright: "© Ann"}, nil},
+		{"extended dataset", stream(dataset(2, CaptionAbstract, string(bytes.Repeat([]byte("a"), 0x8000)))),
+			Metadata{Caption: string(bytes.Repeat([]byte("a"), 0x8000))}, nil},
+		{"padding", append(stream(dataset(2, ObjectName, "Title")), 0, 0, 0),
+			Metadata{Title: "Title"}, nil},
+		{"other records", stream(dataset(1, 0, "\x00\x04"), dataset(3, ObjectName, "not this")),
+			Metadata{}, ErrNoIPTC},
+		{"empty", nil, Metadata{}, ErrNoIPTC},
+		{"short header", []byte{0x1c, 2, ObjectName, 0}, Metadata{}, ErrInvalid},
+		{"size past the end", []byte{0x1c, 2, ObjectName, 0, 9, 'a'}, Metadata{}, ErrInvalid},
+		{"oversized length field", []byte{0x1c, 2, ObjectName, 0x80, 0x05, 0, 0, 0, 0, 1}, Metadata{}, ErrInvalid},
+	}
+	for _, test := range tests {
+		m, err := Parse(test.data)
+		if err != test.err {
+			t.Errorf("%s: Parse = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(m, test.want) {
+			t.Errorf("%s: Parse = %+v, want %+v", test.name, m, test.want)
+		}
+	}
+}
+
+// resource returns a Photoshop image resource.
+func resource(id uint16, name string, data []byte) []byte {
+	b := append([]byte("8BIM\x00\x00"), byte(len(name)))
+	binary.BigEndian.PutUint16(b[4:], id)
+	b = append(b, name...)
+	if len(b)%2 != 0 {
+		b = append(b, 0)
+	}
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	iim := stream(dataset(2, ObjectName, "Title"))
+	tests := []struct {
+		name      string
+		resources []byte
+		err       error
+	}{
+		{"only resource", resource(resourceIPTC, "", iim), nil},
+		{"after others", stream(resource(0x03ed, "odd", []byte{1, 2, 3}), resource(0x040c, "", nil), resource(resourceIPTC, "IPTC", iim)), nil},
+		{"no IPTC resource", resource(0x03ed, "", []byte{1, 2, 3, 4}), ErrNoIPTC},
+		{"size past the end", append([]byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x10"), iim...), ErrInvalid},
+	}
+	for _, test := range tests {
+		data, err := jpegseg.Join([]jpegseg.Segment{
+			{Marker: jpegseg.APP13, Data: append(append([]byte(nil), photoshopHeader...), test.resources...)},
+		}, []byte{0xff, jpegseg.EOI})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := DecodeJPEG(bytes.NewReader(data))
+		if err != test.err {
+			t.Errorf("%s: DecodeJPEG = %v, want %v", test.name, err, test.err)
+		} else if err == nil && m.Title != "Title" {
+			t.Errorf("%s: Title = %q", test.name, m.Title)
+		}
+	}
+
+	if _, err := DecodeJPEG(bytes.NewReader([]byte{0xff, jpegseg.SOI, 0xff, jpegseg.EOI})); err != ErrNoIPTC {
+		t.Errorf("DecodeJPEG without APP13 = %v, want ErrNoIPTC", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Package jpegseg reads the marker segments at the head of a JPEG file,
+// where the metadata lives, without decoding the image.
+package jpegseg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	SOI   = 0xd8
+	EOI   = 0xd9
+	SOS   = 0xda
+	APP0  = 0xe0
+	APP1  = 0xe1
+	APP13 = 0xed
+)
+
+var (
+	ErrNotJPEG  = errors.New("jpegseg: not a JPEG file")
+	ErrTooLarge = errors.New("jpegseg: segment too large")
+)
+
+// Segment is one marker segment. Offset is the position of Data, the
+// payload after the length field, from the start of the file.
+type Segment struct {
+	Marker byte
+	Offset int64
+	Data   []byte
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// ReadSegments returns the segments from the start of the file up to, but
+// not including, the start of scan. The payload of the markers for which
+// keep returns false is skipped rather than read; a nil keep keeps all.
+func ReadSegments(r io.Reader, keep func(marker byte) bool) ([]Segment, error) {
+	segments, _, err := readSegments(r, keep)
+	return segments, err
+}
+
+// readSegments is ReadSegments that also returns the offset of the start
+// of scan marker.
+func readSegments(r io.Reader, keep func(marker byte) bool) ([]Segment, int64, error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+
+	var soi [2]byte
+	if _, err := io.ReadFull(cr, soi[:]); err != nil || soi[0] != 0xff || soi[1] != SOI {
+		return nil, 0, ErrNotJPEG
+	}
+
+	var segments []Segment
+	for {
+		marker, err := readMarker(cr)
+		if err != nil {
+			return segments, 0, err
+		}
+		if marker == SOS || marker == EOI {
+			return segments, cr.n - 2, nil
+		}
+		if marker >= 0xd0 && marker <= 0xd7 || marker == 0x01 {
+			// Standalone markers carry no length.
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(cr, binary.BigEndian, &length); err != nil {
+			return segments, 0, err
+		}
+		if length < 2 {
+			return segments, 0, errors.New("jpegseg: invalid segment length")
+		}
+
+		segment := Segment{Marker: marker, Offset: cr.n}
+		if keep == nil || keep(marker) {
+			segment.Data = make([]byte, length-2)
+			if _, err := io.ReadFull(cr, segment.Data); err != nil {
+				return segments, 0, err
+			}
+			segments = append(segments, segment)
+		} else if _, err := io.CopyN(ioutil.Discard, cr, int64(length-2)); err != nil {
+			return segments, 0, err
+		}
+	}
+}
+
+// readMarker skips to the next marker, allowing fill bytes before it.
+func readMarker(r io.ByteReader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, errors.New("jpegseg: expected marker")
+	}
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// Split returns all segments of the JPEG file data up to the start of
+// scan, and the rest of the file from there on: the image data.
+func Split(data []byte) ([]Segment, []byte, error) {
+	segments, scan, err := readSegments(bytes.NewReader(data), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return segments, data[scan:], nil
+}
+
+// Join returns a JPEG file made of segments followed by the image data
+// returned by Split.
+func Join(segments []Segment, image []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, SOI})
+	for _, s := range segments {
+		if len(s.Data)+2 > 0xffff {
+			return nil, ErrTooLarge
+		}
+		buf.Write([]byte{0xff, s.Marker, byte((len(s.Data) + 2) >> 8), byte(len(s.Data) + 2)})
+		buf.Write(s.Data)
+	}
+	buf.Write(image)
+	return buf.Bytes(), nil
+}
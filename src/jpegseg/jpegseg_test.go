@@ -0,0 +1,99 @@
+package jpegseg
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testImage = []byte{0xff, SOS, 0x00, 0x08, 0x01, 0x01, 0x00, 0x00, 0x3f, 0x00, 0x12, 0x34, 0xff, 0x00, 0xff, 0xd0, 0x56, 0xff, EOI}
+
+// testFile is a JPEG file with fill bytes before a marker.
+var testFile = append([]byte{
+	0xff, SOI,
+	0xff, APP0, 0x00, 0x07, 'J', 'F', 'I', 'F', 0x00,
+	0xff, 0xff, APP1, 0x00, 0x06, 'E', 'x', 'i', 'f',
+	0xff, 0xdb, 0x00, 0x03, 0x00,
+}, testImage...)
+
+func TestSplitJoin(t *testing.T) {
+	segments, image, err := Split(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Segment{
+		{APP0, 6, []byte("JFIF\x00")},
+		{APP1, 16, []byte("Exif")},
+		{0xdb, 24, []byte{0x00}},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, s := range segments {
+		if s.Marker != want[i].Marker || s.Offset != want[i].Offset || !bytes.Equal(s.Data, want[i].Data) {
+			t.Errorf("segment %d = %+v, want %+v", i, s, want[i])
+		}
+	}
+	if !bytes.Equal(image, testImage) {
+		t.Errorf("image = % x, want % x", image, testImage)
+	}
+
+	segments[1].Data = bytes.Repeat([]byte{'x'}, 1000)
+	data, err := Join(segments, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, rest, err := Split(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 3 || !bytes.Equal(again[1].Data, segments[1].Data) {
+		t.Error("edited segment not read back")
+	}
+	if !bytes.Equal(rest, testImage) {
+		t.Error("image data changed")
+	}
+	if !bytes.Equal(data[len(data)-len(testImage):], testImage) {
+		t.Error("file does not end with the image data")
+	}
+}
+
+func TestJoinTooLarge(t *testing.T) {
+	for _, n := range []int{0xffff - 2, 0xffff - 1} {
+		_, err := Join([]Segment{{Marker: APP1, Data: make([]byte, n)}}, testImage)
+		if want := n+2 > 0xffff; (err == ErrTooLarge) != want {
+			t.Errorf("Join of %d bytes: %v", n, err)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"png", []byte("\x89PNG\r\n\x1a\n")},
+		{"no marker", []byte{0xff, SOI, 0x00, 0x01}},
+		{"short length", []byte{0xff, SOI, 0xff, APP1, 0x00, 0x01}},
+		{"truncated", []byte{0xff, SOI, 0xff, APP1, 0x00, 0x10, 'E'}},
+		{"no scan", []byte{0xff, SOI, 0xff, APP0, 0x00, 0x02}},
+	}
+	for _, test := range tests {
+		if _, _, err := Split(test.data); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+	if _, _, err := Split([]byte("GIF89a")); err != ErrNotJPEG {
+		t.Errorf("Split of a GIF = %v, want ErrNotJPEG", err)
+	}
+}
+
+func TestReadSegmentsSkips(t *testing.T) {
+	segments, err := ReadSegments(bytes.NewReader(testFile), func(marker byte) bool { return marker == APP1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].Marker != APP1 || segments[0].Offset != 16 || string(segments[0].Data) != "Exif" {
+		t.Errorf("segments = %+v", segments)
+	}
+}
@@ -0,0 +1,89 @@
+package places
+
+import (
+	"math"
+	"sort"
+)
+
+// Index is a static k-d tree of places. The tree is implicit: every range
+// of nodes has its splitting node in the middle.
+type Index struct {
+	nodes []node
+}
+
+type node struct {
+	v     [3]float64
+	place *Place
+}
+
+func NewIndex(places []Place) *Index {
+	nodes := make([]node, len(places))
+	for i := range places {
+		nodes[i] = node{v: vector(places[i].Latitude, places[i].Longitude), place: &places[i]}
+	}
+	build(nodes, 0)
+	return &Index{nodes: nodes}
+}
+
+func build(nodes []node, axis int) {
+	if len(nodes) <= 1 {
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].v[axis] < nodes[j].v[axis] })
+	mid := len(nodes) / 2
+	build(nodes[:mid], (axis+1)%3)
+	build(nodes[mid+1:], (axis+1)%3)
+}
+
+func (idx *Index) Len() int {
+	return len(idx.nodes)
+}
+
+// Nearest returns the place closest to the position and its distance in
+// metres, or nil when the index is empty.
+func (idx *Index) Nearest(lat float64, lon float64) (*Place, float64) {
+	if len(idx.nodes) == 0 {
+		return nil, 0
+	}
+	s := search{target: vector(lat, lon), best: -1, bestDist: math.Inf(1)}
+	s.visit(idx.nodes, 0, 0)
+	return idx.nodes[s.best].place, surfaceDistance(math.Sqrt(s.bestDist))
+}
+
+type search struct {
+	target   [3]float64
+	best     int
+	bestDist float64
+}
+
+// visit searches the subtree held by nodes, which start at offset in the
+// index.
+func (s *search) visit(nodes []node, offset int, axis int) {
+	if len(nodes) == 0 {
+		return
+	}
+	mid := len(nodes) / 2
+	n := &nodes[mid]
+
+	var d float64
+	for i := 0; i < 3; i++ {
+		d += (n.v[i] - s.target[i]) * (n.v[i] - s.target[i])
+	}
+	if d < s.bestDist {
+		s.best, s.bestDist = offset+mid, d
+	}
+
+	diff := s.target[axis] - n.v[axis]
+	next := (axis + 1) % 3
+	if diff < 0 {
+		s.visit(nodes[:mid], offset, next)
+		if diff*diff < s.bestDist {
+			s.visit(nodes[mid+1:], offset+mid+1, next)
+		}
+	} else {
+		s.visit(nodes[mid+1:], offset+mid+1, next)
+		if diff*diff < s.bestDist {
+			s.visit(nodes[:mid], offset, next)
+		}
+	}
+}
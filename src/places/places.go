@@ -0,0 +1,161 @@
+// Package places finds the nearest populated place to a position, offline,
+// from the GeoNames data files:
+//
+//	cities1000.txt        (or cities500, cities5000, cities15000, allCountries)
+//	admin1CodesASCII.txt  names of first-level regions
+//	countryInfo.txt       names of countries
+//
+// from https://download.geonames.org/export/dump/.
+package places
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const earthRadius = 6371008.8
+
+// Place is a populated place. Region is the first-level administrative
+// division, such as a state or province.
+type Place struct {
+	Name        string
+	Region      string
+	Country     string
+	CountryCode string
+	Latitude    float64
+	Longitude   float64
+	Population  int64
+}
+
+// Load reads the GeoNames files into an index. The region and country
+// files may be empty paths, in which case their codes are used as names.
+func Load(cities string, admin1 string, countries string) (*Index, error) {
+	regionNames := map[string]string{}
+	if admin1 != "" {
+		m, err := readFile(admin1, ReadAdmin1)
+		if err != nil {
+			return nil, err
+		}
+		regionNames = m
+	}
+	countryNames := map[string]string{}
+	if countries != "" {
+		m, err := readFile(countries, ReadCountries)
+		if err != nil {
+			return nil, err
+		}
+		countryNames = m
+	}
+
+	f, err := os.Open(cities)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	places, err := ReadCities(f, regionNames, countryNames)
+	if err != nil {
+		return nil, err
+	}
+	return NewIndex(places), nil
+}
+
+func readFile(path string, read func(io.Reader) (map[string]string, error)) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return read(f)
+}
+
+// records calls fn with the tab-separated fields of every line of r that
+// is not blank or a comment.
+func records(r io.Reader, fn func(fields []string)) error {
+	scanner := bufio.NewScanner(r)
+	// Lines of the cities files carry long lists of alternate names.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fn(strings.Split(line, "\t"))
+	}
+	return scanner.Err()
+}
+
+// ReadCities reads a GeoNames cities file. regionNames maps
+// "countrycode.admin1code" and countryNames an ISO code to a name.
+func ReadCities(r io.Reader, regionNames map[string]string, countryNames map[string]string) ([]Place, error) {
+	var places []Place
+	err := records(r, func(fields []string) {
+		if len(fields) < 15 {
+			return
+		}
+		lat, err1 := strconv.ParseFloat(fields[4], 64)
+		lon, err2 := strconv.ParseFloat(fields[5], 64)
+		if err1 != nil || err2 != nil {
+			return
+		}
+		population, _ := strconv.ParseInt(fields[14], 10, 64)
+
+		code := fields[8]
+		p := Place{
+			Name:        fields[1],
+			Region:      regionNames[code+"."+fields[10]],
+			Country:     countryNames[code],
+			CountryCode: code,
+			Latitude:    lat,
+			Longitude:   lon,
+			Population:  population,
+		}
+		if p.Country == "" {
+			p.Country = code
+		}
+		places = append(places, p)
+	})
+	return places, err
+}
+
+// ReadAdmin1 reads admin1CodesASCII.txt into a map from
+// "countrycode.admin1code" to the region name.
+func ReadAdmin1(r io.Reader) (map[string]string, error) {
+	names := make(map[string]string)
+	err := records(r, func(fields []string) {
+		if len(fields) >= 2 {
+			names[fields[0]] = fields[1]
+		}
+	})
+	return names, err
+}
+
+// ReadCountries reads countryInfo.txt into a map from ISO code to the
+// country name.
+func ReadCountries(r io.Reader) (map[string]string, error) {
+	names := make(map[string]string)
+	err := records(r, func(fields []string) {
+		if len(fields) >= 5 {
+			names[fields[0]] = fields[4]
+		}
+	})
+	return names, err
+}
+
+// vector returns the position on the unit sphere, where straight-line
+// distance orders the same as distance along the surface and nothing
+// special happens at the poles or the antimeridian.
+func vector(lat float64, lon float64) [3]float64 {
+	phi := lat * math.Pi / 180
+	lambda := lon * math.Pi / 180
+	return [3]float64{math.Cos(phi) * math.Cos(lambda), math.Cos(phi) * math.Sin(lambda), math.Sin(phi)}
+}
+
+// surfaceDistance converts a chord of the unit sphere into metres.
+func surfaceDistance(chord float64) float64 {
+	return 2 * earthRadius * math.Asin(math.Min(1, chord/2))
+}
@@ -0,0 +1,121 @@
+package places
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// haversine is the distance in metres between two positions.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func TestNearest(t *testing.T) {
+	places := []Place{
+		{Name: "Suva", Latitude: -18.14, Longitude: 178.44},
+		{Name: "Apia", Latitude: -13.83, Longitude: -171.76},
+		{Name: "Longyearbyen", Latitude: 78.22, Longitude: 15.65},
+		{Name: "Alert", Latitude: 82.50, Longitude: -62.35},
+		{Name: "McMurdo", Latitude: -77.85, Longitude: 166.67},
+		{Name: "Singapore", Latitude: 1.29, Longitude: 103.85},
+		{Name: "Greenwich", Latitude: 51.48, Longitude: 0},
+	}
+	idx := NewIndex(places)
+	tests := []struct {
+		name     string
+		lat, lon float64
+		want     string
+	}{
+		{"on a place", 1.29, 103.85, "Singapore"},
+		{"across the antimeridian", -16, -179.9, "Suva"},
+		{"north pole", 90, 120, "Alert"},
+		{"across the pole", 88, -170, "Alert"},
+		{"south pole", -90, 0, "McMurdo"},
+		{"prime meridian", 51, -0.5, "Greenwich"},
+	}
+	for _, test := range tests {
+		p, d := idx.Nearest(test.lat, test.lon)
+		if p == nil || p.Name != test.want {
+			t.Errorf("%s: Nearest = %v, want %s", test.name, p, test.want)
+			continue
+		}
+		if want := haversine(test.lat, test.lon, p.Latitude, p.Longitude); math.Abs(d-want) > 1 {
+			t.Errorf("%s: distance %.0f m, want %.0f m", test.name, d, want)
+		}
+	}
+
+	if p, d := NewIndex(nil).Nearest(0, 0); p != nil || d != 0 {
+		t.Errorf("Nearest of an empty index = %v, %v", p, d)
+	}
+}
+
+// TestNearestBruteForce checks the tree against a linear scan, with
+// duplicate positions among the places.
+func TestNearestBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	position := func() (float64, float64) {
+		return math.Asin(2*r.Float64()-1) * 180 / math.Pi, 360*r.Float64() - 180
+	}
+	for _, n := range []int{1, 2, 3, 10, 1000} {
+		places := make([]Place, n)
+		for i := range places {
+			places[i].Latitude, places[i].Longitude = position()
+			if i%7 == 6 {
+				places[i].Latitude, places[i].Longitude = places[i-1].Latitude, places[i-1].Longitude
+			}
+		}
+		idx := NewIndex(places)
+		if idx.Len() != n {
+			t.Errorf("Len = %d, want %d", idx.Len(), n)
+		}
+		for i := 0; i < 200; i++ {
+			lat, lon := position()
+			best := math.Inf(1)
+			for _, p := range places {
+				best = math.Min(best, haversine(lat, lon, p.Latitude, p.Longitude))
+			}
+			p, d := idx.Nearest(lat, lon)
+			if got := haversine(lat, lon, p.Latitude, p.Longitude); math.Abs(got-best) > 1e-3 || math.Abs(d-best) > 1 {
+				t.Fatalf("%d places: Nearest(%v, %v) at %.3f m, reported %.3f m, want %.3f m", n, lat, lon, got, d, best)
+			}
+		}
+	}
+}
+
+func TestReadCities(t *testing.T) {
+	const cities = "# comment\n" +
+		"1880252\tSingapore\tSingapore\t\t1.28967\t103.85007\tP\tPPLC\tSG\t\t01\t\t\t\t3547809\t\t\t\t\n" +
+		"\n" +
+		"2147714\tSydney\tSydney\t\t-33.86785\t151.20732\tP\tPPLA\tAU\t\t02\t\t\t\t4627345\n" +
+		"1\tBad\tBad\t\tnorth\t1\tP\tPPL\tXX\t\t01\t\t\t\t0\n" +
+		"2\tShort\tShort\n"
+	regions, err := ReadAdmin1(strings.NewReader("AU.02\tNew South Wales\tNew South Wales\t2155400\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	countries, err := ReadCountries(strings.NewReader("#ISO\tISO3\tISO-Numeric\tfips\tCountry\nAU\tAUS\t036\tAS\tAustralia\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	places, err := ReadCities(strings.NewReader(cities), regions, countries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Place{
+		{Name: "Singapore", Country: "SG", CountryCode: "SG", Latitude: 1.28967, Longitude: 103.85007, Population: 3547809},
+		{Name: "Sydney", Region: "New South Wales", Country: "Australia", CountryCode: "AU", Latitude: -33.86785, Longitude: 151.20732, Population: 4627345},
+	}
+	if len(places) != len(want) {
+		t.Fatalf("places = %+v", places)
+	}
+	for i := range want {
+		if places[i] != want[i] {
+			t.Errorf("place %d = %+v, want %+v", i, places[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// node is one token of an XMP document. Elements keep their children and
+// everything else is kept as it was read, so that writing the tree back
+// leaves the parts boonfoto does not know about untouched. Names are as
+// written, with the prefix in Space; uri and attrURI hold what the
+// prefixes resolve to.
+type node struct {
+	tok      xml.Token
+	name     xml.Name
+	attr     []xml.Attr
+	attrURI  []string
+	uri      string
+	scope    map[string]string
+	children []*node
+}
+
+func (n *node) isElement() bool {
+	return n.tok == nil
+}
+
+func (n *node) is(uri string, local string) bool {
+	return n.isElement() && n.uri == uri && n.name.Local == local
+}
+
+// text returns the character data directly inside n.
+func (n *node) text() string {
+	var b bytes.Buffer
+	for _, c := range n.children {
+		if data, ok := c.tok.(xml.CharData); ok {
+			b.Write(data)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func (n *node) walk(fn func(n *node)) {
+	fn(n)
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
+
+// prefixFor returns a prefix bound to uri where n is, or "".
+func (n *node) prefixFor(uri string) string {
+	for prefix, u := range n.scope {
+		if u == uri && prefix != "" {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// bind returns a prefix for uri on n, declaring preferred or a variant of
+// it on n when no prefix is bound to uri yet.
+func (n *node) bind(uri string, preferred string) string {
+	if prefix := n.prefixFor(uri); prefix != "" {
+		return prefix
+	}
+	prefix := preferred
+	for i := 1; n.scope[prefix] != ""; i++ {
+		prefix = preferred + strconv.Itoa(i)
+	}
+	n.attr = append(n.attr, xml.Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: uri})
+	n.attrURI = append(n.attrURI, "")
+	n.setScope(prefix, uri)
+	return prefix
+}
+
+func (n *node) setScope(prefix string, uri string) {
+	scope := make(map[string]string, len(n.scope)+1)
+	for k, v := range n.scope {
+		scope[k] = v
+	}
+	scope[prefix] = uri
+	n.scope = scope
+	for _, c := range n.children {
+		if c.isElement() {
+			c.setScope(prefix, uri)
+		}
+	}
+}
+
+func newElement(parent *node, prefix string, local string, uri string) *node {
+	return &node{name: xml.Name{Space: prefix, Local: local}, uri: uri, scope: parent.scope}
+}
+
+var baseScope = map[string]string{"xml": nsXML}
+
+// parse reads a document into a root node holding its top-level tokens.
+func parse(data []byte) (*node, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+
+	root := &node{scope: baseScope}
+	stack := []*node{root}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name, attr: t.Attr, scope: parent.scope}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					n.setScope(a.Name.Local, a.Value)
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.setScope("", a.Value)
+				}
+			}
+			n.uri = n.scope[t.Name.Space]
+			n.attrURI = make([]string, len(t.Attr))
+			for i, a := range t.Attr {
+				if a.Name.Space != "" && a.Name.Space != "xmlns" {
+					n.attrURI[i] = n.scope[a.Name.Space]
+				}
+			}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 1 {
+				return nil, errInvalid
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			parent.children = append(parent.children, &node{tok: xml.CopyToken(tok)})
+		}
+	}
+	if len(stack) != 1 {
+		return nil, errInvalid
+	}
+	return root, nil
+}
+
+func qname(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;",
+		"\n", "&#xA;", "\r", "&#xD;", "\t", "&#x9;")
+)
+
+func (n *node) write(b *bytes.Buffer) {
+	switch t := n.tok.(type) {
+	case nil:
+		b.WriteString("<" + qname(n.name))
+		for _, a := range n.attr {
+			b.WriteString(" " + qname(a.Name) + `="` + attrEscaper.Replace(a.Value) + `"`)
+		}
+		if len(n.children) == 0 {
+			b.WriteString("/>")
+			return
+		}
+		b.WriteString(">")
+		for _, c := range n.children {
+			c.write(b)
+		}
+		b.WriteString("</" + qname(n.name) + ">")
+	case xml.CharData:
+		b.WriteString(textEscaper.Replace(string(t)))
+	case xml.Comment:
+		b.WriteString("<!--" + string(t) + "-->")
+	case xml.ProcInst:
+		b.WriteString("<?" + t.Target)
+		if len(t.Inst) > 0 {
+			b.WriteString(" " + string(t.Inst))
+		}
+		b.WriteString("?>")
+	case xml.Directive:
+		b.WriteString("<!" + string(t) + ">")
+	}
+}
+
+func (n *node) bytes() []byte {
+	var b bytes.Buffer
+	for _, c := range n.children {
+		c.write(&b)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,149 @@
+package xmp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// darktableSidecar has fields in two descriptions, titles in two languages
+// and properties boonfoto does not know.
+const darktableSidecar = `<?xml version="1.0" encoding="UTF-8"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="XMP Core 4.4.0-Exiv2">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:darktable="http://darktable.sf.net/"
+    xmp:Rating="2"
+    darktable:xmp_version="3">
+   <darktable:history>
+    <rdf:Seq/>
+   </darktable:history>
+  </rdf:Description>
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:title>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">Harbour</rdf:li>
+     <rdf:li xml:lang="de-DE">Hafen</rdf:li>
+    </rdf:Alt>
+   </dc:title>
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="fr-FR">Le port</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+   <dc:rights>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">CC BY</rdf:li>
+    </rdf:Alt>
+   </dc:rights>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+func TestUpdateKeepsOtherFields(t *testing.T) {
+	m, err := Read([]byte(darktableSidecar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Rating = 4
+	data, err := Update([]byte(darktableSidecar), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, kept := range []string{
+		`<rdf:li xml:lang="x-default">Harbour</rdf:li>`,
+		`<rdf:li xml:lang="de-DE">Hafen</rdf:li>`,
+		`<rdf:li xml:lang="fr-FR">Le port</rdf:li>`,
+		`<rdf:li xml:lang="x-default">CC BY</rdf:li>`,
+		`darktable:xmp_version="3"`,
+		`<rdf:Seq/>`,
+	} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("rating update lost %s:\n%s", kept, got)
+		}
+	}
+	if strings.Contains(got, `xmp:Rating="2"`) {
+		t.Errorf("old rating kept:\n%s", got)
+	}
+	if after, err := Read(data); err != nil || !reflect.DeepEqual(after, m) {
+		t.Errorf("Read after Update = %+v, %v, want %+v", after, err, m)
+	}
+}
+
+func TestUpdateUnchanged(t *testing.T) {
+	m, err := Read([]byte(darktableSidecar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Update([]byte(darktableSidecar), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != darktableSidecar {
+		t.Errorf("unchanged update rewrote the sidecar:\n%s", data)
+	}
+}
+
+func TestUpdateLanguageAlternatives(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(m *Metadata)
+		contains []string
+		lacks    []string
+	}{
+		{"title", func(m *Metadata) { m.Title = "Port" },
+			[]string{`<rdf:li xml:lang="x-default">Port</rdf:li>`, `<rdf:li xml:lang="de-DE">Hafen</rdf:li>`},
+			[]string{"Harbour"}},
+		{"description without x-default", func(m *Metadata) { m.Description = "The port" },
+			[]string{"<rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">The port</rdf:li>\n     <rdf:li xml:lang=\"fr-FR\">Le port</rdf:li>"},
+			nil},
+		{"title removed", func(m *Metadata) { m.Title = "" },
+			[]string{`<rdf:li xml:lang="fr-FR">Le port</rdf:li>`},
+			[]string{"dc:title", "Hafen"}},
+	}
+	for _, test := range tests {
+		m, err := Read([]byte(darktableSidecar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.edit(&m)
+		data, err := Update([]byte(darktableSidecar), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(string(data), s) {
+				t.Errorf("%s: no %q in\n%s", test.name, s, data)
+			}
+		}
+		for _, s := range test.lacks {
+			if strings.Contains(string(data), s) {
+				t.Errorf("%s: %q kept in\n%s", test.name, s, data)
+			}
+		}
+		if after, err := Read(data); err != nil || !reflect.DeepEqual(after, m) {
+			t.Errorf("%s: Read after Update = %+v, %v, want %+v", test.name, after, err, m)
+		}
+	}
+}
+
+func TestUpdateDuplicateProperty(t *testing.T) {
+	data := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/" dc:title="Old"/>
+<rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title><rdf:Alt><rdf:li xml:lang="x-default">Older</rdf:li></rdf:Alt></dc:title></rdf:Description>
+</rdf:RDF></x:xmpmeta>`
+	updated, err := Update([]byte(data), Metadata{Title: "New"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(updated), "dc:title") != 2 || strings.Contains(string(updated), "Old") {
+		t.Errorf("copies of the title left:\n%s", updated)
+	}
+	if m, err := Read(updated); err != nil || m.Title != "New" {
+		t.Errorf("Read after Update = %+v, %v", m, err)
+	}
+}
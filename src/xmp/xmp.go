@@ -0,0 +1,518 @@
+// Package xmp reads and updates the fields boonfoto shares with desktop
+// tools in XMP packets, such as the .xmp sidecars darktable, digiKam and
+// Lightroom keep next to images: rating, color label, keywords, title and
+// description. Updating a packet leaves everything else in it as it was.
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"jpegseg"
+)
+
+const (
+	nsRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsXMP = "http://ns.adobe.com/xap/1.0/"
+	nsDC  = "http://purl.org/dc/elements/1.1/"
+	nsX   = "adobe:ns:meta/"
+	nsPS  = "http://ns.adobe.com/photoshop/1.0/"
+	nsXML = "http://www.w3.org/XML/1998/namespace"
+)
+
+var errInvalid = errors.New("xmp: unbalanced elements")
+
+// Metadata holds the shared fields. Rating is 1 to 5 stars, -1 for a
+// rejected image and 0 when unrated. Label is a color label such as "Red".
+// Creator, Rights and City are only read; Update leaves them as they are.
+type Metadata struct {
+	Rating      int
+	Label       string
+	Keywords    []string
+	Title       string
+	Description string
+	Creator     string
+	Rights      string
+	City        string
+}
+
+var jpegHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// EmbedPacket returns the payload of the APP1 segment that embeds packet
+// in a JPEG file.
+func EmbedPacket(packet []byte) []byte {
+	return append(append([]byte(nil), jpegHeader...), packet...)
+}
+
+// FindSegment returns the APP1 segment holding an XMP packet, or nil.
+func FindSegment(segments []jpegseg.Segment) *jpegseg.Segment {
+	for i := range segments {
+		if segments[i].Marker == jpegseg.APP1 && bytes.HasPrefix(segments[i].Data, jpegHeader) {
+			return &segments[i]
+		}
+	}
+	return nil
+}
+
+// FindPacket returns the XMP packet embedded in the APP1 segments of a JPEG
+// file, or nil.
+func FindPacket(segments []jpegseg.Segment) []byte {
+	if s := FindSegment(segments); s != nil {
+		return s.Data[len(jpegHeader):]
+	}
+	return nil
+}
+
+// ReadFile reads the fields of an XMP file.
+func ReadFile(path string) (Metadata, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return Read(data)
+}
+
+// Read returns the fields found in an XMP packet. Fields can be written as
+// attributes of rdf:Description or as elements inside it, and there can be
+// several rdf:Description elements.
+func Read(data []byte) (Metadata, error) {
+	root, err := parse(data)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return read(root), nil
+}
+
+func read(root *node) Metadata {
+	var m Metadata
+	root.walk(func(n *node) {
+		if !n.is(nsRDF, "Description") {
+			return
+		}
+		for i, a := range n.attr {
+			m.set(n.attrURI[i], a.Name.Local, a.Value, nil)
+		}
+		for _, c := range n.children {
+			if c.isElement() {
+				m.set(c.uri, c.name.Local, c.text(), c)
+			}
+		}
+	})
+	return m
+}
+
+// set reads one property, given as value or, for structured ones, as the
+// element el.
+func (m *Metadata) set(uri string, local string, value string, el *node) {
+	switch {
+	case uri == nsXMP && local == "Rating":
+		if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && f >= -1 && f <= 5 {
+			m.Rating = int(f)
+		}
+	case uri == nsXMP && local == "Label":
+		m.Label = value
+	case uri == nsDC && local == "subject" && el != nil:
+		m.Keywords = items(el)
+	case uri == nsDC && local == "subject":
+		m.Keywords = splitKeywords(value)
+	case uri == nsDC && local == "title":
+		m.Title = altText(el, value)
+	case uri == nsDC && local == "description":
+		m.Description = altText(el, value)
+	case uri == nsDC && local == "creator" && el != nil:
+		m.Creator = strings.Join(items(el), ", ")
+	case uri == nsDC && local == "creator":
+		m.Creator = value
+	case uri == nsDC && local == "rights":
+		m.Rights = altText(el, value)
+	case uri == nsPS && local == "City":
+		m.City = value
+	}
+}
+
+// items returns the rdf:li texts of the bag or sequence inside el.
+func items(el *node) []string {
+	var values []string
+	el.walk(func(n *node) {
+		if n.is(nsRDF, "li") {
+			if v := n.text(); v != "" {
+				values = append(values, v)
+			}
+		}
+	})
+	if len(values) == 0 {
+		return splitKeywords(el.text())
+	}
+	return values
+}
+
+func splitKeywords(s string) []string {
+	var keywords []string
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+// altText picks the default language entry of a language alternative,
+// else its first entry.
+func altText(el *node, value string) string {
+	if el == nil {
+		return value
+	}
+	first := ""
+	found := ""
+	el.walk(func(n *node) {
+		if !n.is(nsRDF, "li") {
+			return
+		}
+		if isDefault(n) && found == "" {
+			found = n.text()
+		}
+		if first == "" {
+			first = n.text()
+		}
+	})
+	switch {
+	case found != "":
+		return found
+	case first != "":
+		return first
+	}
+	return value
+}
+
+// isDefault reports whether the rdf:li n is the x-default entry of a
+// language alternative.
+func isDefault(n *node) bool {
+	for i, a := range n.attr {
+		if n.attrURI[i] == nsXML && a.Name.Local == "lang" && a.Value == "x-default" {
+			return true
+		}
+	}
+	return false
+}
+
+const xmpmeta = `<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="boonfoto">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""/>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+// A sidecar is a plain XML file, while a packet embedded in a file is
+// wrapped in processing instructions that let tools find it.
+const (
+	sidecarTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+` + xmpmeta
+	packetTemplate = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" + xmpmeta + `<?xpacket end="w"?>`
+)
+
+// Update returns the XMP data of a sidecar with its rating, label,
+// keywords, title and description set to those of m. Only the fields that
+// differ from data are rewritten, and empty ones are removed; a new title
+// or description replaces the x-default entry of an existing language
+// alternative and keeps the other languages. data may be empty to start a
+// new sidecar.
+func Update(data []byte, m Metadata) ([]byte, error) {
+	return update(data, m, sidecarTemplate)
+}
+
+// UpdatePacket is Update for a packet embedded in a file.
+func UpdatePacket(packet []byte, m Metadata) ([]byte, error) {
+	return update(packet, m, packetTemplate)
+}
+
+// property names a field of Metadata in a packet.
+type property struct {
+	uri   string
+	local string
+}
+
+var (
+	propRating      = property{nsXMP, "Rating"}
+	propLabel       = property{nsXMP, "Label"}
+	propKeywords    = property{nsDC, "subject"}
+	propTitle       = property{nsDC, "title"}
+	propDescription = property{nsDC, "description"}
+)
+
+// changedFields returns the properties whose value in m differs from
+// current.
+func changedFields(current Metadata, m Metadata) map[property]bool {
+	changed := make(map[property]bool)
+	if m.Rating != current.Rating {
+		changed[propRating] = true
+	}
+	if m.Label != current.Label {
+		changed[propLabel] = true
+	}
+	if strings.Join(m.Keywords, "\x00") != strings.Join(current.Keywords, "\x00") {
+		changed[propKeywords] = true
+	}
+	if m.Title != current.Title {
+		changed[propTitle] = true
+	}
+	if m.Description != current.Description {
+		changed[propDescription] = true
+	}
+	return changed
+}
+
+func update(data []byte, m Metadata, template string) ([]byte, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		data = []byte(template)
+	}
+	root, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	changed := changedFields(read(root), m)
+	if len(changed) == 0 {
+		return data, nil
+	}
+
+	var descriptions []*node
+	var rdf *node
+	root.walk(func(n *node) {
+		switch {
+		case n.is(nsRDF, "Description"):
+			descriptions = append(descriptions, n)
+		case n.is(nsRDF, "RDF") && rdf == nil:
+			rdf = n
+		}
+	})
+	if rdf == nil {
+		return nil, errors.New("xmp: no rdf:RDF element")
+	}
+
+	// A new title or description goes into the language alternative the
+	// packet has for it, which Read takes from the last description.
+	kept := make(map[*node]bool)
+	for _, f := range []struct {
+		prop  property
+		value string
+	}{{propTitle, m.Title}, {propDescription, m.Description}} {
+		if !changed[f.prop] || f.value == "" {
+			continue
+		}
+		var el *node
+		for _, d := range descriptions {
+			for _, c := range d.children {
+				if c.is(f.prop.uri, f.prop.local) {
+					el = c
+				}
+			}
+		}
+		if el != nil && setDefault(el, f.value) {
+			// Still remove copies elsewhere, which would hide the new
+			// value, but do not add the property again.
+			kept[el] = true
+			changed[f.prop] = false
+		}
+	}
+	for _, d := range descriptions {
+		removeFields(d, changed, kept)
+	}
+
+	var target *node
+	if len(descriptions) > 0 {
+		target = descriptions[0]
+	} else {
+		target = newElement(rdf, rdf.name.Space, "Description", nsRDF)
+		target.attr = []xml.Attr{{Name: xml.Name{Space: rdf.name.Space, Local: "about"}}}
+		target.attrURI = []string{nsRDF}
+		appendChild(rdf, target, depth(root, rdf)+1)
+	}
+	addFields(target, m, changed, depth(root, target)+1)
+	return root.bytes(), nil
+}
+
+// setDefault sets the x-default entry of the rdf:Alt inside el to value,
+// adding one in front of the other languages when there is none. It
+// reports false when el holds no rdf:Alt.
+func setDefault(el *node, value string) bool {
+	var alt *node
+	el.walk(func(n *node) {
+		if alt == nil && n.is(nsRDF, "Alt") {
+			alt = n
+		}
+	})
+	if alt == nil {
+		return false
+	}
+	for _, li := range alt.children {
+		if li.is(nsRDF, "li") && isDefault(li) {
+			li.children = []*node{{tok: xml.CharData(value)}}
+			return true
+		}
+	}
+
+	li := textElement(alt, alt.name.Space, "li", nsRDF, value)
+	li.attr = []xml.Attr{{Name: xml.Name{Space: "xml", Local: "lang"}, Value: "x-default"}}
+	li.attrURI = []string{nsXML}
+	children := []*node{li}
+	if len(alt.children) > 0 && isSpace(alt.children[0]) {
+		// Indent it like the entry that follows.
+		children = []*node{alt.children[0], li, {tok: alt.children[0].tok}}
+		alt.children = alt.children[1:]
+	}
+	alt.children = append(children, alt.children...)
+	return true
+}
+
+// removeFields drops the properties that are keys of fields from d, but
+// for the elements in kept.
+func removeFields(d *node, fields map[property]bool, kept map[*node]bool) {
+	attr, attrURI := d.attr[:0], d.attrURI[:0]
+	for i, a := range d.attr {
+		if _, ok := fields[property{d.attrURI[i], a.Name.Local}]; !ok {
+			attr, attrURI = append(attr, a), append(attrURI, d.attrURI[i])
+		}
+	}
+	d.attr, d.attrURI = attr, attrURI
+
+	var children []*node
+	for i, c := range d.children {
+		if _, ok := fields[property{c.uri, c.name.Local}]; ok && c.isElement() && !kept[c] {
+			// Drop the indentation in front of it as well.
+			if len(children) > 0 && isSpace(children[len(children)-1]) && i > 0 {
+				children = children[:len(children)-1]
+			}
+			continue
+		}
+		children = append(children, c)
+	}
+	d.children = children
+}
+
+func isSpace(n *node) bool {
+	data, ok := n.tok.(xml.CharData)
+	return ok && strings.TrimSpace(string(data)) == ""
+}
+
+// depth returns how many elements deep n is below root.
+func depth(root *node, n *node) int {
+	var find func(cur *node, d int) int
+	find = func(cur *node, d int) int {
+		if cur == n {
+			return d
+		}
+		for _, c := range cur.children {
+			if c.isElement() {
+				if found := find(c, d+1); found >= 0 {
+					return found
+				}
+			}
+		}
+		return -1
+	}
+	return find(root, 0) - 1
+}
+
+// appendChild adds child as the last element of parent, indented by one
+// space per level like the packets Adobe tools write.
+func appendChild(parent *node, child *node, level int) {
+	indent := "\n" + strings.Repeat(" ", level)
+	closing := "\n" + strings.Repeat(" ", level-1)
+
+	children := parent.children
+	if n := len(children); n > 0 && isSpace(children[n-1]) {
+		children = children[:n-1]
+	}
+	parent.children = append(children, &node{tok: xml.CharData(indent)}, child, &node{tok: xml.CharData(closing)})
+}
+
+// addFields writes the fields of m that are set to true in changed.
+func addFields(d *node, m Metadata, changed map[property]bool, level int) {
+	rdf := d.name.Space
+	if changed[propRating] && m.Rating != 0 {
+		x := d.bind(nsXMP, "xmp")
+		appendChild(d, textElement(d, x, "Rating", nsXMP, strconv.Itoa(m.Rating)), level)
+	}
+	if changed[propLabel] && m.Label != "" {
+		x := d.bind(nsXMP, "xmp")
+		appendChild(d, textElement(d, x, "Label", nsXMP, m.Label), level)
+	}
+	if changed[propTitle] && m.Title != "" {
+		dc := d.bind(nsDC, "dc")
+		appendChild(d, container(d, dc, "title", rdf, "Alt", []string{m.Title}, level), level)
+	}
+	if changed[propDescription] && m.Description != "" {
+		dc := d.bind(nsDC, "dc")
+		appendChild(d, container(d, dc, "description", rdf, "Alt", []string{m.Description}, level), level)
+	}
+	if changed[propKeywords] && len(m.Keywords) > 0 {
+		dc := d.bind(nsDC, "dc")
+		appendChild(d, container(d, dc, "subject", rdf, "Bag", m.Keywords, level), level)
+	}
+}
+
+func textElement(parent *node, prefix string, local string, uri string, text string) *node {
+	el := newElement(parent, prefix, local, uri)
+	el.children = []*node{{tok: xml.CharData(text)}}
+	return el
+}
+
+// container builds a property holding an rdf:Alt with x-default entries
+// or an rdf:Bag of values.
+func container(parent *node, prefix string, local string, rdf string, kind string, values []string, level int) *node {
+	el := newElement(parent, prefix, local, nsDC)
+	list := newElement(el, rdf, kind, nsRDF)
+	for _, v := range values {
+		li := textElement(list, rdf, "li", nsRDF, v)
+		if kind == "Alt" {
+			li.attr = []xml.Attr{{Name: xml.Name{Space: "xml", Local: "lang"}, Value: "x-default"}}
+			li.attrURI = []string{nsXML}
+		}
+		appendChild(list, li, level+2)
+	}
+	appendChild(el, list, level+1)
+	return el
+}
+
+// WriteFile sets the fields of the XMP file at path to m, creating the
+// file if needed. The file is replaced in one rename, so readers never see
+// it half written.
+func WriteFile(path string, m Metadata) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	data, err = Update(data, m)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
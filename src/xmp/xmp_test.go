@@ -0,0 +1,131 @@
+package xmp
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"jpegseg"
+)
+
+func TestRead(t *testing.T) {
+	const head = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`
+	const tail = `</rdf:RDF></x:xmpmeta>`
+	const ns = ` xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+		` xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"`
+	tests := []struct {
+		name string
+		body string
+		want Metadata
+	}{
+		{"attributes", `<rdf:Description` + ns + ` xmp:Rating="3" xmp:Label="Red" photoshop:City="Perth" dc:subject="a, b,,c"/>`,
+			Metadata{Rating: 3, Label: "Red", City: "Perth", Keywords: []string{"a", "b", "c"}}},
+		{"elements", `<rdf:Description` + ns + `><xmp:Rating>5</xmp:Rating>
+			<dc:subject><rdf:Bag><rdf:li>beach</rdf:li><rdf:li> </rdf:li><rdf:li>sea &amp; sand</rdf:li></rdf:Bag></dc:subject>
+			<dc:creator><rdf:Seq><rdf:li>Ann</rdf:li><rdf:li>Bob</rdf:li></rdf:Seq></dc:creator></rdf:Description>`,
+			Metadata{Rating: 5, Keywords: []string{"beach", "sea & sand"}, Creator: "Ann, Bob"}},
+		{"default language", `<rdf:Description` + ns + `><dc:title><rdf:Alt>
+			<rdf:li xml:lang="de">Hafen</rdf:li><rdf:li xml:lang="x-default">Harbour</rdf:li></rdf:Alt></dc:title></rdf:Description>`,
+			Metadata{Title: "Harbour"}},
+		{"first language", `<rdf:Description` + ns + `><dc:description><rdf:Alt>
+			<rdf:li xml:lang="de">Hafen</rdf:li><rdf:li xml:lang="fr">Port</rdf:li></rdf:Alt></dc:description></rdf:Description>`,
+			Metadata{Description: "Hafen"}},
+		{"other prefixes", `<rdf:Description xmlns:a="http://ns.adobe.com/xap/1.0/" xmlns:b="http://purl.org/dc/elements/1.1/" a:Rating="2">
+			<b:rights><rdf:Alt><rdf:li xml:lang="x-default">CC BY</rdf:li></rdf:Alt></b:rights></rdf:Description>`,
+			Metadata{Rating: 2, Rights: "CC BY"}},
+		{"several descriptions", `<rdf:Description` + ns + ` xmp:Rating="1"/><rdf:Description` + ns + ` xmp:Rating="4" xmp:Label="Blue"/>`,
+			Metadata{Rating: 4, Label: "Blue"}},
+		{"rejected", `<rdf:Description` + ns + ` xmp:Rating="-1"/>`, Metadata{Rating: -1}},
+		{"decimal rating", `<rdf:Description` + ns + ` xmp:Rating="3.0"/>`, Metadata{Rating: 3}},
+		{"rating out of range", `<rdf:Description` + ns + ` xmp:Rating="7"/>`, Metadata{}},
+		{"other namespace", `<rdf:Description xmlns:xmp="http://example.com/" xmp:Rating="3"/>`, Metadata{}},
+	}
+	for _, test := range tests {
+		m, err := Read([]byte(head + test.body + tail))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, test.want) {
+			t.Errorf("%s: Read = %+v, want %+v", test.name, m, test.want)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, data := range []string{
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/">`,
+		`</a>`,
+		`<a>&bogus;</a>`,
+	} {
+		if _, err := Read([]byte(data)); err == nil {
+			t.Errorf("Read(%q) = nil error", data)
+		}
+	}
+}
+
+func TestUpdateNew(t *testing.T) {
+	m := Metadata{Rating: 4, Label: "Red", Keywords: []string{"beach", "sea"}, Title: "Harbour", Description: "A <busy> day & night"}
+	for _, update := range []func([]byte, Metadata) ([]byte, error){Update, UpdatePacket} {
+		data, err := update(nil, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := Read(data); err != nil || !reflect.DeepEqual(got, m) {
+			t.Errorf("Read of a new packet = %+v, %v, want %+v", got, err, m)
+		}
+
+		data, err = update(data, Metadata{Rating: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := Read(data); err != nil || !reflect.DeepEqual(got, Metadata{Rating: 4}) {
+			t.Errorf("Read after clearing = %+v, %v", got, err)
+		}
+	}
+}
+
+func TestUpdateWithoutDescription(t *testing.T) {
+	data := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"></rdf:RDF></x:xmpmeta>`
+	updated, err := Update([]byte(data), Metadata{Rating: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := Read(updated); err != nil || m.Rating != 2 {
+		t.Errorf("Read = %+v, %v", m, err)
+	}
+	if _, err := Update([]byte(`<a/>`), Metadata{Rating: 2}); err == nil {
+		t.Error("Update without rdf:RDF succeeded")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.jpg.xmp")
+	if err := WriteFile(path, Metadata{Rating: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, Metadata{Rating: 3, Keywords: []string{"x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ReadFile(path); err != nil || !reflect.DeepEqual(m, Metadata{Rating: 3, Keywords: []string{"x"}}) {
+		t.Errorf("ReadFile = %+v, %v", m, err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("%d files left, want the sidecar only", len(files))
+	}
+}
+
+func TestFindPacket(t *testing.T) {
+	packet := []byte("<x:xmpmeta/>")
+	segments := []jpegseg.Segment{
+		{Marker: jpegseg.APP1, Data: []byte("Exif\x00\x00II*\x00")},
+		{Marker: jpegseg.APP1, Data: EmbedPacket(packet)},
+	}
+	if got := FindPacket(segments); string(got) != string(packet) {
+		t.Errorf("FindPacket = %q", got)
+	}
+	if got := FindPacket(segments[:1]); got != nil {
+		t.Errorf("FindPacket without XMP = %q", got)
+	}
+}